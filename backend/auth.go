@@ -48,6 +48,20 @@ func (auth *Auth) Protect(next http.Handler) http.Handler {
 	})
 }
 
+// Admin is a middleware that only allows administrators.
+// It must be used after Protect.
+func (auth *Auth) Admin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := ContextUser(r.Context())
+		if !ok || !user.Admin {
+			http.Error(w, "Administrators only", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 type HTTPLoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
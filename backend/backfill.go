@@ -0,0 +1,351 @@
+// Copies the full history of every chat from Chat-API to the database.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Backfill walks every chat backwards, one page at a time, until its first message.
+// Progress is stored in the database, so an interrupted backfill continues where it stopped.
+type Backfill struct {
+	*ChatAPIDB
+	// Messages requested per page.
+	PageSize int
+	// Largest page requested when many messages have the same time.
+	MaxPageSize int
+	// Minimum time between Chat-API requests.
+	Interval time.Duration
+	// Longest wait after Chat-API errors.
+	MaxInterval time.Duration
+	// A chat is skipped until the next run after this many consecutive errors.
+	MaxErrors int
+
+	mu      sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running bool
+	chatID  string // chat being copied
+	lastErr string
+}
+
+type BackfillStatus struct {
+	*BackfillProgress
+	Running   bool   `json:"running"`
+	ChatID    string `json:"chatId"`
+	LastError string `json:"lastError"`
+}
+
+func NewBackfill(ctx context.Context, wadb *ChatAPIDB) *Backfill {
+	return &Backfill{
+		ChatAPIDB:   wadb,
+		PageSize:    100,
+		MaxPageSize: 10000,
+		Interval:    time.Second,
+		MaxInterval: 5 * time.Minute,
+		MaxErrors:   5,
+		ctx:         ctx,
+	}
+}
+
+// Start runs the backfill in the background.
+// minTime stops the backfill at messages older than this unix time (0 copies everything).
+func (bf *Backfill) Start(minTime int64) bool {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+
+	if bf.running {
+		return false
+	}
+	ctx, cancel := context.WithCancel(bf.ctx)
+	bf.running = true
+	bf.cancel = cancel
+	bf.lastErr = ""
+
+	go func() {
+		defer cancel()
+		err := bf.Run(ctx, minTime)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Backfill.Run: %v", err)
+			bf.setError(err)
+		}
+		bf.mu.Lock()
+		bf.running = false
+		bf.chatID = ""
+		bf.mu.Unlock()
+	}()
+
+	return true
+}
+
+// Stop interrupts a running backfill.
+func (bf *Backfill) Stop() {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+
+	if bf.cancel != nil {
+		bf.cancel()
+	}
+}
+
+// Status returns the progress of the backfill.
+func (bf *Backfill) Status(ctx context.Context) (*BackfillStatus, error) {
+	progress, err := bf.DB.GetBackfillProgress(ctx, bf.Instance)
+	if err != nil {
+		return nil, err
+	}
+
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	return &BackfillStatus{progress, bf.running, bf.chatID, bf.lastErr}, nil
+}
+
+func (bf *Backfill) setError(err error) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	bf.lastErr = err.Error()
+}
+
+// Run copies the history of all chats and returns when done or when ctx is canceled.
+func (bf *Backfill) Run(ctx context.Context, minTime int64) error {
+	// Add chats that appeared since the last run.
+	chats, err := bf.Provider.GetChats(ctx)
+	if err != nil {
+		return err
+	}
+	chatIDs := make([]string, 0, len(chats))
+	for _, chat := range chats {
+		chatIDs = append(chatIDs, chat.ID)
+	}
+	err = bf.DB.AddBackfillChats(ctx, bf.Instance, chatIDs)
+	if err != nil {
+		return err
+	}
+
+	// Copy chats that were not finished.
+	pending, err := bf.DB.GetPendingBackfillChats(ctx, bf.Instance)
+	if err != nil {
+		return err
+	}
+	for i, chat := range pending {
+		log.Printf("Backfill: chat %d of %d: %v", i+1, len(pending), chat.ChatID)
+		bf.mu.Lock()
+		bf.chatID = chat.ChatID
+		bf.mu.Unlock()
+
+		err = bf.RunChat(ctx, chat, minTime)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Backfill.RunChat(%v): %v", chat.ChatID, err)
+			bf.setError(err)
+			// Keep working on other chats.
+		}
+	}
+
+	log.Printf("Backfill: finished")
+	return nil
+}
+
+// RunChat pages backwards through one chat.
+// With minTime, it stops at that time without marking the chat as done.
+func (bf *Backfill) RunChat(ctx context.Context, chat *BackfillChat, minTime int64) error {
+	failures := 0
+	wait := bf.Interval
+	limit := bf.PageSize
+	maxLimit := bf.MaxPageSize
+	if maxLimit < 2*bf.PageSize {
+		maxLimit = 2 * bf.PageSize
+	}
+
+	for !chat.Done {
+		// Respect the Chat-API rate limit.
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		// Request one page.
+		messages, _, err := bf.Provider.GetMessages(ctx, GetMessagesOptions{
+			ChatID:  chat.ChatID,
+			Limit:   limit,
+			MinTime: minTime,
+			MaxTime: chat.MaxTime,
+		})
+		if err == nil && len(messages) == 0 {
+			// Only the beginning of the chat is the end of its history.
+			if minTime > 0 {
+				return nil
+			}
+			chat.Done = true
+		} else if err == nil {
+			var full bool
+			full, err = bf.copyPage(ctx, chat, messages, limit)
+			if err == nil && full {
+				// The page did not reach older messages; request more of that second.
+				limit *= 2
+				if limit > maxLimit {
+					log.Printf("Backfill(%v): more than %d messages at %d, some may be missing", chat.ChatID, maxLimit, chat.MaxTime)
+					chat.MaxTime--
+					limit = bf.PageSize
+				}
+				continue
+			}
+			limit = bf.PageSize
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failures++
+			chat.LastError = err.Error()
+			if err := bf.DB.UpdateBackfillChat(ctx, chat); err != nil {
+				log.Printf("Database.UpdateBackfillChat: %v", err)
+			}
+			if failures >= bf.MaxErrors {
+				return err
+			}
+			// Back off.
+			wait *= 2
+			if wait > bf.MaxInterval {
+				wait = bf.MaxInterval
+			}
+			continue
+		}
+		failures = 0
+		wait = bf.Interval
+
+		// Save progress.
+		chat.LastError = ""
+		err = bf.DB.UpdateBackfillChat(ctx, chat)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyPage stores messages and moves the chat cursor to the oldest one.
+// The messages and the new cursor are saved in the same transaction.
+// It returns true, without moving the cursor, if a full page of limit messages
+// is in the second the cursor is already at, so that more of that second must be requested.
+func (bf *Backfill) copyPage(ctx context.Context, chat *BackfillChat, messages []*Message, limit int) (bool, error) {
+	// Find the oldest message.
+	next := *chat
+	oldest := messages[0].Timestamp
+	for _, message := range messages {
+		if message.Timestamp < oldest {
+			oldest = message.Timestamp
+		}
+	}
+
+	// Messages sent in the same second as the previous page are requested again.
+	full := false
+	if next.MaxTime > 0 && oldest >= next.MaxTime {
+		if len(messages) >= limit {
+			full = true
+			oldest = next.MaxTime
+		} else {
+			// The whole second was received.
+			oldest = next.MaxTime - 1
+		}
+	}
+	if !full {
+		next.Messages += int64(len(messages))
+	}
+	next.MaxTime = oldest
+	if oldest <= 0 {
+		next.Done = true
+	}
+
+	// Store messages and progress.
+	err := bf.DB.AddMessages(ctx, "REPLACE", messages, func(tx dbtx) error {
+		err := updateBackfillChat(ctx, tx, &next)
+		if err != nil {
+			return err
+		}
+		return setSyncBackfill(ctx, tx, bf.Name, next.ChatID, next.MaxTime)
+	})
+	if err != nil {
+		return false, fmt.Errorf("Database.AddMessages: %v", err)
+	}
+	*chat = next
+
+	return full, nil
+}
+
+// HTTPStatus sends the backfill progress.
+func (bf *Backfill) HTTPStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := bf.Status(r.Context())
+	if err != nil {
+		log.Printf("Backfill.Status: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+// HTTPStart starts the backfill.
+//
+// Query parameters:
+// since: do not copy messages older than this unix time.
+// reset: start again from the newest messages of every chat.
+func (bf *Backfill) HTTPStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	uq := r.URL.Query()
+
+	// Get minimum time.
+	var since int64
+	if uq.Has("since") {
+		var err error
+		since, err = strconv.ParseInt(uq.Get("since"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Forget progress.
+	if uq.Has("reset") {
+		status, err := bf.Status(r.Context())
+		if err == nil && status.Running {
+			http.Error(w, "Backfill is running", http.StatusConflict)
+			return
+		}
+		err = bf.DB.ResetBackfill(r.Context(), bf.Instance)
+		if err != nil {
+			log.Printf("Database.ResetBackfill: %v", err)
+			http.Error(w, "Cannot access database", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !bf.Start(since) {
+		http.Error(w, "Backfill is running", http.StatusConflict)
+		return
+	}
+}
+
+// HTTPStop stops the backfill.
+func (bf *Backfill) HTTPStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bf.Stop()
+}
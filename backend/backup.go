@@ -0,0 +1,171 @@
+// Backs up the database to a directory on a schedule, keeping the newest backups.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backups in the directory are named backupPrefix + time + extension.
+const backupPrefix = "chatapi-"
+
+// Backuper writes backups of the database into Config.Dir.
+type Backuper struct {
+	DB     *Database
+	Config *ConfigBackup
+
+	// Only one backup at a time.
+	mu sync.Mutex
+}
+
+func NewBackuper(db *Database, cf *ConfigBackup) *Backuper {
+	return &Backuper{DB: db, Config: cf}
+}
+
+// BackupFile is a backup in the directory.
+type BackupFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// Loop runs Run every Config.Interval hours until ctx is done.
+func (b *Backuper) Loop(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(b.Config.Interval) * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		file, err := b.Run(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Backuper.Run: %v", err)
+		} else {
+			log.Printf("Backuper: wrote %s (%d bytes)", file.Path, file.Size)
+		}
+	}
+}
+
+// Run writes a new backup into the directory, then deletes the oldest ones beyond Config.Keep.
+func (b *Backuper) Run(ctx context.Context) (*BackupFile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.Config.Dir == "" {
+		return nil, fmt.Errorf("no backup directory in the configuration")
+	}
+	err := os.MkdirAll(b.Config.Dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write backup.
+	path := filepath.Join(b.Config.Dir, backupPrefix+time.Now().UTC().Format("20060102-150405")+".sqlite")
+	err = b.DB.Backup(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rotate.
+	files, err := b.Files()
+	if err != nil {
+		return nil, err
+	}
+	for i := b.Config.Keep; i < len(files); i++ {
+		err = os.Remove(files[i].Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &BackupFile{Path: path, Size: fi.Size(), Created: fi.ModTime()}, nil
+}
+
+// Files returns the backups in the directory, newest first.
+func (b *Backuper) Files() ([]*BackupFile, error) {
+	files := make([]*BackupFile, 0, b.Config.Keep)
+
+	entries, err := os.ReadDir(b.Config.Dir)
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), backupPrefix) {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, &BackupFile{Path: filepath.Join(b.Config.Dir, entry.Name()), Size: fi.Size(), Created: fi.ModTime()})
+	}
+
+	// Names sort by time.
+	sort.Slice(files, func(i, j int) bool { return files[i].Path > files[j].Path })
+	return files, nil
+}
+
+// HTTPFiles sends the backups in the directory.
+func (b *Backuper) HTTPFiles(w http.ResponseWriter, r *http.Request) {
+	files, err := b.Files()
+	if err != nil {
+		log.Printf("Backuper.Files: %v", err)
+		http.Error(w, "Cannot read backup directory", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"backups": files})
+}
+
+// HTTPRun writes a backup now.
+func (b *Backuper) HTTPRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, err := b.Run(r.Context())
+	if err != nil {
+		log.Printf("Backuper.Run: %v", err)
+		http.Error(w, "Cannot write backup", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(file)
+}
+
+// HTTPIntegrityCheck sends the problems found by PRAGMA integrity_check in the database.
+func (b *Backuper) HTTPIntegrityCheck(w http.ResponseWriter, r *http.Request) {
+	problems, err := b.DB.IntegrityCheck(r.Context())
+	if err != nil {
+		log.Printf("Database.IntegrityCheck: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": len(problems) == 0, "problems": problems})
+}
@@ -0,0 +1,249 @@
+// Chat-API methods that the frontend calls through the proxy.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+)
+
+// ChatTarget selects a chat by ID or, for private chats, by phone number.
+type ChatTarget struct {
+	ChatID string `json:"chatId,omitempty"`
+	Phone  string `json:"phone,omitempty"`
+}
+
+// ChatActionResponse is returned by the methods that change a chat.
+type ChatActionResponse struct {
+	ChatID string `json:"chatId"`
+	Result string `json:"result"`
+}
+
+type SendMessageOptions struct {
+	ChatTarget
+	Body            string   `json:"body"`
+	QuotedMsgID     string   `json:"quotedMsgId,omitempty"`
+	MentionedPhones []string `json:"mentionedPhones,omitempty"`
+}
+
+type SendFileOptions struct {
+	ChatTarget
+	// URL or base64 data URI of the file.
+	Body        string `json:"body"`
+	Filename    string `json:"filename"`
+	Caption     string `json:"caption,omitempty"`
+	QuotedMsgID string `json:"quotedMsgId,omitempty"`
+}
+
+type SendMessageResponse struct {
+	Sent        bool   `json:"sent"`
+	Message     string `json:"message"`
+	ID          string `json:"id"`
+	QueueNumber int    `json:"queueNumber"`
+}
+
+// SendMessage sends a text message.
+func (wa *ChatAPI) SendMessage(ctx context.Context, options SendMessageOptions) (*SendMessageResponse, error) {
+	log.Printf("ChatAPI.SendMessage(%+v)", options.ChatTarget)
+	return wa.sendMessage(ctx, "/sendMessage", options)
+}
+
+// SendFile sends a file, with an optional caption.
+func (wa *ChatAPI) SendFile(ctx context.Context, options SendFileOptions) (*SendMessageResponse, error) {
+	log.Printf("ChatAPI.SendFile(%+v, %v)", options.ChatTarget, options.Filename)
+	return wa.sendMessage(ctx, "/sendFile", options)
+}
+
+func (wa *ChatAPI) sendMessage(ctx context.Context, path string, options interface{}) (*SendMessageResponse, error) {
+	var j SendMessageResponse
+	err := wa.request(ctx, "POST", path, nil, options, &j)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check response.
+	if !j.Sent {
+		return nil, fmt.Errorf("Chat-API %v: not sent: %v", path, j.Message)
+	}
+
+	return &j, nil
+}
+
+type ReadChatResponse struct {
+	Read    bool   `json:"read"`
+	ChatID  string `json:"chatId"`
+	Message string `json:"message"`
+}
+
+// ReadChat marks all messages of a chat as read.
+func (wa *ChatAPI) ReadChat(ctx context.Context, target ChatTarget) error {
+	log.Printf("ChatAPI.ReadChat(%+v)", target)
+
+	var j ReadChatResponse
+	err := wa.request(ctx, "POST", "/readChat", nil, target, &j)
+	if err != nil {
+		return err
+	}
+
+	// Check response.
+	if !j.Read {
+		return fmt.Errorf("Chat-API /readChat: not read: %v", j.Message)
+	}
+
+	return nil
+}
+
+// UnreadChat marks a chat as unread.
+func (wa *ChatAPI) UnreadChat(ctx context.Context, target ChatTarget) (*ChatActionResponse, error) {
+	log.Printf("ChatAPI.UnreadChat(%+v)", target)
+	return wa.chatAction(ctx, "/unreadChat", target)
+}
+
+// ArchiveChat archives a chat.
+func (wa *ChatAPI) ArchiveChat(ctx context.Context, target ChatTarget) (*ChatActionResponse, error) {
+	log.Printf("ChatAPI.ArchiveChat(%+v)", target)
+	return wa.chatAction(ctx, "/archiveChat", target)
+}
+
+type LabelChatOptions struct {
+	ChatTarget
+	LabelID string `json:"labelId"`
+}
+
+// LabelChat adds a label to a chat.
+func (wa *ChatAPI) LabelChat(ctx context.Context, options LabelChatOptions) (*ChatActionResponse, error) {
+	log.Printf("ChatAPI.LabelChat(%+v)", options)
+	return wa.chatAction(ctx, "/labelChat", options)
+}
+
+// UnlabelChat removes a label from a chat.
+func (wa *ChatAPI) UnlabelChat(ctx context.Context, options LabelChatOptions) (*ChatActionResponse, error) {
+	log.Printf("ChatAPI.UnlabelChat(%+v)", options)
+	return wa.chatAction(ctx, "/unlabelChat", options)
+}
+
+func (wa *ChatAPI) chatAction(ctx context.Context, path string, options interface{}) (*ChatActionResponse, error) {
+	var j ChatActionResponse
+	err := wa.request(ctx, "POST", path, nil, options, &j)
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+type Label struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	HexColor string `json:"hexColor"`
+}
+
+type GetLabelsResponse struct {
+	Labels *[]*Label `json:"labels"`
+}
+
+// GetLabels lists the labels of the account.
+func (wa *ChatAPI) GetLabels(ctx context.Context) ([]*Label, error) {
+	log.Printf("ChatAPI.GetLabels()")
+
+	var j GetLabelsResponse
+	err := wa.request(ctx, "GET", "/labelsList", nil, nil, &j)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check response.
+	if j.Labels == nil {
+		return nil, fmt.Errorf("Chat-API /labelsList is missing key labels")
+	}
+
+	return *j.Labels, nil
+}
+
+type CheckPhoneResponse struct {
+	Result string `json:"result"`
+}
+
+// CheckPhone returns true if the phone number has a WhatsApp account.
+func (wa *ChatAPI) CheckPhone(ctx context.Context, phone string) (bool, error) {
+	log.Printf("ChatAPI.CheckPhone(%v)", phone)
+
+	var j CheckPhoneResponse
+	err := wa.request(ctx, "GET", "/checkPhone", url.Values{"phone": {phone}}, nil, &j)
+	if err != nil {
+		return false, err
+	}
+
+	// Check response.
+	switch j.Result {
+	case "exists":
+		return true, nil
+	case "not exists":
+		return false, nil
+	default:
+		return false, fmt.Errorf("Chat-API /checkPhone: %v", j.Result)
+	}
+}
+
+// DeleteMessage deletes a message.
+func (wa *ChatAPI) DeleteMessage(ctx context.Context, messageID string) error {
+	log.Printf("ChatAPI.DeleteMessage(%v)", messageID)
+
+	var j SendMessageResponse
+	err := wa.request(ctx, "POST", "/deleteMessage", nil, map[string]interface{}{"messageId": messageID}, &j)
+	if err != nil {
+		return err
+	}
+
+	// Check response.
+	if !j.Sent {
+		return fmt.Errorf("Chat-API /deleteMessage: not deleted: %v", j.Message)
+	}
+
+	return nil
+}
+
+type TypingOptions struct {
+	ChatTarget
+	// Show or hide the typing indicator.
+	On bool `json:"on"`
+	// Seconds to show the indicator (default 5).
+	Duration int `json:"duration,omitempty"`
+}
+
+// Typing shows the typing indicator in a chat.
+func (wa *ChatAPI) Typing(ctx context.Context, options TypingOptions) error {
+	log.Printf("ChatAPI.Typing(%+v)", options)
+	return wa.request(ctx, "POST", "/typing", nil, options, nil)
+}
+
+// GetQRCode returns the PNG image of the QR code used to log in.
+func (wa *ChatAPI) GetQRCode(ctx context.Context) ([]byte, error) {
+	log.Printf("ChatAPI.GetQRCode()")
+
+	b, err := wa.do(ctx, "GET", "/qr_code", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Chat-API sends JSON when there is no QR code.
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		log.Printf("Chat-API /qr_code response: %s", b)
+		var j struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(b, &j)
+		return nil, fmt.Errorf("Chat-API /qr_code: no QR code: %v", j.Error)
+	}
+
+	return b, nil
+}
+
+// Logout logs the account out of WhatsApp; a new QR code must be scanned to log in again.
+func (wa *ChatAPI) Logout(ctx context.Context) error {
+	log.Printf("ChatAPI.Logout()")
+	return wa.request(ctx, "POST", "/logout", nil, nil, nil)
+}
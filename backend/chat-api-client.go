@@ -0,0 +1,285 @@
+// Sends requests to Chat-API with timeouts, retries and a circuit breaker.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotAuthenticated = errors.New("not authenticated to Chat-API")
+	ErrCircuitOpen      = errors.New("Chat-API is unavailable, not sending requests for a while")
+)
+
+// POST methods that can be sent twice without a second effect, so they are retried like GET requests.
+// Methods like sendMessage are never retried: a timeout does not tell if the message was sent.
+var idempotentMethods = map[string]bool{
+	"webhook":     true,
+	"readChat":    true,
+	"unreadChat":  true,
+	"archiveChat": true,
+	"labelChat":   true,
+	"unlabelChat": true,
+	"typing":      true,
+}
+
+// isIdempotent returns true if req can be retried.
+func isIdempotent(req *http.Request) bool {
+	return req.Method == http.MethodGet || idempotentMethods[path.Base(req.URL.Path)]
+}
+
+// ChatAPIError is a non-transient HTTP error from Chat-API.
+type ChatAPIError struct {
+	Path   string
+	Status int
+	Body   []byte
+}
+
+func (err *ChatAPIError) Error() string {
+	return fmt.Sprintf("Chat-API %v: HTTP %d: %s", err.Path, err.Status, err.Body)
+}
+
+// CircuitBreaker stops requests after too many consecutive failures.
+// After Cooldown, one request is let through; if it succeeds, requests flow again.
+type CircuitBreaker struct {
+	// Consecutive failures that open the circuit.
+	Threshold int
+	// How long the circuit stays open.
+	Cooldown time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool // a request is testing the half-open circuit
+}
+
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold: 5,
+		Cooldown:  30 * time.Second,
+	}
+}
+
+// Allow returns false if requests should not be sent now.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.failures < cb.Threshold {
+		return true
+	}
+	if time.Now().Before(cb.openUntil) || cb.trial {
+		return false
+	}
+	cb.trial = true
+	return true
+}
+
+// Success closes the circuit.
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.failures >= cb.Threshold {
+		log.Printf("Chat-API circuit closed")
+	}
+	cb.failures = 0
+	cb.trial = false
+}
+
+// Failure counts a failed request, opening the circuit after Threshold failures.
+func (cb *CircuitBreaker) Failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	cb.trial = false
+	if cb.failures >= cb.Threshold {
+		if cb.failures == cb.Threshold {
+			log.Printf("Chat-API circuit open after %d failures", cb.failures)
+		}
+		cb.openUntil = time.Now().Add(cb.Cooldown)
+	}
+}
+
+// Cancel releases the half-open slot taken by Allow without counting a success or failure,
+// for requests canceled by the caller.
+func (cb *CircuitBreaker) Cancel() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.trial = false
+}
+
+// isTransient returns true for HTTP statuses worth retrying.
+func isTransient(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout
+}
+
+const userAgent = "https://github.com/andre-luiz-dos-santos/chat-api"
+
+// request calls a Chat-API method and decodes the JSON response into res.
+// query may be nil; body, if not nil, is encoded as JSON.
+// Responses with an error key are returned as errors.
+func (wa *ChatAPI) request(ctx context.Context, method, path string, query url.Values, body, res interface{}) error {
+	// Send request and read response body.
+	b, err := wa.do(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+
+	// Check response.
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(b, &e) == nil && e.Error != "" {
+		return fmt.Errorf("Chat-API %v error: %v", path, e.Error)
+	}
+
+	// Decode response body.
+	if res == nil {
+		return nil
+	}
+	return json.Unmarshal(b, res)
+}
+
+// do creates a request, adding the token, and returns the raw response body.
+func (wa *ChatAPI) do(ctx context.Context, method, path string, query url.Values, body interface{}) ([]byte, error) {
+	// Prepare URL.
+	u := *wa.URL
+	u.Path += path
+	q := u.Query()
+	for key, values := range query {
+		for _, value := range values {
+			q.Add(key, value)
+		}
+	}
+	q.Add("token", wa.Token)
+	u.RawQuery = q.Encode()
+
+	// Prepare request body.
+	var r io.Reader
+	if body != nil {
+		var buf bytes.Buffer
+		err := json.NewEncoder(&buf).Encode(body)
+		if err != nil {
+			return nil, err
+		}
+		r = &buf
+	}
+
+	// Create request.
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return wa.send(ctx, req)
+}
+
+// send sends req and returns the response body.
+// Network errors and 5xx responses of idempotent requests are retried with exponential backoff and jitter.
+func (wa *ChatAPI) send(ctx context.Context, req *http.Request) ([]byte, error) {
+	var lastErr error
+
+	retries := wa.Retries
+	if !isIdempotent(req) {
+		retries = 0
+	}
+	for attempt := 0; attempt <= retries; attempt++ {
+		// Wait before retrying.
+		if attempt > 0 {
+			delay := wa.RetryDelay << (attempt - 1)
+			delay = delay/2 + time.Duration(rand.Int63n(int64(delay)+1))
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		// Do not hammer a failing service.
+		if !wa.Breaker.Allow() {
+			if lastErr != nil {
+				return nil, fmt.Errorf("%w: %v", ErrCircuitOpen, lastErr)
+			}
+			return nil, ErrCircuitOpen
+		}
+
+		b, status, err := wa.sendOnce(ctx, req)
+		if err == nil && !isTransient(status) {
+			wa.Breaker.Success()
+			if status >= 400 {
+				return nil, &ChatAPIError{req.URL.Path, status, b}
+			}
+			return b, nil
+		}
+		// Canceled by the caller, not a failure of Chat-API.
+		if ctx.Err() != nil {
+			wa.Breaker.Cancel()
+			return nil, ctx.Err()
+		}
+		wa.Breaker.Failure()
+		if err == nil {
+			err = &ChatAPIError{req.URL.Path, status, b}
+		}
+		log.Printf("Chat-API %v attempt %d failed: %v", req.URL.Path, attempt+1, err)
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// sendOnce makes one attempt, limited by Timeout.
+func (wa *ChatAPI) sendOnce(ctx context.Context, req *http.Request) ([]byte, int, error) {
+	if wa.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wa.Timeout)
+		defer cancel()
+	}
+
+	// Requests with a body are sent again from the start.
+	r := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, 0, err
+		}
+		r.Body = body
+	}
+
+	// Send request.
+	res, err := wa.Client.Do(r)
+	if err != nil {
+		// Keep the token out of the logs.
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = redactURL(urlErr.URL)
+		}
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	// Read response body.
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return b, res.StatusCode, nil
+}
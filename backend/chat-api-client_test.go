@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsIdempotent(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{"GET", "/instance123/messages", true},
+		{"GET", "/instance123/status", true},
+		{"POST", "/instance123/readChat", true},
+		{"POST", "/instance123/labelChat", true},
+		{"POST", "/instance123/webhook", true},
+		{"POST", "/instance123/sendMessage", false},
+		{"POST", "/instance123/sendFile", false},
+		{"POST", "/instance123/deleteMessage", false},
+		{"POST", "/instance123/forwardMessage", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "https://chat-api.example.com"+tt.path, nil)
+		if got := isIdempotent(req); got != tt.want {
+			t.Errorf("%s %s: got %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		statuses []int // responses in order; the last one repeats
+		want     int32 // attempts
+		wantErr  bool
+		// Failures that open the circuit; 10 if zero.
+		threshold int
+	}{
+		{"GET succeeds", "GET", "/status", []int{200}, 1, false, 0},
+		{"GET retried after 5xx", "GET", "/status", []int{502, 503, 200}, 3, false, 0},
+		{"GET retried after 429", "GET", "/status", []int{429, 200}, 2, false, 0},
+		{"GET gives up", "GET", "/status", []int{500}, 3, true, 0},
+		{"GET not retried after 4xx", "GET", "/status", []int{404}, 1, true, 0},
+		{"GET stops when the circuit opens", "GET", "/status", []int{500}, 2, true, 2},
+		{"readChat retried", "POST", "/readChat", []int{500, 200}, 2, false, 0},
+		{"sendMessage not retried", "POST", "/sendMessage", []int{500}, 1, true, 0},
+		{"sendMessage not retried after 429", "POST", "/sendMessage", []int{429}, 1, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(atomic.AddInt32(&attempts, 1))
+				if n > len(tt.statuses) {
+					n = len(tt.statuses)
+				}
+				w.WriteHeader(tt.statuses[n-1])
+				w.Write([]byte(`{}`))
+			}))
+			defer srv.Close()
+			wa, err := NewChatAPI(&ConfigChatAPI{Name: "default", URL: srv.URL, Token: "test"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wa.Retries = 2
+			wa.RetryDelay = time.Millisecond
+			wa.Breaker = &CircuitBreaker{Threshold: 10, Cooldown: time.Minute}
+			if tt.threshold > 0 {
+				wa.Breaker.Threshold = tt.threshold
+			}
+
+			var body interface{}
+			if tt.method == "POST" {
+				body = map[string]string{"chatId": "5511999999999@c.us"}
+			}
+			_, err = wa.do(context.Background(), tt.method, tt.path, nil, body)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error: %v", err)
+			}
+			if attempts != tt.want {
+				t.Errorf("attempts: got %d, want %d", attempts, tt.want)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := &CircuitBreaker{Threshold: 2, Cooldown: 20 * time.Millisecond}
+
+	// Closed.
+	if !cb.Allow() {
+		t.Fatal("closed: Allow = false")
+	}
+	cb.Failure()
+	if !cb.Allow() {
+		t.Fatal("after one failure: Allow = false")
+	}
+
+	// Open.
+	cb.Failure()
+	if cb.Allow() {
+		t.Fatal("open: Allow = true")
+	}
+
+	// Half-open: one trial at a time.
+	time.Sleep(30 * time.Millisecond)
+	if !cb.Allow() {
+		t.Fatal("half-open: Allow = false")
+	}
+	if cb.Allow() {
+		t.Fatal("half-open during trial: Allow = true")
+	}
+
+	// A canceled trial lets the next request try.
+	cb.Cancel()
+	if !cb.Allow() {
+		t.Fatal("half-open after Cancel: Allow = false")
+	}
+
+	// A failed trial opens the circuit again.
+	cb.Failure()
+	if cb.Allow() {
+		t.Fatal("open after failed trial: Allow = true")
+	}
+
+	// A successful trial closes it.
+	time.Sleep(30 * time.Millisecond)
+	if !cb.Allow() {
+		t.Fatal("half-open: Allow = false")
+	}
+	cb.Success()
+	if !cb.Allow() || !cb.Allow() {
+		t.Fatal("closed after success: Allow = false")
+	}
+}
+
+func TestSendCanceledTrial(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	wa, err := NewChatAPI(&ConfigChatAPI{Name: "default", URL: srv.URL, Token: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wa.Retries = 0
+	wa.Breaker = &CircuitBreaker{Threshold: 1, Cooldown: time.Millisecond}
+	wa.Breaker.Failure()
+	time.Sleep(5 * time.Millisecond)
+
+	// The caller gives up on the half-open trial.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = wa.do(ctx, http.MethodGet, "/status", nil, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !wa.Breaker.Allow() {
+		t.Fatal("canceled trial kept the circuit blocked")
+	}
+}
@@ -1,18 +1,33 @@
-// Links a Chat-API instance to a database.
+// Links a Chat-API instance, or another Provider, to a database.
 
 package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"strings"
 	"time"
 )
 
+var ErrInvalidWebhook = errors.New("invalid webhook request")
+
 type ChatAPIDB struct {
-	ChatAPI *ChatAPI
-	DB      *Database
+	Provider Provider
+	DB       *Database
+	// Instance name, stored with messages and chats.
+	Instance string
+	// Name of the sync state in the database.
+	Name string
+	// Identifies this process when several processes share the database.
+	Owner string
 	// Interval between forced updates.
 	ReadMessageInterval time.Duration
+	// Messages requested from Chat-API at a time by CopyNewMessages.
+	PageSize int
 
 	// Last message number in the database.
 	// Used by CopyNewMessages to know where to start.
@@ -23,11 +38,16 @@ type ChatAPIDB struct {
 	ActiveC chan struct{}
 }
 
-func NewChatAPIDB(chatAPI *ChatAPI, db *Database) *ChatAPIDB {
+func NewChatAPIDB(provider Provider, db *Database) *ChatAPIDB {
+	hostname, _ := os.Hostname()
 	return &ChatAPIDB{
-		ChatAPI:             chatAPI,
+		Provider:            provider,
 		DB:                  db,
+		Instance:            provider.Name(),
+		Name:                instanceKey("chat-api", provider.Name()),
+		Owner:               fmt.Sprintf("%s:%d", hostname, os.Getpid()),
 		ReadMessageInterval: 10 * time.Second,
+		PageSize:            100,
 		ActiveC:             make(chan struct{}, 6),
 		UpdateC:             make(chan struct{}, 1),
 	}
@@ -38,31 +58,64 @@ func (wa *ChatAPIDB) Start(ctx context.Context) error {
 	// Run one update on start.
 	wa.UpdateC <- struct{}{}
 
-	// Get last message number.
-	number, err := wa.DB.GetLastMessageNumber(ctx)
-	if err != nil {
-		return err
-	}
-
-	// Get chats.
-	err = wa.CopyChats(ctx)
+	// Continue where the last run stopped.
+	state, err := wa.LoadSyncState(ctx)
 	if err != nil {
 		return err
 	}
 
-	// Start by copying the last 10 messages.
-	if number > 10 {
-		wa.LastMessageNumber = number - 10
+	// Get chats, unless they were copied recently.
+	// If Chat-API is not available yet, CopyChatsLoop tries again soon.
+	next := wa.ChatsInterval()
+	if time.Since(time.Unix(state.LastChatsSync, 0)) >= next {
+		err = wa.CopyChats(ctx)
+		if err != nil {
+			log.Printf("CopyChats: %v", err)
+			next = time.Minute
+		}
 	}
 
 	// Start background goroutines.
 	go wa.CopyNewMessagesLoop(ctx)
-	go wa.CopyChatsLoop(ctx)
+	go wa.CopyChatsLoop(ctx, next)
 
 	// Started.
 	return nil
 }
 
+// LoadSyncState reads the sync state, creating it on first run.
+func (wa *ChatAPIDB) LoadSyncState(ctx context.Context) (*SyncState, error) {
+	state, err := wa.DB.GetSyncState(ctx, wa.Name)
+	if err == sql.ErrNoRows {
+		// Databases created before sync_state existed:
+		// start by copying the last 10 messages.
+		var number int64
+		number, err = wa.DB.GetLastMessageNumber(ctx, wa.Instance)
+		if err != nil {
+			return nil, err
+		}
+		if number > 10 {
+			number -= 10
+		}
+		err = wa.DB.CreateSyncState(ctx, wa.Name, number)
+		if err != nil {
+			return nil, err
+		}
+		state, err = wa.DB.GetSyncState(ctx, wa.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	wa.LastMessageNumber = state.LastMessageNumber
+	return state, nil
+}
+
+// ChatsInterval is the time between CopyChats runs.
+func (wa *ChatAPIDB) ChatsInterval() time.Duration {
+	return time.Hour
+}
+
 // Active informs that automatic forced updates should continue.
 func (wa *ChatAPIDB) Active() {
 	for {
@@ -112,23 +165,36 @@ func (wa *ChatAPIDB) CopyNewMessagesLoop(ctx context.Context) {
 
 // CopyNewMessages copies new messages from Chat-API to the database.
 func (wa *ChatAPIDB) CopyNewMessages(ctx context.Context) error {
-	// Request new messages from Chat-API.
-	messages, number, err := wa.ChatAPI.GetMessages(ctx, GetMessagesOptions{LastMessageNumber: wa.LastMessageNumber})
+	// Only one process copies new messages at a time.
+	ok, err := wa.DB.AcquireSyncLease(ctx, wa.Name, wa.Owner, 2*time.Minute)
 	if err != nil {
 		return err
 	}
-	if number > wa.LastMessageNumber {
-		wa.LastMessageNumber = number
+	if !ok {
+		log.Printf("CopyNewMessages: another process is copying messages")
+		return nil
 	}
 
-	// Send new messages to the database.
-	for _, message := range messages {
-		err = wa.DB.AddMessage(ctx, "REPLACE", message)
+	// Continue where the last copy stopped, possibly in another process.
+	_, err = wa.LoadSyncState(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Request new messages from Chat-API, one page at a time.
+	for {
+		n, err := wa.copyNewMessagesPage(ctx)
 		if err != nil {
 			return err
 		}
-		if message.Number > wa.LastMessageNumber {
-			wa.LastMessageNumber = message.Number
+		if n < wa.PageSize {
+			break
+		}
+
+		// Keep the lease while more pages are copied.
+		ok, err = wa.DB.AcquireSyncLease(ctx, wa.Name, wa.Owner, 2*time.Minute)
+		if err != nil || !ok {
+			return err
 		}
 	}
 
@@ -136,12 +202,56 @@ func (wa *ChatAPIDB) CopyNewMessages(ctx context.Context) error {
 	return nil
 }
 
-// CopyChatMessages copies messages with chatID from Chat-API to the database.
-func (wa *ChatAPIDB) CopyChatMessages(ctx context.Context, chatID string) error {
+// ReleaseSyncLease lets another process copy new messages without waiting for the lease to expire.
+func (wa *ChatAPIDB) ReleaseSyncLease(ctx context.Context) error {
+	return wa.DB.ReleaseSyncLease(ctx, wa.Name, wa.Owner)
+}
+
+// copyNewMessagesPage copies up to PageSize messages after LastMessageNumber.
+// It returns the number of messages received from Chat-API, or 0 if the position did not move.
+func (wa *ChatAPIDB) copyNewMessagesPage(ctx context.Context) (int, error) {
+	messages, number, err := wa.Provider.GetMessages(ctx, GetMessagesOptions{LastMessageNumber: wa.LastMessageNumber, Limit: wa.PageSize})
+	if err != nil {
+		return 0, err
+	}
+
+	// The next page starts after the last message in this one.
+	last := wa.LastMessageNumber
+	for _, message := range messages {
+		if message.Number > last {
+			last = message.Number
+		}
+	}
+	if last == wa.LastMessageNumber && number > last {
+		// Messages without number; continue after the last number known to Chat-API.
+		last = number
+	}
+
+	// Send new messages to the database, together with the new position.
+	err = wa.DB.AddMessages(ctx, "REPLACE", messages, func(tx dbtx) error {
+		return setSyncLastMessageNumber(ctx, tx, wa.Name, last)
+	})
+	if err != nil {
+		return 0, err
+	}
+	moved := last > wa.LastMessageNumber
+	wa.LastMessageNumber = last
+
+	if !moved {
+		// The same page would be received again.
+		return 0, nil
+	}
+	return len(messages), nil
+}
+
+// CopyChatMessages copies up to limit messages with chatID from Chat-API to the database.
+// If maxTime is not 0, only messages sent up to maxTime are copied.
+// It returns the number of messages received from Chat-API.
+func (wa *ChatAPIDB) CopyChatMessages(ctx context.Context, chatID string, maxTime int64, limit int) (int, error) {
 	// Request messages from one chat from Chat-API.
-	messages, _, err := wa.ChatAPI.GetMessages(ctx, GetMessagesOptions{ChatID: chatID})
+	messages, _, err := wa.Provider.GetMessages(ctx, GetMessagesOptions{ChatID: chatID, MaxTime: maxTime, Limit: limit})
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Send messages to the database.
@@ -153,34 +263,39 @@ func (wa *ChatAPIDB) CopyChatMessages(ctx context.Context, chatID string) error
 		}
 	}
 	if firstErr != nil {
-		return firstErr
+		return 0, firstErr
 	}
 
 	// All chat messages copied.
-	return nil
+	return len(messages), nil
 }
 
-func (wa *ChatAPIDB) CopyChatsLoop(ctx context.Context) {
-	ticker := time.NewTicker(time.Hour)
-	defer ticker.Stop()
+// CopyChatsLoop runs CopyChats every ChatsInterval, starting after next.
+// Failures are retried after a minute.
+func (wa *ChatAPIDB) CopyChatsLoop(ctx context.Context, next time.Duration) {
+	timer := time.NewTimer(next)
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-timer.C:
 		}
 
 		err := wa.CopyChats(ctx)
 		if err != nil {
 			log.Printf("CopyChats: %v", err)
+			timer.Reset(time.Minute)
+			continue
 		}
+		timer.Reset(wa.ChatsInterval())
 	}
 }
 
 func (wa *ChatAPIDB) CopyChats(ctx context.Context) error {
 	// Request chats from Chat-API.
-	chats, err := wa.ChatAPI.GetChats(ctx)
+	chats, err := wa.Provider.GetChats(ctx)
 	if err != nil {
 		return err
 	}
@@ -193,5 +308,54 @@ func (wa *ChatAPIDB) CopyChats(ctx context.Context) error {
 			firstErr = err
 		}
 	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	// Remember when chats were copied.
+	return wa.DB.SetSyncLastChatsSync(ctx, wa.Name, time.Now())
+}
+
+// ProcessWebhook applies a webhook request body from the provider to the database.
+// Every message and ack is tried; the first error is returned.
+func (wa *ChatAPIDB) ProcessWebhook(ctx context.Context, b []byte) error {
+	// Decode request body.
+	events, err := wa.Provider.ParseWebhook(b)
+	if err != nil {
+		return err
+	}
+
+	// Update database.
+	var firstErr error
+	for _, message := range events.Messages {
+		err = wa.DB.AddMessage(ctx, "INSERT", message)
+		if err != nil && !strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			log.Printf("Database.AddMessage: %v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			// Keep working on other messages.
+		}
+	}
+
+	// Apply ACK updates.
+	for _, ack := range events.Acks {
+		err = wa.DB.SetMessageAck(ctx, wa.Instance, ack.ChatID, ack.MessageID, ack.Ack)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				// Message is not here yet, update now and retry later.
+				log.Printf("Database.SetMessageAck: Message ID not found, updating now")
+				wa.UpdateNow()
+				err = fmt.Errorf("ack for unknown message %v", ack.MessageID)
+			} else {
+				log.Printf("Database.SetMessageAck: %v", err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			// Keep working on other updates.
+		}
+	}
+
 	return firstErr
 }
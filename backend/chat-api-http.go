@@ -6,33 +6,128 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
-	"strings"
 	"time"
 )
 
 // ChatAPIHTTP implements HTTP handlers for Chat-API+Database.
 type ChatAPIHTTP struct {
 	*ChatAPIDB
+	// Verifies webhook requests.
+	WebhookAuth *WebhookAuth
+	// Records webhook requests, if set.
+	Recorder *Recorder
 }
 
 func NewChatAPIHTTP(db *ChatAPIDB) *ChatAPIHTTP {
-	return &ChatAPIHTTP{db}
+	return &ChatAPIHTTP{ChatAPIDB: db}
 }
 
-type WebhookRequest struct {
-	ACKs     []*WebhookACKRequest `json:"ack"`
-	Messages []BJSON              `json:"messages"`
+// RegisterWebhook handles webhook requests on mux and informs Chat-API of our webhook URL.
+// If the URL changed since the last run, the previous URL keeps working for cf.WebhookGracePeriod,
+// and new messages are copied from Chat-API to catch up with webhooks lost during the switch.
+// Paths has the current webhook paths of all instances and the previous paths registered so far;
+// a previous path in it belongs to another instance and is not accepted again.
+func (wa *ChatAPIHTTP) RegisterWebhook(ctx context.Context, mux *http.ServeMux, cf *ConfigChatAPI, paths map[string]bool) error {
+	u, err := url.Parse(cf.Webhook)
+	if err != nil {
+		return err
+	}
+	if u.Path == "" || u.Path == "/" {
+		return fmt.Errorf("chat-api.webhook must have a path, e.g. https://example.com/webhook")
+	}
+
+	// Requests must carry the persistent secret.
+	wa.WebhookAuth, err = NewWebhookAuth(ctx, wa.DB, cf)
+	if err != nil {
+		return err
+	}
+	webhookURL := wa.WebhookAuth.URL(u).String()
+
+	// Handle HTTP requests.
+	if isRegistered(mux, u.Path) {
+		return fmt.Errorf("chat-api.webhook path %q is already handled", u.Path)
+	}
+	mux.HandleFunc(u.Path, wa.Webhook)
+	paths[u.Path] = true
+
+	// Keep accepting the previous URL for a while.
+	grace := time.Duration(cf.WebhookGracePeriod) * time.Second
+	previous, err := wa.DB.GetSetting(ctx, instanceKey(SettingWebhookURL, wa.Instance))
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if previous != "" && previous != webhookURL && grace > 0 {
+		pu, err := url.Parse(previous)
+		if err == nil {
+			log.Printf("Webhook URL changed, accepting %v for %v", redactURL(previous), grace)
+			wa.WebhookAuth.PreviousSecret = pu.Query().Get("token")
+			wa.WebhookAuth.PreviousUntil = time.Now().Add(grace)
+			if pu.Path != u.Path && pu.Path != "" && pu.Path != "/" {
+				if paths[pu.Path] || isRegistered(mux, pu.Path) {
+					log.Printf("Previous webhook path %q is used by another handler, not accepting it", pu.Path)
+				} else {
+					mux.HandleFunc(pu.Path, wa.Webhook)
+					paths[pu.Path] = true
+				}
+			}
+			// Catch up again when the previous URL stops working.
+			time.AfterFunc(grace, wa.UpdateNow)
+		}
+	}
+
+	// Inform Chat-API our webhook URL.
+	err = wa.setWebhook(ctx, webhookURL)
+	if err != nil {
+		// Chat-API is not ready, keep trying in the background.
+		log.Printf("ChatAPI.SetWebhook: %v", err)
+		go func() {
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				err := wa.setWebhook(ctx, webhookURL)
+				if err == nil {
+					return
+				}
+				log.Printf("ChatAPI.SetWebhook: %v", err)
+			}
+		}()
+	}
+
+	return nil
 }
 
-type WebhookACKRequest struct {
-	ChatID      string `json:"chatId"`
-	MessageID   string `json:"id"`
-	Status      string `json:"status"`
-	QueueNumber int    `json:"queueNumber"`
+// isRegistered returns true if mux has a handler for exactly path, so that HandleFunc would panic.
+func isRegistered(mux *http.ServeMux, path string) bool {
+	_, pattern := mux.Handler(&http.Request{Method: http.MethodPost, URL: &url.URL{Path: path}})
+	return pattern == path
+}
+
+// setWebhook sends webhookURL to Chat-API and copies messages that arrived while it was not set.
+func (wa *ChatAPIHTTP) setWebhook(ctx context.Context, webhookURL string) error {
+	err := wa.Provider.SetWebhook(ctx, webhookURL)
+	if err != nil {
+		return err
+	}
+	err = wa.DB.SetSetting(ctx, instanceKey(SettingWebhookURL, wa.Instance), webhookURL)
+	if err != nil {
+		return err
+	}
+
+	// Copy messages that arrived while the webhook was not reachable.
+	wa.UpdateNow()
+
+	return nil
 }
 
 // Webhook handles incoming messages from Chat-API.
@@ -45,49 +140,46 @@ func (wa *ChatAPIHTTP) Webhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check that the request is from Chat-API.
+	if wa.WebhookAuth != nil {
+		err = wa.WebhookAuth.Check(r, b)
+		if err != nil {
+			log.Printf("Webhook rejected from %v: %v", r.RemoteAddr, err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
 	// Log request.
 	log.Printf("Webhook: %s", b)
+	if wa.Recorder != nil {
+		err = wa.Recorder.RecordWebhook(wa.Instance, b)
+		if err != nil {
+			log.Printf("Recorder.RecordWebhook: %v", err)
+		}
+	}
 
-	// Decode request body.
-	var req WebhookRequest
-	err = json.Unmarshal(b, &req)
-	if err != nil {
+	// Check request body.
+	if !json.Valid(b) {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	// Convert BJSON's into Message's.
-	messages, err := NewMessagesFromBJSON(req.Messages)
-	if err != nil {
-		log.Printf("NewMessagesFromBJSON: %v", err)
-		// Do not return!
-		// Use Message's that were successfully converted.
+	// Store request; it is applied to the database by WebhookInbox.
+	var replayWindow time.Duration
+	if wa.WebhookAuth != nil {
+		replayWindow = wa.WebhookAuth.ReplayWindow
 	}
-
-	// Update database.
-	for _, message := range messages {
-		err = wa.DB.AddMessage(r.Context(), "INSERT", message)
-		if err != nil && !strings.Contains(err.Error(), "UNIQUE constraint failed") {
-			log.Printf("Database.AddMessage: %v", err)
-			// Do not return!
-			// Keep working on other messages.
-		}
+	err = wa.DB.AddInboxEntry(r.Context(), wa.Instance, b, replayWindow)
+	if err == ErrWebhookReplay {
+		// Already stored, do not make Chat-API retry.
+		log.Printf("Webhook rejected from %v: %v", r.RemoteAddr, err)
+		return
 	}
-
-	// Apply ACK updates.
-	for _, ack := range req.ACKs {
-		err = wa.DB.SetMessageAck(r.Context(), ack.ChatID, ack.MessageID, ack.Status)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				// Message is not here yet, update now.
-				log.Printf("Database.SetMessageAck: Message ID not found, updating now")
-				wa.UpdateNow()
-			} else {
-				log.Printf("Database.SetMessageAck: %v", err)
-			}
-			// Do not return!
-			// Keep working on other updates.
-		}
+	if err != nil {
+		log.Printf("Database.AddInboxEntry: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
 	}
 }
 
@@ -101,7 +193,7 @@ func (wa *ChatAPIHTTP) GetUserChatInfo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get chat info from database.
-	infos, err := wa.DB.GetUserChatInfo(r.Context(), user.ID)
+	infos, err := wa.DB.GetUserChatInfo(r.Context(), wa.Instance, user.ID)
 	if err != nil {
 		log.Printf("Database.GetUserChatInfo: %v", err)
 		http.Error(w, "Cannot access database", http.StatusInternalServerError)
@@ -112,6 +204,173 @@ func (wa *ChatAPIHTTP) GetUserChatInfo(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{"infos": infos})
 }
 
+// ChatSummaries fetches the chats with messages, most recently active first,
+// with their last message, the user's unread count, assignee and labels.
+//
+// Query parameters:
+// instance: only chats of this Chat-API instance will be fetched.
+// since: only chats with messages at or after this unix time.
+// limit: number of chats (default 100, maximum 1000).
+func (wa *ChatAPIHTTP) ChatSummaries(w http.ResponseWriter, r *http.Request) {
+	var err error
+	uq := r.URL.Query()
+
+	// Get user ID from context.
+	user, ok := ContextUser(r.Context())
+	if !ok {
+		http.Error(w, "Unknown user", http.StatusInternalServerError)
+		return
+	}
+
+	// Get options from URL.
+	options := ChatSummaryOptions{Instance: uq.Get("instance"), Limit: 100}
+	if uq.Has("limit") {
+		options.Limit, err = strconv.Atoi(uq.Get("limit"))
+		if err != nil || options.Limit < 1 || options.Limit > 1000 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	if uq.Has("since") {
+		options.Since, err = strconv.ParseInt(uq.Get("since"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Get chats from database.
+	chats, err := wa.DB.GetChatSummaries(r.Context(), user.ID, options)
+	if err != nil {
+		log.Printf("Database.GetChatSummaries: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+	for _, chat := range chats {
+		if chat.LastMessage != nil {
+			hideRevoked(r.Context(), []*Message{chat.LastMessage})
+		}
+	}
+
+	// Send chats to user.
+	json.NewEncoder(w).Encode(map[string]interface{}{"chats": chats})
+}
+
+type SetChatAssigneeRequest struct {
+	ChatID string `json:"chatID"`
+	UserID int64  `json:"userID"` // 0 to unassign
+}
+
+// SetChatAssignee assigns a chat of the instance to a user.
+func (wa *ChatAPIHTTP) SetChatAssignee(w http.ResponseWriter, r *http.Request) {
+	// Read request body.
+	var req SetChatAssigneeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.ChatID == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Check user.
+	if req.UserID != 0 {
+		ok, err := wa.DB.UserExists(r.Context(), req.UserID)
+		if err != nil {
+			log.Printf("Database.UserExists: %v", err)
+			http.Error(w, "Cannot access database", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Unknown user", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Update database.
+	err = wa.DB.SetChatAssignee(r.Context(), wa.Instance, req.ChatID, req.UserID)
+	if err != nil {
+		log.Printf("Database.SetChatAssignee: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+}
+
+type SetChatLabelsRequest struct {
+	ChatID string   `json:"chatID"`
+	Labels []string `json:"labels"`
+}
+
+// SetChatLabels replaces the labels of a chat of the instance.
+func (wa *ChatAPIHTTP) SetChatLabels(w http.ResponseWriter, r *http.Request) {
+	// Read request body.
+	var req SetChatLabelsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.ChatID == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Update database.
+	err = wa.DB.SetChatLabels(r.Context(), wa.Instance, req.ChatID, req.Labels)
+	if err != nil {
+		log.Printf("Database.SetChatLabels: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+}
+
+type LegalHoldRequest struct {
+	ChatID string `json:"chatID"`
+	Reason string `json:"reason"`
+}
+
+// AddLegalHold exempts a chat of the instance from retention rules.
+func (wa *ChatAPIHTTP) AddLegalHold(w http.ResponseWriter, r *http.Request) {
+	// Read request body.
+	var req LegalHoldRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.ChatID == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	hold := &LegalHold{Instance: wa.Instance, ChatID: req.ChatID, Reason: req.Reason}
+	if user, ok := ContextUser(r.Context()); ok {
+		hold.CreatedBy = user.Name
+	}
+
+	// Update database.
+	err = wa.DB.AddLegalHold(r.Context(), hold)
+	if err != nil {
+		log.Printf("Database.AddLegalHold: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hold)
+}
+
+// RemoveLegalHold lets retention rules apply to a chat of the instance again.
+func (wa *ChatAPIHTTP) RemoveLegalHold(w http.ResponseWriter, r *http.Request) {
+	// Read request body.
+	var req LegalHoldRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.ChatID == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Update database.
+	err = wa.DB.RemoveLegalHold(r.Context(), wa.Instance, req.ChatID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Legal hold not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Database.RemoveLegalHold: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+}
+
 type SetUserChatAsReadRequest struct {
 	ChatID    string `json:"chatID"`
 	Timestamp int64  `json:"timestamp"`
@@ -135,7 +394,7 @@ func (wa *ChatAPIHTTP) SetUserChatAsRead(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Update database.
-	err = wa.DB.SetUserChatAsRead(r.Context(), user.ID, req.ChatID, req.Timestamp)
+	err = wa.DB.SetUserChatAsRead(r.Context(), wa.Instance, user.ID, req.ChatID, req.Timestamp)
 	if err != nil {
 		log.Printf("Database.SetUserChatAsRead: %v", err)
 		http.Error(w, "Cannot access database", http.StatusInternalServerError)
@@ -147,8 +406,19 @@ func (wa *ChatAPIHTTP) SetUserChatAsRead(w http.ResponseWriter, r *http.Request)
 // New messages are not immediately fetched from Chat-API.
 //
 // Query parameters:
-// id: only messages after this one will be fetched.
+// seq: only messages changed after this change sequence number will be fetched.
+// id: only messages inserted after this row ID will be fetched (ignores changes; use seq).
+// instance: only messages of this Chat-API instance will be fetched.
 // wait: if not empty, wait for new messages to arrive.
+//
+// The response has the sequence number to send as seq in the next request.
+// With seq, it also lists the messages deleted by retention rules since then in pruned,
+// and at most limit messages are fetched (default 1000, maximum 10000); hasMore tells
+// whether more changed messages follow the returned seq.
+// Without seq and id, the last messages of the most recently active chats are fetched:
+// chats: number of chats (default 100, maximum 1000).
+// per_chat: messages of each chat (default 20, maximum 200).
+// since: only chats with messages at or after this unix time.
 func (wa *ChatAPIHTTP) Messages(w http.ResponseWriter, r *http.Request) {
 	var err error
 	uq := r.URL.Query()
@@ -156,8 +426,15 @@ func (wa *ChatAPIHTTP) Messages(w http.ResponseWriter, r *http.Request) {
 	// Tell copy goroutine to keep updating.
 	wa.Active()
 
-	// Get row ID of last sent message.
-	var qID int64
+	// Get change sequence number or row ID of last sent message.
+	var qSeq, qID int64
+	if uq.Has("seq") {
+		qSeq, err = strconv.ParseInt(uq.Get("seq"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid seq", http.StatusBadRequest)
+			return
+		}
+	}
 	if uq.Has("id") {
 		qID, err = strconv.ParseInt(uq.Get("id"), 10, 64)
 		if err != nil {
@@ -166,6 +443,40 @@ func (wa *ChatAPIHTTP) Messages(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Get page size of changed messages.
+	limit := 1000
+	if uq.Has("limit") {
+		limit, err = strconv.Atoi(uq.Get("limit"))
+		if err != nil || limit < 1 || limit > 10000 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Get recent messages window.
+	recent := RecentMessagesOptions{Chats: 100, PerChat: 20}
+	for _, p := range []struct {
+		name  string
+		value *int
+		max   int
+	}{{"chats", &recent.Chats, 1000}, {"per_chat", &recent.PerChat, 200}} {
+		if !uq.Has(p.name) {
+			continue
+		}
+		*p.value, err = strconv.Atoi(uq.Get(p.name))
+		if err != nil || *p.value < 1 || *p.value > p.max {
+			http.Error(w, "Invalid "+p.name, http.StatusBadRequest)
+			return
+		}
+	}
+	if uq.Has("since") {
+		recent.Since, err = strconv.ParseInt(uq.Get("since"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Create wait context.
 	wait := uq.Has("wait")
 	var waitCtx context.Context
@@ -177,14 +488,38 @@ func (wa *ChatAPIHTTP) Messages(w http.ResponseWriter, r *http.Request) {
 retry:
 
 	// Get messages from database.
+	// The sequence number is read first, so that no change is missed; with seq,
+	// both reads stop at it, so that changes made between them are sent next time.
+	seq, err := wa.DB.LastMessageChangeSeq(r.Context())
+	if err != nil {
+		log.Printf("Database.LastMessageChangeSeq: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
 	var rows []MessageRow
-	if qID == 0 {
-		rows, err = wa.DB.GetRecentMessages(r.Context())
+	var hasMore bool
+	pruned := []PrunedMessage{}
+	if qSeq != 0 {
+		rows, hasMore, err = wa.DB.GetMessagesAfterSeq(r.Context(), uq.Get("instance"), qSeq, seq, limit)
+		if err != nil {
+			log.Printf("Database.GetMessagesAfterSeq(%v): %v", qSeq, err)
+		}
+		if hasMore {
+			seq = rows[len(rows)-1].Seq
+		}
+		if err == nil {
+			pruned, err = wa.DB.GetPrunedAfterSeq(r.Context(), uq.Get("instance"), qSeq, seq)
+			if err != nil {
+				log.Printf("Database.GetPrunedAfterSeq(%v): %v", qSeq, err)
+			}
+		}
+	} else if qID == 0 {
+		rows, err = wa.DB.GetRecentMessages(r.Context(), uq.Get("instance"), recent)
 		if err != nil {
 			log.Printf("Database.GetRecentMessages: %v", err)
 		}
 	} else {
-		rows, err = wa.DB.GetMessagesAfterID(r.Context(), qID)
+		rows, err = wa.DB.GetMessagesAfterID(r.Context(), uq.Get("instance"), qID)
 		if err != nil {
 			log.Printf("Database.GetMessagesAfterID(%v): %v", qID, err)
 		}
@@ -195,11 +530,15 @@ retry:
 	}
 
 	// If there are no messages, wait for new messages.
-	if wait && len(rows) <= 0 {
+	if wait && len(rows) <= 0 && len(pruned) <= 0 {
 		if wa.DB.MessageW.Wait(waitCtx) == nil {
 			goto retry
 		}
 	}
+	if qSeq != 0 && seq < qSeq {
+		// Do not send the client back to changes it has seen.
+		seq = qSeq
+	}
 
 	// Convert MessageRow's into Message's.
 	messages, err := NewMessagesFromRow(rows)
@@ -208,17 +547,70 @@ retry:
 		// Do not return!
 		// Send messages that were successfully converted.
 	}
+	hideRevoked(r.Context(), messages)
 
 	// Send messages to user.
-	json.NewEncoder(w).Encode(map[string]interface{}{"messages": messages})
+	response := map[string]interface{}{"messages": messages, "pruned": pruned, "seq": seq}
+	if qSeq != 0 {
+		response["hasMore"] = hasMore
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// MessageHistory sends the recorded changes of a message: creation, edits, acks and deletion.
+// Bodies of deleted messages are only sent to users who may see them.
+//
+// Query parameters:
+// message_id: Chat-API message ID.
+// instance: Chat-API instance of the message (the first one if missing).
+func (wa *ChatAPIHTTP) MessageHistory(w http.ResponseWriter, r *http.Request) {
+	messageID := r.URL.Query().Get("message_id")
+	if messageID == "" {
+		http.Error(w, "Missing message_id", http.StatusBadRequest)
+		return
+	}
+
+	// Get changes from database.
+	changes, err := wa.DB.GetMessageChanges(r.Context(), wa.Instance, messageID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown message", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Database.GetMessageChanges: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	// Hide old bodies of deleted messages.
+	if !canSeeRevoked(r.Context()) {
+		revoked := false
+		for _, c := range changes {
+			revoked = revoked || c.Kind == ChangeRevoked
+		}
+		for i := range changes {
+			if revoked && changes[i].Kind == ChangeEdited {
+				changes[i].OldValue, changes[i].NewValue = "", ""
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"changes": changes})
 }
 
-// MessagesByChatID fetches messages from the database for a single chat.
+// MessagesByChatID fetches a page of messages from the database for a single chat,
+// oldest first. The response has the cursors of the first and last messages
+// and tells whether there are more messages in the requested direction.
 //
 // Query parameters:
 // chat_id: only messages in this chat will be fetched.
-// update: synchronize database messages with Chat-API.
+// instance: Chat-API instance of the chat (the first one if missing).
+// before: only messages older than this cursor (default: the newest messages).
+// after: only messages newer than this cursor.
+// limit: messages per page (default 50, maximum 500).
+// update: copy the requested page from Chat-API first.
 func (wa *ChatAPIHTTP) MessagesByChatID(w http.ResponseWriter, r *http.Request) {
+	var err error
 	uq := r.URL.Query()
 
 	// Get chat ID from URL.
@@ -228,21 +620,66 @@ func (wa *ChatAPIHTTP) MessagesByChatID(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Get page from URL.
+	options := GetChatMessagesOptions{Limit: 50}
+	if uq.Has("limit") {
+		options.Limit, err = strconv.Atoi(uq.Get("limit"))
+		if err != nil || options.Limit < 1 || options.Limit > 500 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, param := range []string{"before", "after"} {
+		if !uq.Has(param) {
+			continue
+		}
+		c, err := ParseMessageCursor(uq.Get(param))
+		if err != nil {
+			http.Error(w, "Invalid "+param, http.StatusBadRequest)
+			return
+		}
+		if param == "before" {
+			options.Before = &c
+		} else {
+			options.After = &c
+		}
+	}
+
 	// Update database.
-	if uq.Has("update") {
-		err := wa.CopyChatMessages(r.Context(), chatID)
+	// Newer messages arrive by webhook; only the older page is requested.
+	var moreInChatAPI bool
+	if uq.Has("update") && options.After == nil {
+		var maxTime int64
+		limit := options.Limit
+		if options.Before != nil {
+			// Chat-API also sends the message at the cursor.
+			maxTime = options.Before.Time
+			limit++
+		}
+		n, err := wa.CopyChatMessages(r.Context(), chatID, maxTime, limit)
 		if err != nil {
 			http.Error(w, "Cannot copy messages from Chat-API", http.StatusInternalServerError)
 			return
 		}
+		// A full page means Chat-API may have older messages.
+		moreInChatAPI = n >= limit
 	}
 
 	// Fetch messages from database.
-	rows, err := wa.DB.GetChatMessages(r.Context(), chatID)
+	rows, hasMore, err := wa.DB.GetChatMessages(r.Context(), wa.Instance, chatID, options)
 	if err != nil {
+		log.Printf("Database.GetChatMessages: %v", err)
 		http.Error(w, "Cannot access database", http.StatusInternalServerError)
 		return
 	}
+	hasMore = hasMore || moreInChatAPI
+
+	// Cursors of the page.
+	var before, after string
+	if len(rows) > 0 {
+		before = MessageCursor{rows[0].Time, rows[0].ID}.String()
+		after = MessageCursor{rows[len(rows)-1].Time, rows[len(rows)-1].ID}.String()
+	}
 
 	// Convert MessageRow's into Message's.
 	messages, err := NewMessagesFromRow(rows)
@@ -251,9 +688,15 @@ func (wa *ChatAPIHTTP) MessagesByChatID(w http.ResponseWriter, r *http.Request)
 		// Do not return!
 		// Send messages that were successfully converted.
 	}
+	hideRevoked(r.Context(), messages)
 
 	// Send messages to user.
-	json.NewEncoder(w).Encode(map[string]interface{}{"messages": messages})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages": messages,
+		"before":   before,
+		"after":    after,
+		"hasMore":  hasMore,
+	})
 }
 
 // Chats fetches chats from the database.
@@ -261,6 +704,7 @@ func (wa *ChatAPIHTTP) MessagesByChatID(w http.ResponseWriter, r *http.Request)
 //
 // Query parameters:
 // id: only chats after this one will be fetched.
+// instance: only chats of this Chat-API instance will be fetched.
 // wait: if not empty, wait for new chats to arrive.
 func (wa *ChatAPIHTTP) Chats(w http.ResponseWriter, r *http.Request) {
 	var err error
@@ -287,7 +731,7 @@ func (wa *ChatAPIHTTP) Chats(w http.ResponseWriter, r *http.Request) {
 retry:
 
 	// Get chats from database.
-	rows, err := wa.DB.GetChatsAfterID(r.Context(), qID)
+	rows, err := wa.DB.GetChatsAfterID(r.Context(), uq.Get("instance"), qID)
 	if err != nil {
 		log.Printf("Database.GetChatsAfterID(%v): %v", qID, err)
 		http.Error(w, "Cannot access database", http.StatusInternalServerError)
@@ -312,3 +756,79 @@ retry:
 	// Send chats to user.
 	json.NewEncoder(w).Encode(map[string]interface{}{"chats": chats})
 }
+
+// SyncState sends the position of the sync loop.
+func (wa *ChatAPIHTTP) SyncState(w http.ResponseWriter, r *http.Request) {
+	state, err := wa.DB.GetSyncState(r.Context(), wa.Name)
+	if err != nil {
+		log.Printf("Database.GetSyncState: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(state)
+}
+
+// DeleteMessage deletes a message for everyone and marks it as deleted in the database.
+// It answers like Chat-API /deleteMessage, so that the frontend calls it through the proxy.
+func (wa *ChatAPIHTTP) DeleteMessage(w http.ResponseWriter, r *http.Request) {
+	// Get user from context.
+	user, ok := ContextUser(r.Context())
+	if !ok {
+		http.Error(w, "Unknown user", http.StatusInternalServerError)
+		return
+	}
+
+	// Read request body.
+	var req struct {
+		MessageID string `json:"messageId"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.MessageID == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Delete message in the provider.
+	deleter, ok := wa.Provider.(MessageDeleter)
+	if !ok {
+		http.Error(w, "Instance cannot delete messages", http.StatusNotImplemented)
+		return
+	}
+	err = deleter.DeleteMessage(r.Context(), req.MessageID)
+	if err != nil {
+		log.Printf("Provider.DeleteMessage: %v", err)
+		http.Error(w, "Cannot delete message", http.StatusBadGateway)
+		return
+	}
+
+	// Update database.
+	// A message that was not copied yet is marked when it arrives as revoked.
+	err = wa.DB.RevokeMessage(r.Context(), wa.Instance, req.MessageID, "user:"+user.Name)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Database.RevokeMessage: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"sent": true, "message": "message deleted"})
+}
+
+// canSeeRevoked returns true if the user in ctx may see the content of deleted messages.
+func canSeeRevoked(ctx context.Context) bool {
+	user, ok := ContextUser(ctx)
+	return ok && (user.Admin || user.Supervisor)
+}
+
+// hideRevoked removes the content of deleted messages, unless the user in ctx may see it.
+func hideRevoked(ctx context.Context, messages []*Message) {
+	if canSeeRevoked(ctx) {
+		return
+	}
+	for _, message := range messages {
+		err := message.HideRevoked()
+		if err != nil {
+			log.Printf("Message.HideRevoked: %v", err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestRegisterWebhookPreviousPath(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	_, chatAPI := newTestSimulator(t, "test", 1, 1)
+	other, err := NewChatAPI(&ConfigChatAPI{Name: "other", URL: chatAPI.URL.String(), Token: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The default instance moved from /a to /b, and the other instance now uses /a.
+	err = db.SetSetting(ctx, SettingWebhookURL, "https://example.com/a?token=old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfs := []*ConfigChatAPI{
+		{Name: "default", Webhook: "https://example.com/b", WebhookGracePeriod: 600},
+		{Name: "other", Webhook: "https://example.com/a", WebhookGracePeriod: 600},
+	}
+	mux := http.NewServeMux()
+	paths := map[string]bool{"/a": true, "/b": true}
+	for i, provider := range []Provider{chatAPI, other} {
+		wa := NewChatAPIHTTP(NewChatAPIDB(provider, db))
+		err = wa.RegisterWebhook(ctx, mux, cfs[i], paths)
+		if err != nil {
+			t.Fatalf("%s: %v", cfs[i].Name, err)
+		}
+	}
+
+	// A path handled by another route is an error, not a panic.
+	mux.HandleFunc("/api/login", func(http.ResponseWriter, *http.Request) {})
+	wa := NewChatAPIHTTP(NewChatAPIDB(other, db))
+	err = wa.RegisterWebhook(ctx, mux, &ConfigChatAPI{Name: "other", Webhook: "https://example.com/api/login"}, paths)
+	if err == nil {
+		t.Fatal("registered a path that is already handled")
+	}
+}
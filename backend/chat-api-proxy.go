@@ -17,10 +17,12 @@ func (api *ChatAPIProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.Host = api.URL.Host
 
 	// Let Chat-API know it's us.
-	r.Header.Set("User-Agent", "https://github.com/andre-luiz-dos-santos/chat-api")
+	r.Header.Set("User-Agent", userAgent)
 
 	// Add Chat-API token to the URL.
+	// The instance parameter was used to choose this proxy.
 	uq := r.URL.Query()
+	uq.Del("instance")
 	uq.Set("token", api.Token)
 	r.URL.RawQuery = uq.Encode()
 
@@ -3,70 +3,99 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 )
 
 type ChatAPI struct {
-	URL   *url.URL
-	Token string
+	// Instance name, set on the messages and chats fetched.
+	Instance string
+	URL      *url.URL
+	Token    string
+
+	Client *http.Client
+	// Time limit of each attempt.
+	Timeout time.Duration
+	// Attempts after the first one fails with a network error or 5xx.
+	Retries int
+	// Delay before the first retry, doubled on each retry.
+	RetryDelay time.Duration
+	Breaker    *CircuitBreaker
+}
+
+// NewChatAPI creates a ChatAPI from the configuration.
+func NewChatAPI(cf *ConfigChatAPI) (*ChatAPI, error) {
+	u, err := url.Parse(cf.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChatAPI{
+		Instance:   cf.Name,
+		URL:        u,
+		Token:      cf.Token,
+		Client:     &http.Client{},
+		Timeout:    time.Duration(cf.Timeout) * time.Second,
+		Retries:    cf.Retries,
+		RetryDelay: time.Second,
+		Breaker:    NewCircuitBreaker(),
+	}, nil
 }
 
 type GetStatusResponse struct {
-	Status string `json:"accountStatus"`
+	Status     string           `json:"accountStatus"`
+	StatusData StatusDataResult `json:"statusData"`
 }
 
-// GetStatus checks whether the account is active.
-func (wa *ChatAPI) GetStatus(ctx context.Context) error {
-	log.Printf("ChatAPI.GetStatus()")
+type StatusDataResult struct {
+	Substatus string `json:"substatus"`
+	Title     string `json:"title"`
+	Message   string `json:"msg"`
+}
 
-	// Prepare URL.
-	u := *wa.URL
-	u.Path += "/status"
-	q := u.Query()
-	q.Add("token", wa.Token)
-	u.RawQuery = q.Encode()
+// Name returns the instance name.
+func (wa *ChatAPI) Name() string {
+	return wa.Instance
+}
 
-	// Create request.
-	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+// Status returns the state of the account.
+func (wa *ChatAPI) Status(ctx context.Context) (*AccountStatus, error) {
+	var j GetStatusResponse
+	err := wa.request(ctx, "GET", "/status", nil, nil, &j)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	req.Header.Set("User-Agent", "https://github.com/andre-luiz-dos-santos/chat-api")
 
-	// Send request.
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+	status := &AccountStatus{
+		State:     j.Status,
+		Substatus: j.StatusData.Substatus,
+		Title:     j.StatusData.Title,
+		Message:   j.StatusData.Message,
 	}
-	defer res.Body.Close()
-
-	// Read response body.
-	b, err := io.ReadAll(res.Body)
-	if err != nil {
-		return err
+	if j.Status == "authenticated" && j.StatusData.Substatus == "phone" {
+		status.State = AccountDisconnected
 	}
+	return status, nil
+}
 
-	// Log response.
-	log.Printf("Chat-API /status response: %s", b)
+// GetStatus checks whether the account is active.
+func (wa *ChatAPI) GetStatus(ctx context.Context) error {
+	log.Printf("ChatAPI.GetStatus()")
 
-	// Decode response body.
-	var j GetStatusResponse
-	err = json.Unmarshal(b, &j)
+	status, err := wa.Status(ctx)
 	if err != nil {
 		return err
 	}
 
 	// Check response.
-	if j.Status != "authenticated" {
-		return fmt.Errorf("not authenticated to Chat-API: %v", j.Status)
+	if status.State != "authenticated" {
+		return fmt.Errorf("%w: %v", ErrNotAuthenticated, status.State)
 	}
 
 	// Authenticated.
@@ -79,49 +108,10 @@ type SetWebhookResponse struct {
 
 // SetWebhook sets the webhook URL.
 func (wa *ChatAPI) SetWebhook(ctx context.Context, url string) error {
-	log.Printf("ChatAPI.SetWebhook(%v)", url)
-
-	// Prepare URL.
-	u := *wa.URL
-	u.Path += "/webhook"
-	q := u.Query()
-	q.Add("token", wa.Token)
-	u.RawQuery = q.Encode()
-
-	// Prepare request body.
-	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(map[string]interface{}{"webhookUrl": url})
-	if err != nil {
-		return err
-	}
-
-	// Create request.
-	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), &buf)
-	if err != nil {
-		return err
-	}
-	req.Header.Set("User-Agent", "https://github.com/andre-luiz-dos-santos/chat-api")
-	req.Header.Set("Content-Type", "application/json")
-
-	// Send request.
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
-
-	// Read response body.
-	b, err := io.ReadAll(res.Body)
-	if err != nil {
-		return err
-	}
+	log.Printf("ChatAPI.SetWebhook(%v)", redactURL(url))
 
-	// Log response.
-	log.Printf("Chat-API /webhook response: %s", b)
-
-	// Decode response body.
 	var j SetWebhookResponse
-	err = json.Unmarshal(b, &j)
+	err := wa.request(ctx, "POST", "/webhook", nil, map[string]interface{}{"webhookUrl": url}, &j)
 	if err != nil {
 		return err
 	}
@@ -146,7 +136,6 @@ type GetMessagesOptions struct {
 type GetMessagesResponse struct {
 	LastMessageNumber *int64   `json:"lastMessageNumber"`
 	Messages          *[]BJSON `json:"messages"`
-	Error             string   `json:"error"`
 }
 
 // GetMessages fetches messages from Chat-API.
@@ -154,11 +143,8 @@ type GetMessagesResponse struct {
 func (wa *ChatAPI) GetMessages(ctx context.Context, options GetMessagesOptions) ([]*Message, int64, error) {
 	log.Printf("ChatAPI.GetMessages(%+v)", options)
 
-	// Prepare URL.
-	u := *wa.URL
-	u.Path += "/messages"
-	q := u.Query()
-	q.Add("token", wa.Token)
+	// Prepare query.
+	q := url.Values{}
 	q.Add("limit", strconv.Itoa(options.Limit))
 	if options.ChatID != "" {
 		q.Add("chatId", options.ChatID)
@@ -172,42 +158,14 @@ func (wa *ChatAPI) GetMessages(ctx context.Context, options GetMessagesOptions)
 	if options.LastMessageNumber > 0 {
 		q.Add("lastMessageNumber", strconv.FormatInt(options.LastMessageNumber, 10))
 	}
-	u.RawQuery = q.Encode()
-
-	// Create request.
-	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
-	if err != nil {
-		return nil, 0, err
-	}
-	req.Header.Set("User-Agent", "https://github.com/andre-luiz-dos-santos/chat-api")
 
-	// Send request.
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, 0, err
-	}
-	defer res.Body.Close()
-
-	// Read response body.
-	b, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, 0, err
-	}
-
-	// Log response.
-	log.Printf("Chat-API /messages response: %s", b)
-
-	// Decode response body.
 	var j GetMessagesResponse
-	err = json.Unmarshal(b, &j)
+	err := wa.request(ctx, "GET", "/messages", q, nil, &j)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	// Check response.
-	if j.Error != "" {
-		return nil, 0, fmt.Errorf("Chat-API /messages error: %v", j.Error)
-	}
 	if j.Messages == nil {
 		return nil, 0, fmt.Errorf("Chat-API /messages is missing key messages")
 	}
@@ -222,6 +180,9 @@ func (wa *ChatAPI) GetMessages(ctx context.Context, options GetMessagesOptions)
 		log.Printf("WARNING: Ignoring message from Chat-API!")
 		log.Printf("NewMessagesFromBJSON: %v", err)
 	}
+	for _, message := range messages {
+		message.Instance = wa.Instance
+	}
 
 	// Message's fetched from Chat-API.
 	return messages, lastMessageNumber, nil
@@ -234,39 +195,8 @@ type GetChatsResponse struct {
 func (wa *ChatAPI) GetChats(ctx context.Context) ([]*Chat, error) {
 	log.Printf("ChatAPI.GetChats()")
 
-	// Prepare URL.
-	u := *wa.URL
-	u.Path += "/dialogs"
-	q := u.Query()
-	q.Add("token", wa.Token)
-	u.RawQuery = q.Encode()
-
-	// Create request.
-	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("User-Agent", "https://github.com/andre-luiz-dos-santos/chat-api")
-
-	// Send request.
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	// Read response body.
-	b, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	// Log response.
-	log.Printf("Chat-API /dialogs response: %s", b)
-
-	// Decode response body.
 	var j GetChatsResponse
-	err = json.Unmarshal(b, &j)
+	err := wa.request(ctx, "GET", "/dialogs", nil, nil, &j)
 	if err != nil {
 		return nil, err
 	}
@@ -282,11 +212,56 @@ func (wa *ChatAPI) GetChats(ctx context.Context) ([]*Chat, error) {
 		log.Printf("WARNING: Ignoring chat from Chat-API!")
 		log.Printf("NewChatsFromBJSON: %v", err)
 	}
+	for _, chat := range chats {
+		chat.Instance = wa.Instance
+	}
 
 	// Chat's fetched from Chat-API.
 	return chats, nil
 }
 
+type WebhookRequest struct {
+	ACKs     []*WebhookACKRequest `json:"ack"`
+	Messages []BJSON              `json:"messages"`
+}
+
+type WebhookACKRequest struct {
+	ChatID      string `json:"chatId"`
+	MessageID   string `json:"id"`
+	Status      string `json:"status"`
+	QueueNumber int    `json:"queueNumber"`
+}
+
+// ParseWebhook decodes a webhook request body from Chat-API.
+// Invalid messages are logged and left out.
+func (wa *ChatAPI) ParseWebhook(b []byte) (*WebhookEvents, error) {
+	// Decode request body.
+	var req WebhookRequest
+	err := json.Unmarshal(b, &req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+	}
+
+	// Convert BJSON's into Message's.
+	messages, err := NewMessagesFromBJSON(req.Messages)
+	if err != nil {
+		log.Printf("NewMessagesFromBJSON: %v", err)
+		// Do not return!
+		// Use Message's that were successfully converted.
+	}
+	for _, message := range messages {
+		message.Instance = wa.Instance
+	}
+
+	// Convert ACK's.
+	acks := make([]*MessageAck, 0, len(req.ACKs))
+	for _, ack := range req.ACKs {
+		acks = append(acks, &MessageAck{ChatID: ack.ChatID, MessageID: ack.MessageID, Ack: ack.Status})
+	}
+
+	return &WebhookEvents{Messages: messages, Acks: acks}, nil
+}
+
 // ackToNum converts an ack string to a comparable number.
 func ackToNum(ack string) int {
 	switch ack {
@@ -11,6 +11,8 @@ type Chat struct {
 	Name  string `json:"name"`
 	Image string `json:"image"`
 	JSON  BJSON  `json:"-"`
+	// Chat-API instance the chat belongs to.
+	Instance string `json:"-"`
 }
 
 type ChatError struct {
@@ -64,9 +66,11 @@ func NewChatFromRow(row ChatRow) (*Chat, error) {
 	if err != nil {
 		return chat, err
 	}
+	chat.Instance = row.Instance
 
 	err = chat.JSON.Update(func(j map[string]interface{}) error {
 		j["__rowID"] = row.ID
+		j["__instance"] = row.Instance
 		return nil
 	})
 	return chat, err
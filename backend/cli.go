@@ -0,0 +1,606 @@
+// Command line subcommands.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Command is a subcommand run instead of the HTTP server, e.g. "chatapi contacts-import".
+type Command struct {
+	Usage string
+	Run   func(ctx context.Context, cf *Config, db *Database, args []string) error
+	// Run before the database is opened, e.g. to replace it; Run opens it if needed.
+	BeforeOpen bool
+}
+
+var commands = map[string]*Command{
+	"contacts-import": {
+		Usage: "[-format csv|vcard] [-map field:column,...] file",
+		Run:   cmdContactsImport,
+	},
+	"contacts-export": {
+		Usage: "[-format csv|vcard] [-version 3.0|4.0] [file]",
+		Run:   cmdContactsExport,
+	},
+	"backfill": {
+		Usage: "[-instance name] [-page 100] [-interval 1s] [-since 2006-01-02] [-reset]",
+		Run:   cmdBackfill,
+	},
+	"backfill-status": {
+		Usage: "[-instance name]",
+		Run:   cmdBackfillStatus,
+	},
+	"webhook-rotate-secret": {
+		Usage: "[-instance name]",
+		Run:   cmdWebhookRotateSecret,
+	},
+	"simulate": {
+		Usage: "[-listen :8099] [-token test] [-chats 5] [-messages 20] [-incoming 30s] [-ack 2s]",
+		Run:   cmdSimulate,
+	},
+	"replay": {
+		Usage: "[-instance name] file",
+		Run:   cmdReplay,
+	},
+	"prune": {
+		Usage: "[-dry-run] [-vacuum]",
+		Run:   cmdPrune,
+	},
+	"legal-hold": {
+		Usage: "[-instance name] [-reason text] [-remove] [chat-id]",
+		Run:   cmdLegalHold,
+	},
+	"gdpr-export": {
+		Usage: "[-media] [-o file.zip] phone-or-chat-id",
+		Run:   cmdGDPRExport,
+	},
+	"gdpr-erase": {
+		Usage: "[-pseudonymise] phone-or-chat-id",
+		Run:   cmdGDPRErase,
+	},
+	"gdpr-audit": {
+		Usage: "[phone-or-chat-id]",
+		Run:   cmdGDPRAudit,
+	},
+	"backup": {
+		Usage: "[file]",
+		Run:   cmdBackup,
+	},
+	"restore": {
+		Usage:      "file",
+		Run:        cmdRestore,
+		BeforeOpen: true,
+	},
+	"integrity-check": {
+		Usage: "[file]",
+		Run:   cmdIntegrityCheck,
+	},
+}
+
+// IsBeforeOpenCommand returns true if the subcommand name runs before the database is opened.
+func IsBeforeOpenCommand(name string) bool {
+	cmd, ok := commands[name]
+	return ok && cmd.BeforeOpen
+}
+
+// RunCommand runs the subcommand in args[0].
+func RunCommand(ctx context.Context, cf *Config, db *Database, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name, cmd := range commands {
+			names = append(names, "  "+name+" "+cmd.Usage)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q, available commands:\n%s", args[0], strings.Join(names, "\n"))
+	}
+	return cmd.Run(ctx, cf, db, args[1:])
+}
+
+func cmdContactsImport(ctx context.Context, cf *Config, db *Database, args []string) error {
+	fs := flag.NewFlagSet("contacts-import", flag.ContinueOnError)
+	format := fs.String("format", "", "File format: csv or vcard (default: from file extension)")
+	mapping := fs.String("map", "", "CSV column mapping, e.g. phone:Mobile,name:Full Name")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: contacts-import [-format csv|vcard] [-map field:column,...] file")
+	}
+	path := fs.Arg(0)
+
+	// Guess format from file name.
+	if *format == "" {
+		*format = "csv"
+		if strings.HasSuffix(strings.ToLower(path), ".vcf") {
+			*format = "vcard"
+		}
+	}
+
+	columns, err := ParseContactColumns(*mapping)
+	if err != nil {
+		return err
+	}
+
+	// Open file.
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Import contacts.
+	result, err := ImportContacts(ctx, db, *format, f, columns)
+	if err != nil {
+		return err
+	}
+
+	// Print result.
+	for _, e := range result.Errors {
+		fmt.Fprintf(os.Stderr, "%s: row %d: %s\n", path, e.Row, e.Error)
+	}
+	fmt.Printf("%d contacts imported, %d errors\n", result.Imported, len(result.Errors))
+	return nil
+}
+
+func cmdContactsExport(ctx context.Context, cf *Config, db *Database, args []string) error {
+	fs := flag.NewFlagSet("contacts-export", flag.ContinueOnError)
+	format := fs.String("format", "csv", "File format: csv or vcard")
+	version := fs.String("version", "3.0", "vCard version: 3.0 or 4.0")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	// Write to stdout or to a file.
+	w := os.Stdout
+	if fs.NArg() > 0 {
+		f, err := os.Create(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return ExportContacts(ctx, db, *format, *version, w)
+}
+
+// cmdWebhookRotateSecret replaces the webhook token stored in the database.
+// The new URL is sent to Chat-API on the next start; the old one is accepted during the grace period.
+func cmdWebhookRotateSecret(ctx context.Context, cf *Config, db *Database, args []string) error {
+	fs := flag.NewFlagSet("webhook-rotate-secret", flag.ContinueOnError)
+	instance := fs.String("instance", "", "Chat-API instance (default: the first one)")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	icf, err := cf.Instance(*instance)
+	if err != nil {
+		return err
+	}
+
+	if icf.WebhookSecret != "" {
+		return fmt.Errorf("webhookSecret is set in the configuration, change it there")
+	}
+
+	err = db.SetSetting(ctx, instanceKey(SettingWebhookSecret, icf.Name), generateToken())
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Webhook secret replaced, restart the server to use it")
+	return nil
+}
+
+// cmdBackfill copies the history of every chat, stopping on Ctrl+C.
+// Running it again continues where it stopped.
+func cmdBackfill(ctx context.Context, cf *Config, db *Database, args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	instance := fs.String("instance", "", "Chat-API instance (default: the first one)")
+	pageSize := fs.Int("page", 100, "Messages per Chat-API request")
+	interval := fs.Duration("interval", time.Second, "Minimum time between Chat-API requests")
+	since := fs.String("since", "", "Do not copy messages older than this date (YYYY-MM-DD or unix time)")
+	reset := fs.Bool("reset", false, "Start again from the newest messages")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	// Parse minimum time.
+	var minTime int64
+	if *since != "" {
+		minTime, err = parseTime(*since)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Connect to the provider.
+	icf, err := cf.Instance(*instance)
+	if err != nil {
+		return err
+	}
+	provider, err := NewProvider(icf)
+	if err != nil {
+		return err
+	}
+	bf := NewBackfill(ctx, NewChatAPIDB(provider, db))
+	bf.PageSize = *pageSize
+	bf.Interval = *interval
+
+	if *reset {
+		err = db.ResetBackfill(ctx, icf.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Stop on Ctrl+C.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	err = bf.Run(ctx, minTime)
+	if err != nil && err != context.Canceled {
+		return err
+	}
+	return cmdBackfillStatus(context.Background(), cf, db, []string{"-instance", icf.Name})
+}
+
+func cmdBackfillStatus(ctx context.Context, cf *Config, db *Database, args []string) error {
+	fs := flag.NewFlagSet("backfill-status", flag.ContinueOnError)
+	instance := fs.String("instance", "", "Chat-API instance (default: the first one)")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	icf, err := cf.Instance(*instance)
+	if err != nil {
+		return err
+	}
+
+	progress, err := db.GetBackfillProgress(ctx, icf.Name)
+	if err != nil {
+		return err
+	}
+	return printJSON(progress)
+}
+
+// cmdSimulate runs a fake Chat-API server until Ctrl+C.
+// Point the url and token of an instance at it to run without a Chat-API account.
+func cmdSimulate(ctx context.Context, cf *Config, db *Database, args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	listen := fs.String("listen", ":8099", "Address to listen on")
+	token := fs.String("token", "test", "Token expected in requests")
+	chats := fs.Int("chats", 5, "Chats created on start")
+	messages := fs.Int("messages", 20, "Messages created in each chat on start")
+	incoming := fs.Duration("incoming", 30*time.Second, "Time between received messages, 0 to disable")
+	ack := fs.Duration("ack", 2*time.Second, "Time between ack changes of sent messages")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	sim := NewSimulator(*token)
+	sim.AckInterval = *ack
+	sim.Seed(*chats, *messages)
+
+	// Stop on Ctrl+C.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	if *incoming > 0 {
+		go sim.ReceiveLoop(ctx, *incoming)
+	}
+
+	server := &http.Server{Addr: *listen, Handler: sim}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Printf("Simulating Chat-API on %v with token %v", *listen, *token)
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// cmdReplay copies a recording into the database, as the server would have copied it from Chat-API:
+// chats and new messages are copied first, then the recorded webhook requests are applied.
+// Use a configuration with an empty database.
+func cmdReplay(ctx context.Context, cf *Config, db *Database, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	instance := fs.String("instance", "", "Chat-API instance (default: the first one)")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: replay [-instance name] file")
+	}
+	icf, err := cf.Instance(*instance)
+	if err != nil {
+		return err
+	}
+
+	rec, err := ReadRecording(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// Answer Chat-API requests from the recording.
+	chatAPI, err := NewChatAPI(icf)
+	if err != nil {
+		return err
+	}
+	chatAPI.Client.Transport = rec.Transport(icf.Name)
+	chatAPI.Retries = 0
+	wa := NewChatAPIDB(chatAPI, db)
+	wa.PageSize = icf.PageSize
+
+	// Copy chats and messages.
+	// Requests missing from the recording fail; the webhooks are still applied.
+	_, err = wa.LoadSyncState(ctx)
+	if err != nil {
+		return err
+	}
+	err = wa.CopyChats(ctx)
+	if err != nil {
+		log.Printf("CopyChats: %v", err)
+	}
+	err = wa.CopyNewMessages(ctx)
+	if err != nil {
+		log.Printf("CopyNewMessages: %v", err)
+	}
+
+	// Apply webhook requests.
+	webhooks := rec.Webhooks(icf.Name)
+	var failed int
+	for i, b := range webhooks {
+		err = wa.ProcessWebhook(ctx, b)
+		if err != nil {
+			log.Printf("Webhook %d: %v", i+1, err)
+			failed++
+		}
+	}
+
+	return printJSON(map[string]interface{}{
+		"lastMessageNumber": wa.LastMessageNumber,
+		"webhooks":          len(webhooks),
+		"webhooksFailed":    failed,
+	})
+}
+
+// cmdPrune applies the retention rules once and prints the report.
+func cmdPrune(ctx context.Context, cf *Config, db *Database, args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Only report what would be deleted")
+	vacuum := fs.Bool("vacuum", false, "Run VACUUM afterwards, even if it is not due")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	pruner := NewPruner(db, &cf.Retention)
+	report, err := pruner.Run(ctx, *dryRun)
+	if err != nil {
+		return err
+	}
+	if *vacuum && !*dryRun && !report.Vacuumed {
+		err = pruner.Vacuum(ctx)
+		if err != nil {
+			return err
+		}
+		report.Vacuumed = true
+	}
+	return printJSON(report)
+}
+
+// cmdLegalHold exempts a chat from retention rules, or lists legal holds without a chat ID.
+func cmdLegalHold(ctx context.Context, cf *Config, db *Database, args []string) error {
+	fs := flag.NewFlagSet("legal-hold", flag.ContinueOnError)
+	instance := fs.String("instance", "", "Chat-API instance (default: the first one)")
+	reason := fs.String("reason", "", "Why the chat must be kept")
+	remove := fs.Bool("remove", false, "Remove the legal hold")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		holds, err := db.GetLegalHolds(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(holds)
+	}
+	icf, err := cf.Instance(*instance)
+	if err != nil {
+		return err
+	}
+
+	if *remove {
+		return db.RemoveLegalHold(ctx, icf.Name, fs.Arg(0))
+	}
+	hold := &LegalHold{Instance: icf.Name, ChatID: fs.Arg(0), Reason: *reason, CreatedBy: "cli"}
+	err = db.AddLegalHold(ctx, hold)
+	if err != nil {
+		return err
+	}
+	return printJSON(hold)
+}
+
+func cmdGDPRExport(ctx context.Context, cf *Config, db *Database, args []string) error {
+	fs := flag.NewFlagSet("gdpr-export", flag.ContinueOnError)
+	media := fs.Bool("media", false, "Download media files into the export")
+	output := fs.String("o", "", "Output file (default: <chat-id>.zip)")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: gdpr-export [-media] [-o file.zip] phone-or-chat-id")
+	}
+	subject, err := PhoneToChatID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		*output = sanitizeFileName(subject) + ".zip"
+	}
+
+	// Write zip file.
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	report, err := NewGDPR(db).Export(ctx, subject, *media, "cli", f)
+	if err != nil {
+		f.Close()
+		os.Remove(*output)
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported to %s\n", *output)
+	return printJSON(report)
+}
+
+func cmdGDPRErase(ctx context.Context, cf *Config, db *Database, args []string) error {
+	fs := flag.NewFlagSet("gdpr-erase", flag.ContinueOnError)
+	pseudonymise := fs.Bool("pseudonymise", false, "Replace the phone number and names with a pseudonym instead of deleting messages")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: gdpr-erase [-pseudonymise] phone-or-chat-id")
+	}
+	subject, err := PhoneToChatID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	report, err := NewGDPR(db).Erase(ctx, subject, *pseudonymise, "cli")
+	if err != nil {
+		return err
+	}
+	return printJSON(report)
+}
+
+func cmdGDPRAudit(ctx context.Context, cf *Config, db *Database, args []string) error {
+	subject := ""
+	if len(args) > 0 {
+		var err error
+		subject, err = PhoneToChatID(args[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err := db.GetGDPRAudit(ctx, subject)
+	if err != nil {
+		return err
+	}
+	return printJSON(entries)
+}
+
+func cmdBackup(ctx context.Context, cf *Config, db *Database, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: backup [file]")
+	}
+
+	// Without a file, write into the backup directory like scheduled backups.
+	if len(args) == 0 {
+		file, err := NewBackuper(db, &cf.Backup).Run(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(file)
+	}
+
+	err := db.Backup(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Database copied to %s\n", args[0])
+	return nil
+}
+
+func cmdRestore(ctx context.Context, cf *Config, db *Database, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: restore file")
+	}
+
+	err := db.Restore(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	// Older backups need the current tables.
+	err = db.Open()
+	if err != nil {
+		return err
+	}
+	err = db.Create()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Database restored from %s\n", args[0])
+	return nil
+}
+
+func cmdIntegrityCheck(ctx context.Context, cf *Config, db *Database, args []string) error {
+	var problems []string
+	var err error
+	if len(args) > 0 {
+		problems, err = IntegrityCheckFile(ctx, args[0])
+	} else {
+		problems, err = db.IntegrityCheck(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed:\n%s", strings.Join(problems, "\n"))
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+// parseTime parses a date (YYYY-MM-DD) or a unix time.
+func parseTime(s string) (int64, error) {
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err == nil {
+		return t.Unix(), nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, use YYYY-MM-DD or unix time", s)
+	}
+	return n, nil
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
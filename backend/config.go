@@ -2,19 +2,57 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/url"
 	"os"
+	"regexp"
 )
 
+// DefaultInstance names the Chat-API instance configured in chat-api.
+// Rows stored before instances existed belong to it.
+const DefaultInstance = "default"
+
+var validInstanceName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
 type Config struct {
-	ChatAPI  ConfigChatAPI  `json:"chat-api"`
-	Database ConfigDatabase `json:"database"`
-	Proxy    string         `json:"proxy"`
+	ChatAPI ConfigChatAPI `json:"chat-api"`
+	// Several Chat-API instances; if empty, chat-api is the only instance.
+	Instances []ConfigChatAPI `json:"instances"`
+	Database  ConfigDatabase  `json:"database"`
+	Proxy     string          `json:"proxy"`
+	Webhooks  []ConfigWebhook `json:"webhooks"`
+	Retention ConfigRetention `json:"retention"`
+	Backup    ConfigBackup    `json:"backup"`
+	GDPR      ConfigGDPR      `json:"gdpr"`
 }
 
 type ConfigChatAPI struct {
-	URL     string `json:"url"`
-	Token   string `json:"token"`
-	Webhook string `json:"webhook"`
+	// Instance name, stored with every message and chat.
+	Name string `json:"name"`
+	// Messaging service; only "chat-api" (the default) for now.
+	Provider string `json:"provider"`
+	URL      string `json:"url"`
+	Token    string `json:"token"`
+	Webhook  string `json:"webhook"`
+	// Seconds before a request to Chat-API is abandoned.
+	Timeout int `json:"timeout"`
+	// Times a failed request to Chat-API is retried; -1 disables retries.
+	Retries int `json:"retries"`
+	// Messages per request when copying new messages.
+	PageSize int `json:"pageSize"`
+	// Seconds the previous webhook URL is still accepted after it changes.
+	WebhookGracePeriod int `json:"webhookGracePeriod"`
+	// Webhook token; a random one is stored in the database if empty.
+	WebhookSecret string `json:"webhookSecret"`
+	// IPs or CIDRs allowed to send webhooks; empty allows all.
+	WebhookAllowedIPs []string `json:"webhookAllowedIPs"`
+	// IPs or CIDRs of reverse proxies whose X-Forwarded-For header gives the sender IP.
+	WebhookTrustedProxies []string `json:"webhookTrustedProxies"`
+	// Header with the HMAC-SHA256 of the body (added by a signing proxy).
+	WebhookSignatureHeader string `json:"webhookSignatureHeader"`
+	// File receiving every Chat-API request, response and webhook request, tokens removed.
+	// Read it back with the replay command.
+	Record string `json:"record"`
 }
 
 type ConfigDatabase struct {
@@ -22,6 +60,52 @@ type ConfigDatabase struct {
 	DSN    string `json:"dsn"`
 }
 
+// ConfigWebhook is an outbound webhook subscription.
+type ConfigWebhook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"` // HMAC-SHA256 key
+	Events []string `json:"events"` // empty means all events
+}
+
+// ConfigRetention limits how long messages are kept.
+// Chats under legal hold are never pruned.
+type ConfigRetention struct {
+	// The first rule matching a chat applies; chats matching no rule are kept.
+	Rules []ConfigRetentionRule `json:"rules"`
+	// Hours between pruning runs (default 24).
+	Interval int `json:"interval"`
+	// Days between VACUUMs, run after a pruning run that deleted something; 0 never vacuums.
+	VacuumDays int `json:"vacuumDays"`
+}
+
+// ConfigRetentionRule selects chats by instance, chat ID and label; empty fields match every chat.
+type ConfigRetentionRule struct {
+	Instance string `json:"instance,omitempty"`
+	ChatID   string `json:"chatId,omitempty"`
+	Label    string `json:"label,omitempty"`
+	// Messages older than this many days are deleted; 0 keeps them.
+	MessageDays int `json:"messageDays,omitempty"`
+	// Media URLs of messages older than this many days are removed; 0 keeps them.
+	MediaDays int `json:"mediaDays,omitempty"`
+}
+
+// ConfigBackup enables scheduled backups of the database.
+type ConfigBackup struct {
+	// Directory receiving the backups; empty disables scheduled backups.
+	Dir string `json:"dir"`
+	// Hours between backups (default 24).
+	Interval int `json:"interval"`
+	// Number of backups kept in Dir, oldest deleted first (default 7).
+	Keep int `json:"keep"`
+}
+
+// ConfigGDPR configures the erasure of personal data.
+type ConfigGDPR struct {
+	// Key of the hashes stored instead of erased phone numbers.
+	// A random key is stored in the database if empty; once hashes are stored, it must not change.
+	HashKey string `json:"hashKey"`
+}
+
 func ReadConfig(path string) (*Config, error) {
 	var config Config
 
@@ -45,7 +129,83 @@ func ReadConfig(path string) (*Config, error) {
 	if config.Database.DSN == "" {
 		config.Database.DSN = "data.sqlite"
 	}
+	if len(config.Instances) == 0 {
+		config.Instances = []ConfigChatAPI{config.ChatAPI}
+		if config.Instances[0].Name == "" {
+			config.Instances[0].Name = DefaultInstance
+		}
+	}
+	names := make(map[string]bool)
+	paths := make(map[string]bool)
+	for i := range config.Instances {
+		cf := &config.Instances[i]
+
+		// Names and webhook paths tell instances apart.
+		if !validInstanceName.MatchString(cf.Name) {
+			return nil, fmt.Errorf("instances[%d]: name must be 1 to 32 of a-z, 0-9, _ and -", i)
+		}
+		if names[cf.Name] {
+			return nil, fmt.Errorf("instances[%d]: name %q is used twice", i, cf.Name)
+		}
+		names[cf.Name] = true
+		if cf.Webhook != "" {
+			u, err := url.Parse(cf.Webhook)
+			if err != nil {
+				return nil, fmt.Errorf("instances[%d]: webhook: %v", i, err)
+			}
+			if paths[u.Path] {
+				return nil, fmt.Errorf("instances[%d]: webhook path %q is used twice", i, u.Path)
+			}
+			paths[u.Path] = true
+		}
+
+		if cf.Timeout <= 0 {
+			cf.Timeout = 30
+		}
+		if cf.Retries == 0 {
+			cf.Retries = 3
+		} else if cf.Retries < 0 {
+			cf.Retries = 0
+		}
+		if cf.PageSize <= 0 {
+			cf.PageSize = 100
+		}
+		if cf.WebhookGracePeriod == 0 {
+			cf.WebhookGracePeriod = 600
+		}
+	}
+
+	// Retention rules.
+	for i, rule := range config.Retention.Rules {
+		if rule.MessageDays < 0 || rule.MediaDays < 0 {
+			return nil, fmt.Errorf("retention.rules[%d]: days must not be negative", i)
+		}
+	}
+	if config.Retention.Interval <= 0 {
+		config.Retention.Interval = 24
+	}
+
+	// Backups.
+	if config.Backup.Interval <= 0 {
+		config.Backup.Interval = 24
+	}
+	if config.Backup.Keep <= 0 {
+		config.Backup.Keep = 7
+	}
 
 	// Configuration read.
 	return &config, nil
 }
+
+// Instance returns the configuration of the instance named name, or of the first instance if name is empty.
+func (config *Config) Instance(name string) (*ConfigChatAPI, error) {
+	if name == "" {
+		return &config.Instances[0], nil
+	}
+	for i := range config.Instances {
+		if config.Instances[i].Name == name {
+			return &config.Instances[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown instance %q", name)
+}
@@ -0,0 +1,106 @@
+// Contacts on the web.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// ContactHTTP implements HTTP handlers for contacts.
+type ContactHTTP struct {
+	DB *Database
+}
+
+func NewContactHTTP(db *Database) *ContactHTTP {
+	return &ContactHTTP{db}
+}
+
+// Contacts fetches all contacts from the database.
+func (ch *ContactHTTP) Contacts(w http.ResponseWriter, r *http.Request) {
+	contacts, err := ch.DB.GetContacts(r.Context())
+	if err != nil {
+		log.Printf("Database.GetContacts: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"contacts": contacts})
+}
+
+// Import adds contacts from a CSV or vCard file in the request body.
+//
+// Query parameters:
+// format: "csv" (default) or "vcard".
+// map: CSV column mapping, e.g. "phone:Mobile,name:Full Name".
+func (ch *ContactHTTP) Import(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	uq := r.URL.Query()
+
+	// Get file format.
+	format := uq.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+
+	// Get column mapping.
+	columns, err := ParseContactColumns(uq.Get("map"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Import contacts.
+	body := http.MaxBytesReader(w, r.Body, 50_000_000)
+	result, err := ImportContacts(r.Context(), ch.DB, format, body, columns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Send result to user.
+	json.NewEncoder(w).Encode(result)
+}
+
+// Export sends all contacts as a CSV or vCard file.
+//
+// Query parameters:
+// format: "csv" (default) or "vcard".
+// version: vCard version, "3.0" (default) or "4.0".
+func (ch *ContactHTTP) Export(w http.ResponseWriter, r *http.Request) {
+	uq := r.URL.Query()
+
+	// Get file format.
+	format := uq.Get("format")
+	switch format {
+	case "", "csv":
+		format = "csv"
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="contacts.csv"`)
+	case "vcard", "vcf":
+		w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="contacts.vcf"`)
+	default:
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
+
+	// Get vCard version.
+	version := uq.Get("version")
+	if version != "" && version != "3.0" && version != "4.0" {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	// Write contacts.
+	err := ExportContacts(r.Context(), ch.DB, format, version, w)
+	if err != nil {
+		log.Printf("ExportContacts: %v", err)
+		http.Error(w, "Cannot export contacts", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,527 @@
+// Import and export contacts as CSV and vCard.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Contact fields that can be mapped from a CSV column.
+const (
+	ContactFieldName      = "name"
+	ContactFieldFirstName = "first_name"
+	ContactFieldLastName  = "last_name"
+	ContactFieldPhone     = "phone"
+	ContactFieldEmail     = "email"
+	ContactFieldCompany   = "company"
+	ContactFieldNotes     = "notes"
+)
+
+// contactColumnAliases maps normalized CSV headers to contact fields.
+var contactColumnAliases = map[string]string{
+	"name":         ContactFieldName,
+	"fullname":     ContactFieldName,
+	"displayname":  ContactFieldName,
+	"contact":      ContactFieldName,
+	"contactname":  ContactFieldName,
+	"nome":         ContactFieldName,
+	"firstname":    ContactFieldFirstName,
+	"givenname":    ContactFieldFirstName,
+	"lastname":     ContactFieldLastName,
+	"familyname":   ContactFieldLastName,
+	"surname":      ContactFieldLastName,
+	"phone":        ContactFieldPhone,
+	"phonenumber":  ContactFieldPhone,
+	"mobile":       ContactFieldPhone,
+	"mobilephone":  ContactFieldPhone,
+	"cell":         ContactFieldPhone,
+	"cellphone":    ContactFieldPhone,
+	"telephone":    ContactFieldPhone,
+	"tel":          ContactFieldPhone,
+	"whatsapp":     ContactFieldPhone,
+	"chatid":       ContactFieldPhone,
+	"celular":      ContactFieldPhone,
+	"telefone":     ContactFieldPhone,
+	"email":        ContactFieldEmail,
+	"emailaddress": ContactFieldEmail,
+	"mail":         ContactFieldEmail,
+	"company":      ContactFieldCompany,
+	"organization": ContactFieldCompany,
+	"organisation": ContactFieldCompany,
+	"org":          ContactFieldCompany,
+	"account":      ContactFieldCompany,
+	"empresa":      ContactFieldCompany,
+	"notes":        ContactFieldNotes,
+	"note":         ContactFieldNotes,
+	"comment":      ContactFieldNotes,
+	"comments":     ContactFieldNotes,
+	"description":  ContactFieldNotes,
+}
+
+// ContactRecord is one contact read from an import file.
+type ContactRecord struct {
+	Row     int // line number in CSV, card number in vCard
+	Contact *Contact
+	Err     error
+}
+
+type ContactImportError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type ContactImportResult struct {
+	Imported int                   `json:"imported"`
+	Errors   []*ContactImportError `json:"errors"`
+}
+
+// ImportContacts reads contacts in format ("csv" or "vcard") and saves them to the database.
+// columns maps contact fields to CSV headers, overriding the automatic mapping.
+// Rows that fail are reported in the result; the other rows are still imported.
+func ImportContacts(ctx context.Context, db *Database, format string, r io.Reader, columns map[string]string) (*ContactImportResult, error) {
+	var records []*ContactRecord
+	var err error
+
+	// Parse file.
+	switch format {
+	case "csv":
+		records, err = ReadContactsCSV(r, columns)
+	case "vcard", "vcf":
+		records, err = ReadContactsVCard(r)
+	default:
+		return nil, fmt.Errorf("unknown contact format: %v", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Save contacts.
+	result := &ContactImportResult{Errors: []*ContactImportError{}}
+	for _, record := range records {
+		err = record.Err
+		if err == nil {
+			err = record.Contact.Validate()
+		}
+		if err == nil {
+			err = db.AddContact(ctx, record.Contact)
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, &ContactImportError{record.Row, err.Error()})
+			continue
+		}
+		result.Imported++
+	}
+
+	return result, nil
+}
+
+// ExportContacts writes all contacts in format ("csv" or "vcard").
+// version is the vCard version ("3.0" or "4.0") and is ignored for CSV.
+func ExportContacts(ctx context.Context, db *Database, format, version string, w io.Writer) error {
+	contacts, err := db.GetContacts(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "csv":
+		return WriteContactsCSV(w, contacts)
+	case "vcard", "vcf":
+		return WriteContactsVCard(w, contacts, version)
+	default:
+		return fmt.Errorf("unknown contact format: %v", format)
+	}
+}
+
+// normalizeColumn turns "E-mail Address" into "emailaddress".
+func normalizeColumn(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// ReadContactsCSV reads contacts from a CSV file with a header row.
+// Comma and semicolon separated files are accepted.
+func ReadContactsCSV(r io.Reader, columns map[string]string) ([]*ContactRecord, error) {
+	br := bufio.NewReader(r)
+
+	// Skip UTF-8 BOM.
+	if b, err := br.Peek(3); err == nil && bytes.Equal(b, []byte{0xEF, 0xBB, 0xBF}) {
+		br.Discard(3)
+	}
+
+	// Detect separator from the header line.
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	if header, _ := br.Peek(br.Buffered()); len(header) > 0 {
+		if i := bytes.IndexByte(header, '\n'); i >= 0 {
+			header = header[:i]
+		}
+		if bytes.Count(header, []byte(";")) > bytes.Count(header, []byte(",")) {
+			cr.Comma = ';'
+		}
+	}
+
+	// Read header.
+	header, err := cr.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("CSV file is empty")
+		}
+		return nil, err
+	}
+
+	// Map columns to fields.
+	fieldByColumn := make([]string, len(header))
+	for i, name := range header {
+		fieldByColumn[i] = contactColumnAliases[normalizeColumn(name)]
+	}
+	// An explicit mapping replaces the automatic one of that field.
+	for field := range columns {
+		for i := range fieldByColumn {
+			if fieldByColumn[i] == field {
+				fieldByColumn[i] = ""
+			}
+		}
+	}
+	for field, name := range columns {
+		for i := range header {
+			if normalizeColumn(header[i]) == normalizeColumn(name) {
+				fieldByColumn[i] = field
+			}
+		}
+	}
+	hasPhone := false
+	for _, field := range fieldByColumn {
+		if field == ContactFieldPhone {
+			hasPhone = true
+		}
+	}
+	if !hasPhone {
+		return nil, fmt.Errorf("CSV file has no phone column")
+	}
+
+	// Read rows.
+	var records []*ContactRecord
+	for {
+		values, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if perr, ok := err.(*csv.ParseError); ok {
+				records = append(records, &ContactRecord{Row: perr.StartLine, Err: perr.Err})
+				continue
+			}
+			return nil, err
+		}
+		row, _ := cr.FieldPos(0)
+
+		// Skip empty lines.
+		if strings.TrimSpace(strings.Join(values, "")) == "" {
+			continue
+		}
+
+		var contact Contact
+		var firstName, lastName string
+		for i, value := range values {
+			if i >= len(fieldByColumn) {
+				break
+			}
+			value = strings.TrimSpace(value)
+			switch fieldByColumn[i] {
+			case ContactFieldName:
+				contact.Name = value
+			case ContactFieldFirstName:
+				firstName = value
+			case ContactFieldLastName:
+				lastName = value
+			case ContactFieldPhone:
+				if contact.Phone == "" {
+					contact.Phone = value
+				}
+			case ContactFieldEmail:
+				contact.Email = value
+			case ContactFieldCompany:
+				contact.Company = value
+			case ContactFieldNotes:
+				contact.Notes = value
+			}
+		}
+		if contact.Name == "" {
+			contact.Name = strings.TrimSpace(firstName + " " + lastName)
+		}
+
+		records = append(records, &ContactRecord{Row: row, Contact: &contact})
+	}
+
+	return records, nil
+}
+
+// WriteContactsCSV writes contacts as a CSV file with a header row.
+func WriteContactsCSV(w io.Writer, contacts []*Contact) error {
+	cw := csv.NewWriter(w)
+
+	err := cw.Write([]string{"name", "phone", "chat_id", "email", "company", "notes"})
+	if err != nil {
+		return err
+	}
+	for _, c := range contacts {
+		err = cw.Write([]string{c.Name, c.Phone, c.ChatID, c.Email, c.Company, c.Notes})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// vCardLine is one property of a vCard, e.g. "TEL;TYPE=cell:+5511999999999".
+type vCardLine struct {
+	Name   string
+	Params map[string][]string
+	Value  string
+}
+
+// parseVCardLine parses one unfolded content line.
+func parseVCardLine(line string) (*vCardLine, bool) {
+	i := strings.IndexByte(line, ':')
+	if i < 0 {
+		return nil, false
+	}
+	parts := strings.Split(line[:i], ";")
+	name := strings.ToUpper(parts[0])
+
+	// Remove group, e.g. "item1.TEL".
+	if j := strings.LastIndexByte(name, '.'); j >= 0 {
+		name = name[j+1:]
+	}
+
+	params := make(map[string][]string)
+	for _, p := range parts[1:] {
+		k, v := "TYPE", p // vCard 2.1 style: TEL;CELL:...
+		if j := strings.IndexByte(p, '='); j >= 0 {
+			k, v = strings.ToUpper(p[:j]), p[j+1:]
+		}
+		for _, vv := range strings.Split(strings.Trim(v, `"`), ",") {
+			params[k] = append(params[k], strings.ToLower(vv))
+		}
+	}
+
+	return &vCardLine{name, params, line[i+1:]}, true
+}
+
+func (l *vCardLine) HasType(t string) bool {
+	for _, v := range l.Params["TYPE"] {
+		if v == t {
+			return true
+		}
+	}
+	_, pref := l.Params["PREF"]
+	return t == "pref" && pref
+}
+
+// vCardUnescape decodes a vCard text value.
+func vCardUnescape(s string) string {
+	r := strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+	return r.Replace(s)
+}
+
+// vCardEscape encodes a vCard text value.
+func vCardEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, "\r\n", `\n`, "\n", `\n`, ",", `\,`, ";", `\;`)
+	return r.Replace(s)
+}
+
+// ReadContactsVCard reads contacts from a vCard 3.0 or 4.0 file.
+// The first cell phone is used, otherwise the preferred or first phone.
+func ReadContactsVCard(r io.Reader) ([]*ContactRecord, error) {
+	var records []*ContactRecord
+
+	// Unfold lines.
+	var lines []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, strings.TrimPrefix(line, "\uFEFF"))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	// Parse cards.
+	var card []*vCardLine
+	inCard := false
+	for _, s := range lines {
+		line, ok := parseVCardLine(s)
+		if !ok {
+			continue
+		}
+		switch {
+		case line.Name == "BEGIN" && strings.EqualFold(line.Value, "VCARD"):
+			inCard = true
+			card = card[:0]
+		case line.Name == "END" && strings.EqualFold(line.Value, "VCARD") && inCard:
+			inCard = false
+			records = append(records, newContactRecordFromVCard(len(records)+1, card))
+		case inCard:
+			card = append(card, line)
+		}
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("vCard file has no cards")
+	}
+
+	return records, nil
+}
+
+func newContactRecordFromVCard(row int, card []*vCardLine) *ContactRecord {
+	var contact Contact
+	var version, n string
+	var phones []*vCardLine
+
+	for _, line := range card {
+		switch line.Name {
+		case "VERSION":
+			version = line.Value
+		case "FN":
+			contact.Name = vCardUnescape(line.Value)
+		case "N":
+			n = line.Value
+		case "TEL":
+			phones = append(phones, line)
+		case "EMAIL":
+			if contact.Email == "" || line.HasType("pref") {
+				contact.Email = vCardUnescape(line.Value)
+			}
+		case "ORG":
+			contact.Company = vCardUnescape(strings.SplitN(line.Value, ";", 2)[0])
+		case "NOTE":
+			contact.Notes = vCardUnescape(line.Value)
+		}
+	}
+
+	// Check version.
+	if version != "3.0" && version != "4.0" {
+		return &ContactRecord{Row: row, Err: fmt.Errorf("unsupported vCard version: %q", version)}
+	}
+
+	// Use N when FN is missing.
+	if contact.Name == "" && n != "" {
+		parts := strings.Split(n, ";")
+		name := parts[0]
+		if len(parts) > 1 {
+			name = parts[1] + " " + parts[0]
+		}
+		contact.Name = strings.TrimSpace(vCardUnescape(name))
+	}
+
+	// Choose phone number.
+	var phone *vCardLine
+	for _, t := range []string{"cell", "pref"} {
+		for _, p := range phones {
+			if phone == nil && p.HasType(t) {
+				phone = p
+			}
+		}
+	}
+	if phone == nil && len(phones) > 0 {
+		phone = phones[0]
+	}
+	if phone == nil {
+		return &ContactRecord{Row: row, Contact: &contact, Err: fmt.Errorf("card has no phone number")}
+	}
+	contact.Phone = phone.Value
+
+	return &ContactRecord{Row: row, Contact: &contact}
+}
+
+// WriteContactsVCard writes contacts as vCard version "3.0" or "4.0".
+func WriteContactsVCard(w io.Writer, contacts []*Contact, version string) error {
+	if version == "" {
+		version = "3.0"
+	}
+	if version != "3.0" && version != "4.0" {
+		return fmt.Errorf("unsupported vCard version: %q", version)
+	}
+
+	bw := bufio.NewWriter(w)
+	line := func(s string) {
+		// Fold lines longer than 75 octets.
+		for len(s) > 75 {
+			i := 75
+			for i > 1 && s[i]&0xC0 == 0x80 {
+				i-- // do not split UTF-8 sequences
+			}
+			bw.WriteString(s[:i] + "\r\n ")
+			s = s[i:]
+		}
+		bw.WriteString(s + "\r\n")
+	}
+
+	for _, c := range contacts {
+		line("BEGIN:VCARD")
+		line("VERSION:" + version)
+		line("FN:" + vCardEscape(c.Name))
+		if version == "3.0" {
+			line("N:" + vCardEscape(c.Name) + ";;;;")
+			line("TEL;TYPE=CELL:" + c.Phone)
+		} else {
+			line("TEL;TYPE=cell;VALUE=uri:tel:" + c.Phone)
+		}
+		if c.Email != "" {
+			line("EMAIL:" + vCardEscape(c.Email))
+		}
+		if c.Company != "" {
+			line("ORG:" + vCardEscape(c.Company))
+		}
+		if c.Notes != "" {
+			line("NOTE:" + vCardEscape(c.Notes))
+		}
+		line("END:VCARD")
+	}
+
+	return bw.Flush()
+}
+
+// ParseContactColumns parses a column mapping like "phone:Mobile,name:Full Name".
+func ParseContactColumns(s string) (map[string]string, error) {
+	columns := make(map[string]string)
+	if s == "" {
+		return columns, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.IndexByte(pair, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid column mapping: %q", pair)
+		}
+		field := strings.TrimSpace(pair[:i])
+		switch field {
+		case ContactFieldName, ContactFieldFirstName, ContactFieldLastName, ContactFieldPhone,
+			ContactFieldEmail, ContactFieldCompany, ContactFieldNotes:
+		default:
+			return nil, fmt.Errorf("unknown contact field: %q", field)
+		}
+		columns[field] = strings.TrimSpace(pair[i+1:])
+	}
+
+	return columns, nil
+}
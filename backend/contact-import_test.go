@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadContactsCSVExplicitColumn(t *testing.T) {
+	// Phone and Mobile are both phone columns; the mapping chooses Mobile.
+	csv := "Name,Phone,Mobile\nAna,+55 11 3333-4444,+55 11 99999-8888\n"
+	records, err := ReadContactsCSV(strings.NewReader(csv), map[string]string{ContactFieldPhone: "Mobile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Err != nil {
+		t.Fatalf("got %d records, %v", len(records), records[0].Err)
+	}
+	if got, want := records[0].Contact.Phone, "+55 11 99999-8888"; got != want {
+		t.Errorf("phone: got %q, want %q", got, want)
+	}
+}
+
+func TestPhoneToChatID(t *testing.T) {
+	tests := []struct {
+		phone string
+		want  string // empty for ErrInvalidPhone
+	}{
+		{"+55 11 99999-8888", "5511999998888@c.us"},
+		{"+55 (11) 99999.8888", "5511999998888@c.us"},
+		{"005511999998888", "5511999998888@c.us"},
+		{"5511999998888", "5511999998888@c.us"},
+		{"5511999998888@c.us", "5511999998888@c.us"},
+		{"tel:+5511999998888", "5511999998888@c.us"},
+		{"  +1 202 555 0100  ", "12025550100@c.us"},
+		{"", ""},
+		{"+55 11 9999x-8888", ""},
+		{"1234567", ""},           // too short
+		{"+1234567890123456", ""}, // too long
+		{"011999998888", ""},      // national number
+		{"5511999998888@g.us", ""},
+	}
+	for _, tt := range tests {
+		got, err := PhoneToChatID(tt.phone)
+		if tt.want == "" {
+			if err != ErrInvalidPhone {
+				t.Errorf("%q: got %q, %v, want ErrInvalidPhone", tt.phone, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.phone, got, err, tt.want)
+		}
+	}
+}
+
+func TestReadContactsCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		columns map[string]string
+		want    []Contact // one per row; Phone empty if the row has an error
+		wantErr bool
+	}{
+		{name: "comma", csv: "Name,Phone,Email\nAna,+5511999998888,ana@example.com\n",
+			want: []Contact{{Name: "Ana", Phone: "+5511999998888", Email: "ana@example.com"}}},
+		{name: "semicolon", csv: "Nome;Celular;Empresa\nAna;+5511999998888;ACME\n",
+			want: []Contact{{Name: "Ana", Phone: "+5511999998888", Company: "ACME"}}},
+		{name: "BOM and CRLF", csv: "\ufeffName,Mobile\r\nAna,+5511999998888\r\n",
+			want: []Contact{{Name: "Ana", Phone: "+5511999998888"}}},
+		{name: "first and last name", csv: "First Name,Last Name,Phone\nAna,Souza,+5511999998888\n",
+			want: []Contact{{Name: "Ana Souza", Phone: "+5511999998888"}}},
+		{name: "first phone column", csv: "Name,Phone,Mobile\nAna,+5511999998888,+5511988887777\n",
+			want: []Contact{{Name: "Ana", Phone: "+5511999998888"}}},
+		{name: "explicit column", csv: "Name,Number\nAna,+5511999998888\n", columns: map[string]string{ContactFieldPhone: "number"},
+			want: []Contact{{Name: "Ana", Phone: "+5511999998888"}}},
+		{name: "quoted values", csv: "Name,Phone,Notes\n\"Souza, Ana\",+5511999998888,\"line 1\nline 2\"\n",
+			want: []Contact{{Name: "Souza, Ana", Phone: "+5511999998888", Notes: "line 1\nline 2"}}},
+		{name: "empty lines", csv: "Name,Phone\n\nAna,+5511999998888\n,\n",
+			want: []Contact{{Name: "Ana", Phone: "+5511999998888"}}},
+		{name: "bad quote", csv: "Name,Phone\n\"Ana,+5511999998888\n",
+			want: []Contact{{}}},
+		{name: "no phone column", csv: "Name,Email\nAna,ana@example.com\n", wantErr: true},
+		{name: "empty file", csv: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := ReadContactsCSV(strings.NewReader(tt.csv), tt.columns)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: %v", err)
+			}
+			if len(records) != len(tt.want) {
+				t.Fatalf("got %d records, want %d", len(records), len(tt.want))
+			}
+			for i, record := range records {
+				if tt.want[i].Phone == "" {
+					if record.Err == nil {
+						t.Errorf("row %d: no error", record.Row)
+					}
+					continue
+				}
+				if record.Err != nil || *record.Contact != tt.want[i] {
+					t.Errorf("row %d: got %+v, %v, want %+v", record.Row, record.Contact, record.Err, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadContactsVCard(t *testing.T) {
+	tests := []struct {
+		name    string
+		vcard   string
+		want    []Contact // one per card; Phone empty if the card has an error
+		wantErr bool
+	}{
+		{name: "3.0", vcard: "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Ana Souza\r\nTEL;TYPE=CELL:+5511999998888\r\nEMAIL:ana@example.com\r\nORG:ACME;Sales\r\nNOTE:a\\, b\\nc\r\nEND:VCARD\r\n",
+			want: []Contact{{Name: "Ana Souza", Phone: "+5511999998888", Email: "ana@example.com", Company: "ACME", Notes: "a, b\nc"}}},
+		{name: "4.0", vcard: "BEGIN:VCARD\nVERSION:4.0\nFN:Ana\nTEL;TYPE=cell;VALUE=uri:tel:+5511999998888\nEND:VCARD\n",
+			want: []Contact{{Name: "Ana", Phone: "tel:+5511999998888"}}},
+		{name: "folded lines", vcard: "BEGIN:VCARD\nVERSION:3.0\nFN:Ana \n Souza\nNOTE:first\n\tsecond\nTEL:+5511999998888\nEND:VCARD\n",
+			want: []Contact{{Name: "Ana Souza", Phone: "+5511999998888", Notes: "firstsecond"}}},
+		{name: "N without FN", vcard: "BEGIN:VCARD\nVERSION:3.0\nN:Souza;Ana;;;\nTEL:+5511999998888\nEND:VCARD\n",
+			want: []Contact{{Name: "Ana Souza", Phone: "+5511999998888"}}},
+		{name: "cell phone first", vcard: "BEGIN:VCARD\nVERSION:3.0\nFN:Ana\nTEL;TYPE=WORK:+551133334444\nitem1.TEL;TYPE=CELL:+5511999998888\nEND:VCARD\n",
+			want: []Contact{{Name: "Ana", Phone: "+5511999998888"}}},
+		{name: "preferred phone", vcard: "BEGIN:VCARD\nVERSION:3.0\nFN:Ana\nTEL;TYPE=WORK:+551133334444\nTEL;TYPE=HOME,PREF:+5511999998888\nEND:VCARD\n",
+			want: []Contact{{Name: "Ana", Phone: "+5511999998888"}}},
+		{name: "two cards, one without phone", vcard: "BEGIN:VCARD\nVERSION:3.0\nFN:Ana\nEND:VCARD\nBEGIN:VCARD\nVERSION:3.0\nFN:Bia\nTEL:+5511988887777\nEND:VCARD\n",
+			want: []Contact{{}, {Name: "Bia", Phone: "+5511988887777"}}},
+		{name: "version 2.1", vcard: "BEGIN:VCARD\nVERSION:2.1\nFN:Ana\nTEL;CELL:+5511999998888\nEND:VCARD\n",
+			want: []Contact{{}}},
+		{name: "no cards", vcard: "hello\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := ReadContactsVCard(strings.NewReader(tt.vcard))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: %v", err)
+			}
+			if len(records) != len(tt.want) {
+				t.Fatalf("got %d records, want %d", len(records), len(tt.want))
+			}
+			for i, record := range records {
+				if tt.want[i].Phone == "" {
+					if record.Err == nil {
+						t.Errorf("card %d: no error", record.Row)
+					}
+					continue
+				}
+				if record.Err != nil || *record.Contact != tt.want[i] {
+					t.Errorf("card %d: got %+v, %v, want %+v", record.Row, record.Contact, record.Err, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWriteContactsVCardFolding(t *testing.T) {
+	contacts := []*Contact{{Name: "Ana", Phone: "+5511999998888", Notes: strings.Repeat("é", 100) + ", done"}}
+	for _, version := range []string{"3.0", "4.0"} {
+		var b strings.Builder
+		err := WriteContactsVCard(&b, contacts, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(b.String(), "\r\n") {
+			if len(line) > 76 {
+				t.Errorf("%s: line of %d octets: %q", version, len(line), line)
+			}
+		}
+
+		// Reading it back unfolds the lines without breaking characters.
+		records, err := ReadContactsVCard(strings.NewReader(b.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || records[0].Err != nil {
+			t.Fatalf("%s: got %d records, %v", version, len(records), records[0].Err)
+		}
+		if got := records[0].Contact.Notes; got != contacts[0].Notes {
+			t.Errorf("%s: notes: got %q, want %q", version, got, contacts[0].Notes)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrInvalidPhone = errors.New("invalid phone number")
+
+// Contact is a person we talk to on WhatsApp.
+type Contact struct {
+	ID      int64  `json:"id"`
+	ChatID  string `json:"chatId"` // <number>@c.us
+	Name    string `json:"name"`
+	Phone   string `json:"phone"`
+	Email   string `json:"email"`
+	Company string `json:"company"`
+	Notes   string `json:"notes"`
+}
+
+// Validate checks the contact fields and fills ChatID from Phone.
+func (contact *Contact) Validate() error {
+	contact.Name = strings.TrimSpace(contact.Name)
+	contact.Email = strings.TrimSpace(contact.Email)
+	contact.Company = strings.TrimSpace(contact.Company)
+	contact.Notes = strings.TrimSpace(contact.Notes)
+
+	// Phone or chat ID is required.
+	phone := contact.Phone
+	if phone == "" {
+		phone = contact.ChatID
+	}
+	chatID, err := PhoneToChatID(phone)
+	if err != nil {
+		return err
+	}
+	contact.ChatID = chatID
+	contact.Phone = "+" + strings.TrimSuffix(chatID, "@c.us")
+
+	return nil
+}
+
+// PhoneToChatID converts a phone number in international format into a Chat-API chat ID.
+// Spaces, dashes, dots and parentheses are ignored.
+// A chat ID like "5511999999999@c.us" is also accepted.
+func PhoneToChatID(phone string) (string, error) {
+	phone = strings.TrimSpace(phone)
+	phone = strings.TrimPrefix(phone, "tel:")
+	phone = strings.TrimSuffix(phone, "@c.us")
+
+	// International prefix.
+	if strings.HasPrefix(phone, "+") {
+		phone = phone[1:]
+	} else if strings.HasPrefix(phone, "00") {
+		phone = phone[2:]
+	}
+
+	// Keep digits only.
+	var b strings.Builder
+	for _, r := range phone {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+			// Formatting.
+		default:
+			return "", ErrInvalidPhone
+		}
+	}
+	number := b.String()
+
+	// E.164 allows up to 15 digits, including the country code.
+	if len(number) < 8 || len(number) > 15 || number[0] == '0' {
+		return "", ErrInvalidPhone
+	}
+
+	return number + "@c.us", nil
+}
@@ -0,0 +1,105 @@
+// Read and write history backfill progress.
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+type BackfillChat struct {
+	Instance  string `json:"instance"`
+	ChatID    string `json:"chatId"`
+	MaxTime   int64  `json:"maxTime"`
+	Done      bool   `json:"done"`
+	Messages  int64  `json:"messages"`
+	LastError string `json:"lastError"`
+	Updated   int64  `json:"updated"`
+}
+
+type BackfillProgress struct {
+	Chats     int64 `json:"chats"`
+	DoneChats int64 `json:"doneChats"`
+	Messages  int64 `json:"messages"`
+	Errors    int64 `json:"errors"`
+}
+
+// AddBackfillChats adds chats of instance that were not known by the backfill yet.
+func (db *Database) AddBackfillChats(ctx context.Context, instance string, chatIDs []string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	now := time.Now().Unix()
+	for _, chatID := range chatIDs {
+		_, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO backfill_chats (instance, chat_id, max_time, done, messages, last_error, updated) VALUES (?, ?, 0, 0, 0, '', ?)`, instance, chatID, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetPendingBackfillChats returns chats of instance whose beginning was not reached yet.
+func (db *Database) GetPendingBackfillChats(ctx context.Context, instance string) ([]*BackfillChat, error) {
+	chats := make([]*BackfillChat, 0, 128)
+
+	rows, err := db.QueryContext(ctx, `SELECT instance, chat_id, max_time, done, messages, last_error, updated FROM backfill_chats WHERE instance = ? AND done = 0 ORDER BY id`, instance)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c BackfillChat
+		err = rows.Scan(&c.Instance, &c.ChatID, &c.MaxTime, &c.Done, &c.Messages, &c.LastError, &c.Updated)
+		if err != nil {
+			return nil, err
+		}
+		chats = append(chats, &c)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return chats, nil
+}
+
+// UpdateBackfillChat saves the progress of one chat.
+func (db *Database) UpdateBackfillChat(ctx context.Context, c *BackfillChat) error {
+	db.Lock()
+	defer db.Unlock()
+
+	return updateBackfillChat(ctx, db, c)
+}
+
+// updateBackfillChat saves the progress of one chat in tx.
+func updateBackfillChat(ctx context.Context, tx dbtx, c *BackfillChat) error {
+	c.Updated = time.Now().Unix()
+	_, err := tx.ExecContext(ctx, `UPDATE backfill_chats SET max_time = ?, done = ?, messages = ?, last_error = ?, updated = ? WHERE instance = ? AND chat_id = ?`,
+		c.MaxTime, c.Done, c.Messages, c.LastError, c.Updated, c.Instance, c.ChatID)
+	return err
+}
+
+// GetBackfillProgress sums the progress of all chats of instance.
+func (db *Database) GetBackfillProgress(ctx context.Context, instance string) (*BackfillProgress, error) {
+	var p BackfillProgress
+
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(done), 0), COALESCE(SUM(messages), 0), COUNT(NULLIF(last_error, '')) FROM backfill_chats WHERE instance = ?`, instance).
+		Scan(&p.Chats, &p.DoneChats, &p.Messages, &p.Errors)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// ResetBackfill forgets all backfill progress of instance.
+func (db *Database) ResetBackfill(ctx context.Context, instance string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.ExecContext(ctx, `DELETE FROM backfill_chats WHERE instance = ?`, instance)
+	return err
+}
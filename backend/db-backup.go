@@ -0,0 +1,256 @@
+// Copy the database while it is in use, restore copies and check them.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Pages copied per backup step; writers wait for one step at most.
+const backupStepPages = 256
+
+// Times a backup may start again because of writes before the rest is copied in one step under the lock.
+const backupMaxRestarts = 3
+
+var errSQLiteOnly = errors.New("backups are only available for SQLite")
+
+// IsSQLite returns true if the database is SQLite; only SQLite databases can be backed up.
+func (db *Database) IsSQLite() bool {
+	return db.Driver == "sqlite3"
+}
+
+// Backup writes a copy of the database to path, which must not exist,
+// with the online backup API, and checks it with PRAGMA integrity_check.
+func (db *Database) Backup(ctx context.Context, path string) error {
+	if !db.IsSQLite() {
+		return errSQLiteOnly
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	err := copySQLite(ctx, db.DB, sqliteFileDSN(path, ""), db)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	problems, err := IntegrityCheckFile(ctx, path)
+	if err == nil && len(problems) > 0 {
+		err = fmt.Errorf("integrity check of %s failed: %s", path, strings.Join(problems, "; "))
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// Restore replaces the content of the database with the backup in path.
+// It runs before the database is opened: the backup is checked first, then the database is locked
+// exclusively until it is replaced. It fails if a server is running on the database.
+func (db *Database) Restore(ctx context.Context, path string) error {
+	if !db.IsSQLite() {
+		return errSQLiteOnly
+	}
+
+	problems, err := IntegrityCheckFile(ctx, path)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check of %s failed: %s", path, strings.Join(problems, "; "))
+	}
+
+	// Lock the database.
+	dest, err := sql.Open("sqlite3", db.DSN)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	// The lock is kept until the connection is closed.
+	_, err = destConn.ExecContext(ctx, `PRAGMA locking_mode = EXCLUSIVE`)
+	if err != nil {
+		return err
+	}
+	_, err = destConn.ExecContext(ctx, `BEGIN EXCLUSIVE`)
+	if err != nil {
+		return err
+	}
+	running, err := hasSyncLease(ctx, destConn)
+	if err != nil {
+		destConn.ExecContext(ctx, `ROLLBACK`)
+		return err
+	}
+	_, err = destConn.ExecContext(ctx, `COMMIT`)
+	if err != nil {
+		return err
+	}
+	if running {
+		return fmt.Errorf("a server is running on the database; stop it first")
+	}
+
+	// Copy.
+	src, err := sql.Open("sqlite3", sqliteFileDSN(path, "mode=ro"))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	return copySQLiteConn(ctx, srcConn, destConn, nil)
+}
+
+// hasSyncLease returns true if a process holds the lease of a sync loop, which it releases when it stops.
+func hasSyncLease(ctx context.Context, conn *sql.Conn) (bool, error) {
+	var tables int
+	err := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'sync_state'`).Scan(&tables)
+	if err != nil || tables == 0 {
+		return false, err
+	}
+
+	var n int
+	err = conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM sync_state WHERE owner != '' AND lease_until >= ?`, time.Now().Unix()).Scan(&n)
+	return n > 0, err
+}
+
+// IntegrityCheck runs PRAGMA integrity_check, returning the problems found.
+func (db *Database) IntegrityCheck(ctx context.Context) ([]string, error) {
+	if !db.IsSQLite() {
+		return nil, fmt.Errorf("integrity check is only available for SQLite")
+	}
+	return integrityCheck(ctx, db.DB)
+}
+
+// IntegrityCheckFile runs PRAGMA integrity_check on the SQLite database in path.
+func IntegrityCheckFile(ctx context.Context, path string) ([]string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	h, err := sql.Open("sqlite3", sqliteFileDSN(path, "mode=ro"))
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+	return integrityCheck(ctx, h)
+}
+
+// sqliteFileDSN returns the URI of the SQLite database in path, so that characters like ? and # in path
+// are not read as parameters.
+func sqliteFileDSN(path, query string) string {
+	dsn := "file:" + url.PathEscape(path)
+	if query != "" {
+		dsn += "?" + query
+	}
+	return dsn
+}
+
+func integrityCheck(ctx context.Context, h *sql.DB) ([]string, error) {
+	problems := []string{}
+
+	rows, err := h.QueryContext(ctx, `PRAGMA integrity_check`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s string
+		err = rows.Scan(&s)
+		if err != nil {
+			return nil, err
+		}
+		if s != "ok" {
+			problems = append(problems, s)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return problems, nil
+}
+
+// copySQLite copies the database src into a new database at dsn, holding lock during each step.
+func copySQLite(ctx context.Context, src *sql.DB, dsn string, lock sync.Locker) error {
+	dest, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	return copySQLiteConn(ctx, srcConn, destConn, lock)
+}
+
+// copySQLiteConn replaces the content of dest with src using the online backup API.
+// If lock is not nil, it is held during each step and released between steps,
+// so that writers are not blocked for the whole copy. A write through another connection
+// makes the next step start the copy again; after backupMaxRestarts restarts,
+// the rest is copied in one step without releasing lock.
+func copySQLiteConn(ctx context.Context, src, dest *sql.Conn, lock sync.Locker) error {
+	return dest.Raw(func(destRaw interface{}) error {
+		return src.Raw(func(srcRaw interface{}) error {
+			b, err := destRaw.(*sqlite3.SQLiteConn).Backup("main", srcRaw.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			remaining, restarts := -1, 0
+			for done := false; !done; {
+				if err = ctx.Err(); err != nil {
+					b.Close()
+					return err
+				}
+				pages := backupStepPages
+				if lock == nil || restarts >= backupMaxRestarts {
+					pages = -1
+				}
+				if lock != nil {
+					lock.Lock()
+				}
+				done, err = b.Step(pages)
+				if lock != nil {
+					lock.Unlock()
+				}
+				if err != nil {
+					b.Close()
+					return err
+				}
+
+				// Without a restart, fewer pages remain after each step.
+				if remaining >= 0 && b.Remaining() >= remaining {
+					restarts++
+				}
+				remaining = b.Remaining()
+			}
+			return b.Finish()
+		})
+	})
+}
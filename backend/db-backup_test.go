@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBackupWhileWriting(t *testing.T) {
+	db := newTestDatabase(t)
+	_, err := db.Exec(`CREATE TABLE filler (b BLOB);
+		WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 4000)
+		INSERT INTO filler SELECT randomblob(4000) FROM n`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write through other connections, which makes the backup start again.
+	done := make(chan struct{})
+	writes := make(chan int)
+	go func() {
+		n := 0
+		defer func() { writes <- n }()
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			err := db.SetSetting(context.Background(), "test", strconv.Itoa(n))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			n++
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "backup.sqlite")
+	err = db.Backup(ctx, path)
+	close(done)
+	n := <-writes
+	if err != nil {
+		t.Fatalf("Backup after %d writes: %v", n, err)
+	}
+	if n == 0 {
+		t.Fatal("no writes during the backup")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	_, chatAPI := newTestSimulator(t, "test", 2, 3)
+	copyAll(t, db, chatAPI)
+	messages := countRows(t, db, "messages")
+	path := filepath.Join(t.TempDir(), "backup.sqlite")
+	err := db.Backup(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetSetting(ctx, "test", "after the backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A running server holds a sync lease.
+	ok, err := db.AcquireSyncLease(ctx, "chat-api", "test", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("AcquireSyncLease: %v, %v", ok, err)
+	}
+	restored := NewDatabase("sqlite3", db.DSN)
+	err = restored.Restore(ctx, path)
+	if err == nil {
+		t.Fatal("Restore ran while a sync lease was held")
+	}
+	if got := countRows(t, db, "messages"); got != messages {
+		t.Fatalf("messages after the refused restore: got %d, want %d", got, messages)
+	}
+
+	// Stop the server.
+	err = db.ReleaseSyncLease(ctx, "chat-api", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	err = restored.Restore(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The restored database opens and migrates like on start.
+	err = restored.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	err = restored.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var version int
+	err = restored.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err != nil || version != len(SQLITE_MIGRATIONS) {
+		t.Errorf("user_version: got %d, want %d, %v", version, len(SQLITE_MIGRATIONS), err)
+	}
+	problems, err := restored.IntegrityCheck(ctx)
+	if err != nil || len(problems) > 0 {
+		t.Errorf("integrity check: %v, %v", problems, err)
+	}
+	if got := countRows(t, restored, "messages"); got != messages {
+		t.Errorf("messages: got %d, want %d", got, messages)
+	}
+	if value, err := restored.GetSetting(ctx, "test"); err == nil {
+		t.Errorf("setting written after the backup: %q", value)
+	}
+}
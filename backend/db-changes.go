@@ -0,0 +1,149 @@
+// Change log of messages, followed by clients instead of row IDs.
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Kinds of message changes.
+const (
+	ChangeCreated = "created"
+	// Stored again without a change of body or ack.
+	ChangeUpdated = "updated"
+	// Body changed; old_value and new_value are the bodies.
+	ChangeEdited = "edited"
+	// Ack changed; old_value and new_value are the acks.
+	ChangeAck = "ack"
+	// Deleted for everyone; new_value is who deleted it.
+	ChangeRevoked = "revoked"
+	// Media URL removed by a retention rule.
+	ChangeMediaPruned = "media-pruned"
+	// Deleted by a retention rule; old_value is the message ID and new_value the instance.
+	// It is the only change kept of the message.
+	ChangePruned = "pruned"
+)
+
+type MessageChange struct {
+	Seq      int64  `json:"seq"`
+	Kind     string `json:"kind"`
+	OldValue string `json:"oldValue,omitempty"`
+	NewValue string `json:"newValue,omitempty"`
+	Time     int64  `json:"time"`
+}
+
+// addMessageChange records a change of the message in row rowID.
+func addMessageChange(ctx context.Context, tx dbtx, rowID int64, kind, oldValue, newValue string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO message_changes (row_id, kind, old_value, new_value, time) VALUES (?, ?, ?, ?, ?)`,
+		rowID, kind, oldValue, newValue, time.Now().Unix())
+	return err
+}
+
+// LastMessageChangeSeq returns the sequence number of the last change, or 0.
+func (db *Database) LastMessageChangeSeq(ctx context.Context) (int64, error) {
+	var seq int64
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM message_changes`).Scan(&seq)
+	return seq, err
+}
+
+// GetMessagesAfterSeq returns at most limit messages changed after seq and up to upTo, of instance if it is not empty,
+// in the order of their last change. Row.Seq is set to that change.
+// hasMore tells whether more messages changed up to upTo; they follow the Seq of the last message.
+func (db *Database) GetMessagesAfterSeq(ctx context.Context, instance string, seq, upTo int64, limit int) (messages []MessageRow, hasMore bool, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT m.id, m.json, m.instance, COALESCE(m.ack, ''), COALESCE(m.revoked, 0), COALESCE(m.revoked_by, ''), c.seq
+		FROM (SELECT row_id, MAX(seq) AS seq FROM message_changes WHERE seq > ? AND seq <= ? GROUP BY row_id) AS c
+		JOIN messages AS m ON m.id = c.row_id
+		WHERE ? IN ('', m.instance)
+		ORDER BY c.seq LIMIT ?`, seq, upTo, instance, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row MessageRow
+		err = rows.Scan(&row.ID, &row.JSON, &row.Instance, &row.Ack, &row.Revoked, &row.RevokedBy, &row.Seq)
+		if err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, row)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, false, err
+	}
+
+	// One more row was read to know if there are more.
+	if len(messages) > limit {
+		messages = messages[:limit]
+		hasMore = true
+	}
+
+	return messages, hasMore, nil
+}
+
+// PrunedMessage is a message deleted by a retention rule.
+type PrunedMessage struct {
+	Instance string `json:"instance"`
+	ID       string `json:"id"`
+	Seq      int64  `json:"seq"`
+}
+
+// GetPrunedAfterSeq returns the messages deleted by retention rules after seq and up to upTo,
+// of instance if it is not empty, in the order of deletion.
+func (db *Database) GetPrunedAfterSeq(ctx context.Context, instance string, seq, upTo int64) ([]PrunedMessage, error) {
+	pruned := []PrunedMessage{}
+
+	rows, err := db.QueryContext(ctx, `SELECT new_value, old_value, seq FROM message_changes
+		WHERE seq > ? AND seq <= ? AND kind = ? AND ? IN ('', new_value)
+		ORDER BY seq`, seq, upTo, ChangePruned, instance)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p PrunedMessage
+		err = rows.Scan(&p.Instance, &p.ID, &p.Seq)
+		if err != nil {
+			return nil, err
+		}
+		pruned = append(pruned, p)
+	}
+	return pruned, rows.Err()
+}
+
+// GetMessageChanges returns the changes of messageID in instance, oldest first.
+// It returns sql.ErrNoRows if the message does not exist.
+func (db *Database) GetMessageChanges(ctx context.Context, instance, messageID string) ([]MessageChange, error) {
+	var rowID int64
+	err := db.QueryRowContext(ctx, `SELECT id FROM messages WHERE instance = ? AND message_id = ?`, instance, messageID).Scan(&rowID)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.getMessageChangesByRowID(ctx, rowID)
+}
+
+// getMessageChangesByRowID returns the changes of the message in row rowID, oldest first.
+func (db *Database) getMessageChangesByRowID(ctx context.Context, rowID int64) ([]MessageChange, error) {
+	changes := []MessageChange{}
+
+	rows, err := db.QueryContext(ctx, `SELECT seq, kind, COALESCE(old_value, ''), COALESCE(new_value, ''), time
+		FROM message_changes WHERE row_id = ? ORDER BY seq`, rowID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c MessageChange
+		err = rows.Scan(&c.Seq, &c.Kind, &c.OldValue, &c.NewValue, &c.Time)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGetMessagesAfterSeqPages(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	_, chatAPI := newTestSimulator(t, "test", 2, 5)
+	wa := NewChatAPIDB(chatAPI, db)
+	_, err := wa.LoadSyncState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wa.CopyNewMessages(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := countRows(t, db, "messages")
+	upTo, err := db.LastMessageChangeSeq(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Follow pages of 3 until the end.
+	seen := map[int64]bool{}
+	var seq int64
+	for pages := 0; ; pages++ {
+		if pages > total {
+			t.Fatal("pages do not end")
+		}
+		rows, hasMore, err := db.GetMessagesAfterSeq(ctx, "", seq, upTo, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) > 3 || hasMore && len(rows) != 3 {
+			t.Fatalf("page of %d messages, hasMore %v", len(rows), hasMore)
+		}
+		for _, row := range rows {
+			if seen[row.ID] {
+				t.Errorf("message %d sent twice", row.ID)
+			}
+			seen[row.ID] = true
+		}
+		if !hasMore {
+			break
+		}
+		seq = rows[len(rows)-1].Seq
+	}
+	if len(seen) != total {
+		t.Errorf("got %d messages, want %d", len(seen), total)
+	}
+
+	// Changes after upTo are left for the next request.
+	var chatID, messageID string
+	err = db.QueryRow(`SELECT chat_id, message_id FROM messages LIMIT 1`).Scan(&chatID, &messageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetMessageAck(ctx, "default", chatID, messageID, "read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, hasMore, err := db.GetMessagesAfterSeq(ctx, "", upTo, upTo, 3)
+	if err != nil || len(rows) != 0 || hasMore {
+		t.Errorf("up to upTo: got %d messages, hasMore %v, %v", len(rows), hasMore, err)
+	}
+	last, err := db.LastMessageChangeSeq(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, _, err = db.GetMessagesAfterSeq(ctx, "", upTo, last, 3)
+	if err != nil || len(rows) != 1 {
+		t.Errorf("after upTo: got %d messages, %v", len(rows), err)
+	}
+}
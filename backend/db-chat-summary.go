@@ -0,0 +1,204 @@
+// Chat list with last message, unread count, assignee and labels.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Unread messages are counted up to this number.
+const maxUnreadCount = 1000
+
+type ChatSummary struct {
+	Instance string `json:"instance"`
+	ChatID   string `json:"chatId"`
+	Name     string `json:"name"`
+	// Time of the last message.
+	Time        int64    `json:"time"`
+	LastMessage *Message `json:"lastMessage"`
+	// Messages from others after the user's read_before, up to maxUnreadCount.
+	Unread   int           `json:"unread"`
+	Assignee *ChatAssignee `json:"assignee"`
+	Labels   []string      `json:"labels"`
+}
+
+type ChatAssignee struct {
+	ID    int64  `json:"id"`
+	Name  string `json:"name"`
+	Label string `json:"label"`
+}
+
+type ChatSummaryOptions struct {
+	// Only chats of this instance, if not empty.
+	Instance string
+	// Only chats with a message at or after this unix time.
+	Since int64
+	Limit int
+}
+
+// GetChatSummaries returns the chats with messages, most recently active first.
+// Unread counts are those of userID.
+func (db *Database) GetChatSummaries(ctx context.Context, userID int64, options ChatSummaryOptions) ([]*ChatSummary, error) {
+	summaries := make([]*ChatSummary, 0, options.Limit)
+
+	rows, err := db.QueryContext(ctx, `SELECT s.instance, s.chat_id, c.json, s.time,
+			m.id, m.json, COALESCE(m.ack, ''), COALESCE(m.revoked, 0), COALESCE(m.revoked_by, ''),
+			(SELECT COUNT(*) FROM (
+				SELECT 1 FROM messages WHERE instance = s.instance AND chat_id = s.chat_id AND time > COALESCE(u.read_before, 0)
+				AND from_me = 0 LIMIT ?
+			)),
+			a.id, a.name, a.label, COALESCE(md.labels, '[]')
+		FROM chat_last_messages AS s
+		LEFT JOIN messages AS m ON m.instance = s.instance AND m.message_id = s.message_id
+		LEFT JOIN chats AS c ON c.instance = s.instance AND c.chat_id = s.chat_id
+		LEFT JOIN user_chat_info AS u ON u.user_id = ? AND u.instance = s.instance AND u.chat_id = s.chat_id
+		LEFT JOIN chat_metadata AS md ON md.instance = s.instance AND md.chat_id = s.chat_id
+		LEFT JOIN users AS a ON a.id = md.assignee
+		WHERE ? IN ('', s.instance) AND s.time >= ?
+		ORDER BY s.time DESC LIMIT ?`,
+		maxUnreadCount, userID, options.Instance, options.Since, options.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var summary ChatSummary
+		var messageID, assigneeID sql.NullInt64
+		var chatJSON, messageJSON []byte
+		var messageAck, messageRevokedBy string
+		var messageRevoked int64
+		var assigneeName, assigneeLabel sql.NullString
+		var labels []byte
+		err = rows.Scan(&summary.Instance, &summary.ChatID, &chatJSON, &summary.Time,
+			&messageID, &messageJSON, &messageAck, &messageRevoked, &messageRevokedBy, &summary.Unread,
+			&assigneeID, &assigneeName, &assigneeLabel, &labels)
+		if err != nil {
+			return nil, err
+		}
+
+		// Chat name; missing if the chat was not copied yet.
+		if chatJSON != nil {
+			chat, err := NewChatFromBJSON(chatJSON)
+			if err == nil {
+				summary.Name = chat.Name
+			}
+		}
+
+		// Last message; missing if it was deleted.
+		if messageID.Valid {
+			summary.LastMessage, err = NewMessageFromRow(MessageRow{
+				ID: messageID.Int64, JSON: messageJSON, Instance: summary.Instance, Ack: messageAck, Revoked: messageRevoked, RevokedBy: messageRevokedBy,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if assigneeID.Valid {
+			summary.Assignee = &ChatAssignee{assigneeID.Int64, assigneeName.String, assigneeLabel.String}
+		}
+		err = json.Unmarshal(labels, &summary.Labels)
+		if err != nil {
+			return nil, err
+		}
+
+		summaries = append(summaries, &summary)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return summaries, nil
+}
+
+// SetChatAssignee assigns a chat to userID, or to nobody if userID is 0.
+func (db *Database) SetChatAssignee(ctx context.Context, instance, chatID string, userID int64) error {
+	db.Lock()
+	defer db.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	assignee := sql.NullInt64{Int64: userID, Valid: userID != 0}
+	_, err = tx.ExecContext(ctx, `INSERT INTO chat_metadata (instance, chat_id, assignee, updated) VALUES (?, ?, ?, ?)
+		ON CONFLICT (instance, chat_id) DO UPDATE SET assignee = excluded.assignee, updated = excluded.updated`,
+		instance, chatID, assignee, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	// Tell other systems who the chat is assigned to.
+	var user *ChatAssignee
+	if userID != 0 {
+		user = &ChatAssignee{ID: userID}
+		err = tx.QueryRowContext(ctx, `SELECT name, label FROM users WHERE id = ?`, userID).Scan(&user.Name, &user.Label)
+		if err != nil {
+			return err
+		}
+	}
+	err = db.addEvent(ctx, tx, EventChatAssigned, map[string]interface{}{"instance": instance, "chatId": chatID, "assignee": user})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	db.notifyWebhooks()
+	return nil
+}
+
+// SetChatLabels replaces the labels of a chat.
+func (db *Database) SetChatLabels(ctx context.Context, instance, chatID string, labels []string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if labels == nil {
+		labels = []string{}
+	}
+	b, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO chat_metadata (instance, chat_id, labels, updated) VALUES (?, ?, ?, ?)
+		ON CONFLICT (instance, chat_id) DO UPDATE SET labels = excluded.labels, updated = excluded.updated`,
+		instance, chatID, string(b), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	err = db.addEvent(ctx, tx, EventChatLabeled, map[string]interface{}{"instance": instance, "chatId": chatID, "labels": labels})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	db.notifyWebhooks()
+	return nil
+}
+
+// UserExists returns true if there is a user with id.
+func (db *Database) UserExists(ctx context.Context, id int64) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE id = ?`, id).Scan(&n)
+	return n > 0, err
+}
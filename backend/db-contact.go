@@ -0,0 +1,56 @@
+// Read and write contacts.
+
+package main
+
+import (
+	"context"
+)
+
+// AddContact inserts or updates a contact by chat ID.
+// Empty fields do not overwrite values already in the database.
+func (db *Database) AddContact(ctx context.Context, contact *Contact) error {
+	db.Lock()
+	defer db.Unlock()
+
+	err := db.QueryRowContext(ctx, `INSERT INTO contacts (chat_id, name, phone, email, company, notes) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET
+			name = COALESCE(NULLIF(excluded.name, ''), name),
+			phone = excluded.phone,
+			email = COALESCE(NULLIF(excluded.email, ''), email),
+			company = COALESCE(NULLIF(excluded.company, ''), company),
+			notes = COALESCE(NULLIF(excluded.notes, ''), notes)
+		RETURNING id`,
+		contact.ChatID, contact.Name, contact.Phone, contact.Email, contact.Company, contact.Notes).
+		Scan(&contact.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetContacts returns all contacts ordered by name.
+func (db *Database) GetContacts(ctx context.Context) ([]*Contact, error) {
+	contacts := make([]*Contact, 0, 128)
+
+	rows, err := db.QueryContext(ctx, `SELECT id, chat_id, name, phone, email, company, notes FROM contacts ORDER BY name, chat_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Contact
+		err = rows.Scan(&c.ID, &c.ChatID, &c.Name, &c.Phone, &c.Email, &c.Company, &c.Notes)
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, &c)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return contacts, nil
+}
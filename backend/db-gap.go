@@ -0,0 +1,133 @@
+// Find and record holes in the message_number sequence.
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+type MessageGap struct {
+	ID       int64  `json:"id"`
+	Instance string `json:"instance"`
+	Start    int64  `json:"start"` // first missing message number
+	End      int64  `json:"end"`   // last missing message number
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	Detected int64  `json:"detected"`
+	Updated  int64  `json:"updated"`
+	// Time of the messages around the gap.
+	FromTime int64 `json:"fromTime"`
+	ToTime   int64 `json:"toTime"`
+}
+
+// FindMessageGaps returns holes in the message_number sequence of instance,
+// except those already known to be unrecoverable.
+func (db *Database) FindMessageGaps(ctx context.Context, instance string) ([]*MessageGap, error) {
+	gaps := make([]*MessageGap, 0, 16)
+
+	// Messages deleted by retention rules are not missing.
+	rows, err := db.QueryContext(ctx, `SELECT prev + 1, message_number - 1 FROM (
+			SELECT message_number, LAG(message_number) OVER (ORDER BY message_number) AS prev FROM (
+				SELECT message_number FROM messages WHERE instance = ? AND message_number > 0
+				UNION SELECT message_number FROM pruned_messages WHERE instance = ? AND message_number > 0
+			)
+		) AS numbers
+		WHERE message_number - prev > 1 AND NOT EXISTS (
+			SELECT 1 FROM message_gaps WHERE instance = ? AND status = 'unrecoverable' AND start_number <= prev + 1 AND end_number >= message_number - 1
+		)
+		ORDER BY message_number`, instance, instance, instance)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		gap := MessageGap{Instance: instance}
+		err = rows.Scan(&gap.Start, &gap.End)
+		if err != nil {
+			return nil, err
+		}
+		gaps = append(gaps, &gap)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return gaps, nil
+}
+
+// AddMessageGap records gap, or reads the existing record of the same range into gap.
+func (db *Database) AddMessageGap(ctx context.Context, gap *MessageGap) error {
+	db.Lock()
+	defer db.Unlock()
+
+	now := time.Now().Unix()
+	_, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO message_gaps (instance, start_number, end_number, status, attempts, detected, updated) VALUES (?, ?, ?, 'open', 0, ?, ?)`,
+		gap.Instance, gap.Start, gap.End, now, now)
+	if err != nil {
+		return err
+	}
+
+	return db.QueryRowContext(ctx, `SELECT id, status, attempts, detected, updated FROM message_gaps WHERE instance = ? AND start_number = ? AND end_number = ?`, gap.Instance, gap.Start, gap.End).
+		Scan(&gap.ID, &gap.Status, &gap.Attempts, &gap.Detected, &gap.Updated)
+}
+
+// UpdateMessageGap saves the status of a gap.
+func (db *Database) UpdateMessageGap(ctx context.Context, gap *MessageGap) error {
+	db.Lock()
+	defer db.Unlock()
+
+	gap.Updated = time.Now().Unix()
+	_, err := db.ExecContext(ctx, `UPDATE message_gaps SET status = ?, attempts = ?, updated = ? WHERE id = ?`,
+		gap.Status, gap.Attempts, gap.Updated, gap.ID)
+	return err
+}
+
+// CountMissingMessages returns how many message numbers of instance between start and end are not in the database,
+// and were not deleted by retention rules.
+func (db *Database) CountMissingMessages(ctx context.Context, instance string, start, end int64) (int64, error) {
+	var count int64
+
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM (
+			SELECT message_number FROM messages WHERE instance = ? AND message_number BETWEEN ? AND ?
+			UNION SELECT message_number FROM pruned_messages WHERE instance = ? AND message_number BETWEEN ? AND ?
+		)`, instance, start, end, instance, start, end).
+		Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return end - start + 1 - count, nil
+}
+
+// GetMessageGaps returns recorded gaps with status, newest first, with the time of the messages around them.
+// If instance is not empty, only gaps of that instance are returned.
+func (db *Database) GetMessageGaps(ctx context.Context, instance, status string) ([]*MessageGap, error) {
+	gaps := make([]*MessageGap, 0, 16)
+
+	rows, err := db.QueryContext(ctx, `SELECT id, instance, start_number, end_number, status, attempts, detected, updated,
+			COALESCE((SELECT MAX(time) FROM messages WHERE messages.instance = message_gaps.instance AND message_number = start_number - 1), 0),
+			COALESCE((SELECT MIN(time) FROM messages WHERE messages.instance = message_gaps.instance AND message_number = end_number + 1), 0)
+		FROM message_gaps WHERE ? IN ('', instance) AND status = ? ORDER BY start_number DESC`, instance, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var gap MessageGap
+		err = rows.Scan(&gap.ID, &gap.Instance, &gap.Start, &gap.End, &gap.Status, &gap.Attempts, &gap.Detected, &gap.Updated, &gap.FromTime, &gap.ToTime)
+		if err != nil {
+			return nil, err
+		}
+		gaps = append(gaps, &gap)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return gaps, nil
+}
@@ -0,0 +1,597 @@
+// Find, erase and pseudonymise everything stored about one WhatsApp ID.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var ErrSubjectOnLegalHold = errors.New("a chat of the subject is under legal hold")
+
+// Actions recorded in gdpr_audit.
+const (
+	GDPRExport       = "export"
+	GDPRErase        = "erase"
+	GDPRPseudonymise = "pseudonymise"
+)
+
+// SubjectMessage is a message of the subject with its recorded changes.
+type SubjectMessage struct {
+	Message *Message        `json:"message"`
+	Changes []MessageChange `json:"changes"`
+}
+
+type SubjectChat struct {
+	Instance string          `json:"instance"`
+	Chat     json.RawMessage `json:"chat"`
+	Labels   []string        `json:"labels"`
+	Assignee string          `json:"assignee,omitempty"`
+}
+
+// SubjectData is everything stored about a WhatsApp ID.
+type SubjectData struct {
+	Subject  string            `json:"subject"`
+	Messages []*SubjectMessage `json:"messages"`
+	Chats    []*SubjectChat    `json:"chats"`
+	Contact  *Contact          `json:"contact"`
+}
+
+// GDPRReport counts the rows found or changed for a subject.
+type GDPRReport struct {
+	Action   string `json:"action"`
+	Messages int64  `json:"messages"`
+	Changes  int64  `json:"changes"`
+	Chats    int64  `json:"chats"`
+	Contacts int64  `json:"contacts"`
+	// Chat metadata, read state, last messages and backfill progress.
+	ChatRows int64 `json:"chatRows"`
+	// Processed webhook requests and delivered events that mention the subject.
+	WebhookRows int64 `json:"webhookRows"`
+	Media       int   `json:"media,omitempty"`
+	MediaErrors int   `json:"mediaErrors,omitempty"`
+	// Messages of the subject kept because their group chat is under legal hold.
+	HeldMessages int64 `json:"heldMessages,omitempty"`
+}
+
+type GDPRAuditEntry struct {
+	ID     int64  `json:"id"`
+	Time   int64  `json:"time"`
+	Action string `json:"action"`
+	// Keyed hash of the subject, so that the entry does not identify the person.
+	SubjectHash string          `json:"subjectHash"`
+	PerformedBy string          `json:"performedBy"`
+	Report      json.RawMessage `json:"report"`
+}
+
+// subjectPrefix returns the phone number of a chat ID followed by "@",
+// the way it appears in chat IDs, message IDs and payloads. Use subjectGlobs and subjectPattern
+// to find it, which do not match longer numbers that end with the same digits.
+func subjectPrefix(subject string) string {
+	return strings.TrimSuffix(subject, "c.us")
+}
+
+// subjectGlobs returns the arguments of `(column GLOB ? OR column GLOB ?)`,
+// which matches values with the prefix of subject at the start or after a non-digit.
+func subjectGlobs(subject string) []interface{} {
+	prefix := subjectPrefix(subject)
+	return []interface{}{prefix + "*", "*[^0-9]" + prefix + "*"}
+}
+
+// subjectPattern matches the prefix of subject at the start or after a non-digit, which is the first group.
+func subjectPattern(subject string) *regexp.Regexp {
+	return regexp.MustCompile(`(^|[^0-9])` + regexp.QuoteMeta(subjectPrefix(subject)))
+}
+
+// erasedChatHash is stored in erased_chats instead of the ID of an erased chat.
+func (db *Database) erasedChatHash(chatID string) string {
+	return keyedHashPrefix + db.keyedHash(chatID)
+}
+
+// isErasedChat returns true if chatID was erased or pseudonymised on request.
+func (db *Database) isErasedChat(ctx context.Context, tx dbtx, chatID string) (bool, error) {
+	var n int
+	err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM erased_chats WHERE chat_hash = ?`, db.erasedChatHash(chatID)).Scan(&n)
+	return n > 0, err
+}
+
+// Prefix of keyed hashes in pruned_messages and gdpr_audit; older versions stored plain SHA-256.
+const keyedHashPrefix = "hmac:"
+
+// SetHashKey sets the key of the hashes stored instead of phone numbers, which could be
+// recovered from plain hashes by trying every number. If key is empty, a random key is stored
+// in the database. Plain SHA-256 hashes stored by older versions are converted.
+func (db *Database) SetHashKey(ctx context.Context, key string) error {
+	var err error
+	if key == "" {
+		key, err = db.GetOrCreateSetting(ctx, SettingGDPRHashKey, generateToken)
+		if err != nil {
+			return err
+		}
+	}
+	db.HashKey = []byte(key)
+
+	db.Lock()
+	defer db.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Read plain hashes.
+	type plainHash struct {
+		query string
+		args  []interface{}
+		hash  string
+	}
+	var hashes []plainHash
+	rows, err := tx.QueryContext(ctx, `SELECT instance, message_id FROM pruned_messages WHERE message_id LIKE 'sha256:%'`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var instance, messageID string
+		err = rows.Scan(&instance, &messageID)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		hashes = append(hashes, plainHash{`UPDATE OR REPLACE pruned_messages SET message_id = ? WHERE instance = ? AND message_id = ?`,
+			[]interface{}{instance, messageID}, strings.TrimPrefix(messageID, "sha256:")})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows, err = tx.QueryContext(ctx, `SELECT id, subject_hash FROM gdpr_audit WHERE subject_hash NOT LIKE ?`, keyedHashPrefix+"%")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int64
+		var hash string
+		err = rows.Scan(&id, &hash)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		hashes = append(hashes, plainHash{`UPDATE gdpr_audit SET subject_hash = ? WHERE id = ?`, []interface{}{id}, hash})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// Key them.
+	for _, h := range hashes {
+		sum, err := hex.DecodeString(h.hash)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, h.query, append([]interface{}{keyedHashPrefix + db.keySum(sum)}, h.args...)...)
+		if err != nil {
+			return err
+		}
+	}
+	if len(hashes) > 0 {
+		log.Printf("Converted %d plain hashes to keyed hashes", len(hashes))
+	}
+
+	return tx.Commit()
+}
+
+// keyedHash returns the HMAC of the SHA-256 of s, in hex.
+// Hashing the SHA-256 lets plain hashes of older versions be converted.
+func (db *Database) keyedHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return db.keySum(sum[:])
+}
+
+func (db *Database) keySum(sum []byte) string {
+	mac := hmac.New(sha256.New, db.HashKey)
+	mac.Write(sum)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hashedMessageID is stored in pruned_messages instead of the ID of an erased message,
+// which contains the phone number.
+func (db *Database) hashedMessageID(instance, messageID string) string {
+	return keyedHashPrefix + db.keyedHash(instance+" "+messageID)
+}
+
+// GetSubjectData returns the messages sent in the private chat of subject or written by subject in groups,
+// its chats and its contact.
+func (db *Database) GetSubjectData(ctx context.Context, subject string) (*SubjectData, error) {
+	data := &SubjectData{Subject: subject, Messages: []*SubjectMessage{}, Chats: []*SubjectChat{}}
+
+	// Messages.
+	rows, err := db.QueryContext(ctx, `SELECT id, json, instance, COALESCE(ack, ''), COALESCE(revoked, 0), COALESCE(revoked_by, '')
+		FROM messages WHERE chat_id = ? OR author = ? ORDER BY instance, time, id`, subject, subject)
+	if err != nil {
+		return nil, err
+	}
+	var messageRows []MessageRow
+	for rows.Next() {
+		var row MessageRow
+		err = rows.Scan(&row.ID, &row.JSON, &row.Instance, &row.Ack, &row.Revoked, &row.RevokedBy)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messageRows = append(messageRows, row)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, row := range messageRows {
+		message, err := NewMessageFromRow(row)
+		if err != nil {
+			return nil, err
+		}
+		changes, err := db.getMessageChangesByRowID(ctx, row.ID)
+		if err != nil {
+			return nil, err
+		}
+		data.Messages = append(data.Messages, &SubjectMessage{message, changes})
+	}
+
+	// Chats with labels and assignee.
+	rows, err = db.QueryContext(ctx, `SELECT c.instance, c.json, COALESCE(md.labels, '[]'), COALESCE(u.name, '')
+		FROM chats AS c
+		LEFT JOIN chat_metadata AS md ON md.instance = c.instance AND md.chat_id = c.chat_id
+		LEFT JOIN users AS u ON u.id = md.assignee
+		WHERE c.chat_id = ? ORDER BY c.instance`, subject)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var chat SubjectChat
+		var chatJSON, labels []byte
+		err = rows.Scan(&chat.Instance, &chatJSON, &labels, &chat.Assignee)
+		if err != nil {
+			return nil, err
+		}
+		chat.Chat = chatJSON
+		err = json.Unmarshal(labels, &chat.Labels)
+		if err != nil {
+			return nil, err
+		}
+		data.Chats = append(data.Chats, &chat)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Contact.
+	var c Contact
+	err = db.QueryRowContext(ctx, `SELECT id, chat_id, name, phone, email, company, notes FROM contacts WHERE chat_id = ?`, subject).
+		Scan(&c.ID, &c.ChatID, &c.Name, &c.Phone, &c.Email, &c.Company, &c.Notes)
+	if err == nil {
+		data.Contact = &c
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// EraseSubject deletes everything stored about subject, or with pseudonymise replaces
+// its phone number and names with a pseudonym and deletes its contact.
+// Erased messages and the chat of subject are remembered by hash so that they are not copied again.
+// If the chat of subject is under legal hold, nothing is changed and ErrSubjectOnLegalHold is returned;
+// messages of subject in group chats under legal hold are kept.
+func (db *Database) EraseSubject(ctx context.Context, subject string, pseudonymise bool) (*GDPRReport, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	report := &GDPRReport{Action: GDPRErase}
+	if pseudonymise {
+		report.Action = GDPRPseudonymise
+	}
+	prefix := subjectPrefix(subject)
+	pattern := subjectPattern(subject)
+	pseudonym := "anon-" + db.keyedHash(subject)[:12] + "@"
+	pseudonymChatID := pseudonym + "c.us"
+	pseudonymName := "Anonymous " + pseudonym[5:11]
+	replaceSubject := func(s string) string {
+		return pattern.ReplaceAllString(s, "${1}"+pseudonym)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Respect legal holds.
+	var held int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM legal_holds WHERE chat_id = ?`, subject).Scan(&held)
+	if err != nil {
+		return nil, err
+	}
+	if held > 0 {
+		return nil, ErrSubjectOnLegalHold
+	}
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM messages AS m
+		JOIN legal_holds AS h ON h.instance = m.instance AND h.chat_id = m.chat_id
+		WHERE m.author = ?`, subject).Scan(&report.HeldMessages)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read messages.
+	type subjectRow struct {
+		id                  int64
+		instance, messageID string
+		number              int64
+		json                []byte
+		chatID, author      string
+	}
+	var messages []subjectRow
+	rows, err := tx.QueryContext(ctx, `SELECT id, instance, message_id, COALESCE(message_number, 0), json, chat_id, COALESCE(author, '')
+		FROM messages AS m WHERE (chat_id = ? OR author = ?)
+		AND NOT EXISTS (SELECT 1 FROM legal_holds AS h WHERE h.instance = m.instance AND h.chat_id = m.chat_id)`, subject, subject)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var m subjectRow
+		err = rows.Scan(&m.id, &m.instance, &m.messageID, &m.number, &m.json, &m.chatID, &m.author)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Erase or pseudonymise messages.
+	now := time.Now().Unix()
+	for _, m := range messages {
+		_, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO pruned_messages (instance, message_id, message_number, pruned) VALUES (?, ?, ?, ?)`,
+			m.instance, db.hashedMessageID(m.instance, m.messageID), m.number, now)
+		if err != nil {
+			return nil, err
+		}
+
+		if !pseudonymise {
+			res, err := tx.ExecContext(ctx, `DELETE FROM message_changes WHERE row_id = ?`, m.id)
+			if err != nil {
+				return nil, err
+			}
+			n, _ := res.RowsAffected()
+			report.Changes += n
+			_, err = tx.ExecContext(ctx, `DELETE FROM messages WHERE id = ?`, m.id)
+			if err != nil {
+				return nil, err
+			}
+			report.Messages++
+			continue
+		}
+
+		b := BJSON(replaceSubject(string(m.json)))
+		err = b.Update(func(j map[string]interface{}) error {
+			if m.author == subject {
+				j["senderName"] = pseudonymName
+			}
+			if m.chatID == subject {
+				j["chatName"] = pseudonymName
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE messages SET json = ?, message_id = ?, chat_id = ?, author = ?,
+			sender_name = CASE WHEN author = ? THEN ? ELSE sender_name END WHERE id = ?`,
+			[]byte(b), replaceSubject(m.messageID), replaceSubject(m.chatID),
+			replaceSubject(m.author), subject, pseudonymName, m.id)
+		if err != nil {
+			return nil, err
+		}
+		report.Messages++
+	}
+
+	// Erase or pseudonymise chats.
+	if pseudonymise {
+		rows, err := tx.QueryContext(ctx, `SELECT id, json FROM chats WHERE chat_id = ?`, subject)
+		if err != nil {
+			return nil, err
+		}
+		chats := map[int64][]byte{}
+		for rows.Next() {
+			var id int64
+			var b []byte
+			err = rows.Scan(&id, &b)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			chats[id] = b
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		for id, b := range chats {
+			chatJSON := BJSON(replaceSubject(string(b)))
+			err = chatJSON.Update(func(j map[string]interface{}) error {
+				j["name"] = pseudonymName
+				j["image"] = ""
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			_, err = tx.ExecContext(ctx, `UPDATE chats SET chat_id = ?, json = ? WHERE id = ?`, pseudonymChatID, []byte(chatJSON), id)
+			if err != nil {
+				return nil, err
+			}
+			report.Chats++
+		}
+	} else {
+		res, err := tx.ExecContext(ctx, `DELETE FROM chats WHERE chat_id = ?`, subject)
+		if err != nil {
+			return nil, err
+		}
+		report.Chats, _ = res.RowsAffected()
+	}
+
+	// CopyChats must not add the chat again.
+	_, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO erased_chats (chat_hash, erased) VALUES (?, ?)`, db.erasedChatHash(subject), now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tables keyed by chat ID.
+	for _, table := range []string{"chat_metadata", "chat_last_messages", "user_chat_info"} {
+		query := `DELETE FROM ` + table + ` WHERE chat_id = ?`
+		args := []interface{}{subject}
+		if pseudonymise {
+			query = `UPDATE ` + table + ` SET chat_id = ? WHERE chat_id = ?`
+			args = []interface{}{pseudonymChatID, subject}
+		}
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		n, _ := res.RowsAffected()
+		report.ChatRows += n
+	}
+	// The backfill must not look for the chat again.
+	res, err := tx.ExecContext(ctx, `DELETE FROM backfill_chats WHERE chat_id = ?`, subject)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := res.RowsAffected()
+	report.ChatRows += n
+	if pseudonymise {
+		// The number follows "_" in message IDs.
+		_, err = tx.ExecContext(ctx, `UPDATE chat_last_messages SET message_id = REPLACE(message_id, ?, ?) WHERE chat_id = ?`,
+			"_"+prefix, "_"+pseudonym, pseudonymChatID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The contact identifies the person in both cases.
+	res, err = tx.ExecContext(ctx, `DELETE FROM contacts WHERE chat_id = ?`, subject)
+	if err != nil {
+		return nil, err
+	}
+	report.Contacts, _ = res.RowsAffected()
+
+	// Messages pruned earlier.
+	rows, err = tx.QueryContext(ctx, `SELECT instance, message_id FROM pruned_messages WHERE (message_id GLOB ? OR message_id GLOB ?)`,
+		subjectGlobs(subject)...)
+	if err != nil {
+		return nil, err
+	}
+	var pruned [][2]string
+	for rows.Next() {
+		var p [2]string
+		err = rows.Scan(&p[0], &p[1])
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		pruned = append(pruned, p)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, p := range pruned {
+		_, err = tx.ExecContext(ctx, `UPDATE OR REPLACE pruned_messages SET message_id = ? WHERE instance = ? AND message_id = ?`,
+			db.hashedMessageID(p[0], p[1]), p[0], p[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Webhook requests and events already processed.
+	// Pending ones are kept; messages they bring back are ignored as erased.
+	for _, query := range []string{
+		`DELETE FROM webhook_inbox WHERE status != 'pending' AND (payload GLOB ? OR payload GLOB ?)`,
+		`DELETE FROM webhook_deliveries WHERE status != 'pending' AND (payload GLOB ? OR payload GLOB ?)`,
+	} {
+		res, err := tx.ExecContext(ctx, query, subjectGlobs(subject)...)
+		if err != nil {
+			return nil, err
+		}
+		n, _ := res.RowsAffected()
+		report.WebhookRows += n
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	db.MessageW.Notify()
+	return report, nil
+}
+
+// AddGDPRAudit records an export or erasure of subject.
+func (db *Database) AddGDPRAudit(ctx context.Context, subject, performedBy string, report *GDPRReport) error {
+	db.Lock()
+	defer db.Unlock()
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO gdpr_audit (time, action, subject_hash, performed_by, report) VALUES (?, ?, ?, ?, ?)`,
+		time.Now().Unix(), report.Action, keyedHashPrefix+db.keyedHash(subject), performedBy, string(b))
+	return err
+}
+
+// GetGDPRAudit returns the audit entries, newest first.
+// If subject is not empty, only its entries are returned.
+func (db *Database) GetGDPRAudit(ctx context.Context, subject string) ([]*GDPRAuditEntry, error) {
+	entries := make([]*GDPRAuditEntry, 0, 16)
+
+	hash := ""
+	if subject != "" {
+		hash = keyedHashPrefix + db.keyedHash(subject)
+	}
+	rows, err := db.QueryContext(ctx, `SELECT id, time, action, subject_hash, performed_by, report FROM gdpr_audit
+		WHERE ? IN ('', subject_hash) ORDER BY id DESC`, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e GDPRAuditEntry
+		var report []byte
+		err = rows.Scan(&e.ID, &e.Time, &e.Action, &e.SubjectHash, &e.PerformedBy, &report)
+		if err != nil {
+			return nil, err
+		}
+		e.Report = report
+		entries = append(entries, &e)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
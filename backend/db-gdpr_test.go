@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// dumpDatabase returns every row of every table of db as text.
+func dumpDatabase(t *testing.T, db *Database) string {
+	t.Helper()
+	var tables []string
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	var b strings.Builder
+	for _, table := range tables {
+		rows, err := db.Query(`SELECT * FROM ` + table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		columns, err := rows.Columns()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			pointers := make([]interface{}, len(columns))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			err = rows.Scan(pointers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, v := range values {
+				if s, ok := v.([]byte); ok {
+					v = string(s)
+				}
+				fmt.Fprintf(&b, "%s.%s: %v\n", table, columns[i], v)
+			}
+		}
+		rows.Close()
+	}
+	return b.String()
+}
+
+func TestEraseSubject(t *testing.T) {
+	// The other number ends with the digits of the subject.
+	const subject, other = "5511910000000@c.us", "15511910000000@c.us"
+	for _, pseudonymise := range []bool{false, true} {
+		t.Run(fmt.Sprint("pseudonymise=", pseudonymise), func(t *testing.T) {
+			ctx := context.Background()
+			db := newTestDatabase(t)
+			err := db.SetHashKey(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sim, chatAPI := newTestSimulator(t, "test", 2, 4)
+			sim.Receive(ctx, other, "Hello")
+			sim.Receive(ctx, other, "Hello again")
+			copyAll(t, db, chatAPI)
+			for _, chatID := range []string{subject, other} {
+				contact := &Contact{Name: "Contact " + chatID, Phone: chatID}
+				err = contact.Validate()
+				if err == nil {
+					err = db.AddContact(ctx, contact)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = db.SetUserChatAsRead(ctx, "default", 1, chatID, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			otherMessages := countOther(t, db, other)
+			before := dumpDatabase(t, db)
+			if !strings.Contains(before, subject) {
+				t.Fatal("the subject is not in the database")
+			}
+
+			report, err := db.EraseSubject(ctx, subject, pseudonymise)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Messages != 4 || report.Chats != 1 || report.Contacts != 1 {
+				t.Errorf("report: %+v", report)
+			}
+
+			// No trace of the subject, but everything of the other number.
+			after := dumpDatabase(t, db)
+			if subjectPattern(subject).MatchString(after) {
+				for _, line := range strings.Split(after, "\n") {
+					if subjectPattern(subject).MatchString(line) {
+						t.Errorf("left: %s", line)
+					}
+				}
+			}
+			if n := strings.Count(after, other); n != strings.Count(before, other) {
+				t.Errorf("other number: %d mentions, want %d", n, strings.Count(before, other))
+			}
+			if n := countOther(t, db, other); n != otherMessages {
+				t.Errorf("other number: %d messages, want %d", n, otherMessages)
+			}
+
+			// Copying again does not bring the subject back.
+			copyAll(t, db, chatAPI)
+			if subjectPattern(subject).MatchString(dumpDatabase(t, db)) {
+				t.Error("the subject was copied again")
+			}
+		})
+	}
+}
+
+func countOther(t *testing.T, db *Database, chatID string) int {
+	t.Helper()
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM messages WHERE chat_id = ?`, chatID).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,159 @@
+// Read and write the incoming webhook queue.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+type InboxEntry struct {
+	ID          int64  `json:"id"`
+	Instance    string `json:"instance"`
+	Payload     BJSON  `json:"payload"`
+	Status      string `json:"status"`
+	Attempts    int    `json:"attempts"`
+	NextAttempt int64  `json:"nextAttempt"`
+	LastError   string `json:"lastError"`
+	Received    int64  `json:"received"`
+	Processed   int64  `json:"processed"`
+}
+
+// AddInboxEntry stores a webhook request body from instance to be processed later.
+// If replayWindow is not zero, ErrWebhookReplay is returned if the same body was stored within it.
+// The body is only remembered if it is stored, so that Chat-API can retry after an error.
+func (db *Database) AddInboxEntry(ctx context.Context, instance string, payload []byte, replayWindow time.Duration) error {
+	db.Lock()
+	defer db.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Check for replays.
+	if replayWindow > 0 {
+		hash := sha256.Sum256(payload)
+		isNew, err := addWebhookRequest(ctx, tx, hex.EncodeToString(hash[:]), replayWindow)
+		if err != nil {
+			return err
+		}
+		if !isNew {
+			return ErrWebhookReplay
+		}
+	}
+
+	now := time.Now().Unix()
+	_, err = tx.ExecContext(ctx, `INSERT INTO webhook_inbox (instance, payload, status, attempts, next_attempt, last_error, received, processed) VALUES (?, ?, 'pending', 0, ?, '', ?, 0)`,
+		instance, string(payload), now, now)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	db.InboxW.Notify()
+	return nil
+}
+
+// GetDueInboxEntries returns pending entries of instance that should be processed now, oldest first.
+func (db *Database) GetDueInboxEntries(ctx context.Context, instance string, limit int) ([]*InboxEntry, error) {
+	return db.getInboxEntries(ctx, `WHERE instance = ? AND status = 'pending' AND next_attempt <= ? ORDER BY id LIMIT ?`, instance, time.Now().Unix(), limit)
+}
+
+// GetInboxEntries returns the most recent entries, optionally filtered by instance and status.
+func (db *Database) GetInboxEntries(ctx context.Context, instance, status string, limit int) ([]*InboxEntry, error) {
+	return db.getInboxEntries(ctx, `WHERE ? IN ('', instance) AND ? IN ('', status) ORDER BY id DESC LIMIT ?`, instance, status, limit)
+}
+
+// GetNextInboxAttempt returns the time of the next pending entry of instance, or zero if there is none.
+func (db *Database) GetNextInboxAttempt(ctx context.Context, instance string) (int64, error) {
+	var next int64
+
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MIN(next_attempt), 0) FROM webhook_inbox WHERE instance = ? AND status = 'pending'`, instance).
+		Scan(&next)
+	if err != nil {
+		return 0, err
+	}
+
+	return next, nil
+}
+
+func (db *Database) getInboxEntries(ctx context.Context, where string, args ...interface{}) ([]*InboxEntry, error) {
+	entries := make([]*InboxEntry, 0, 16)
+
+	rows, err := db.QueryContext(ctx, `SELECT id, instance, payload, status, attempts, next_attempt, last_error, received, processed FROM webhook_inbox `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e InboxEntry
+		var payload string
+		err = rows.Scan(&e.ID, &e.Instance, &payload, &e.Status, &e.Attempts, &e.NextAttempt, &e.LastError, &e.Received, &e.Processed)
+		if err != nil {
+			return nil, err
+		}
+		e.Payload = BJSON(payload)
+		entries = append(entries, &e)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// UpdateInboxEntry saves the result of processing an entry.
+func (db *Database) UpdateInboxEntry(ctx context.Context, e *InboxEntry) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.ExecContext(ctx, `UPDATE webhook_inbox SET status = ?, attempts = ?, next_attempt = ?, last_error = ?, processed = ? WHERE id = ?`,
+		e.Status, e.Attempts, e.NextAttempt, e.LastError, e.Processed, e.ID)
+	return err
+}
+
+// ReplayInboxEntries queues dead entries of instance again.
+// If id is zero, all dead entries are queued.
+func (db *Database) ReplayInboxEntries(ctx context.Context, instance string, id int64) (int64, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var res sql.Result
+	var err error
+	now := time.Now().Unix()
+	if id == 0 {
+		res, err = db.ExecContext(ctx, `UPDATE webhook_inbox SET status = 'pending', attempts = 0, next_attempt = ? WHERE instance = ? AND status = 'dead'`, now, instance)
+	} else {
+		res, err = db.ExecContext(ctx, `UPDATE webhook_inbox SET status = 'pending', attempts = 0, next_attempt = ? WHERE instance = ? AND status = 'dead' AND id = ?`, now, instance, id)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	db.InboxW.Notify()
+	return affected, nil
+}
+
+// DeleteProcessedInboxEntries removes entries processed before t.
+func (db *Database) DeleteProcessedInboxEntries(ctx context.Context, t time.Time) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.ExecContext(ctx, `DELETE FROM webhook_inbox WHERE status = 'done' AND processed < ?`, t.Unix())
+	return err
+}
@@ -0,0 +1,325 @@
+// Delete old messages and media, except in chats under legal hold.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Rows changed per transaction, so that the database is not locked for long.
+const pruneBatchSize = 1000
+
+// RetentionChat is a chat with messages, with what retention rules need to know about it.
+type RetentionChat struct {
+	Instance string
+	ChatID   string
+	Labels   []string
+	Held     bool
+}
+
+// GetRetentionChats returns every chat with messages.
+func (db *Database) GetRetentionChats(ctx context.Context) ([]*RetentionChat, error) {
+	var chats []*RetentionChat
+
+	rows, err := db.QueryContext(ctx, `SELECT s.instance, s.chat_id, COALESCE(md.labels, '[]'), h.chat_id IS NOT NULL
+		FROM chat_last_messages AS s
+		LEFT JOIN chat_metadata AS md ON md.instance = s.instance AND md.chat_id = s.chat_id
+		LEFT JOIN legal_holds AS h ON h.instance = s.instance AND h.chat_id = s.chat_id
+		ORDER BY s.instance, s.chat_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chat RetentionChat
+		var labels []byte
+		err = rows.Scan(&chat.Instance, &chat.ChatID, &labels, &chat.Held)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(labels, &chat.Labels)
+		if err != nil {
+			return nil, err
+		}
+		chats = append(chats, &chat)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return chats, nil
+}
+
+// mediaTypesSQL returns the placeholders and arguments of MediaMessageTypes for an IN clause.
+func mediaTypesSQL() (string, []interface{}) {
+	args := make([]interface{}, len(MediaMessageTypes))
+	for i, t := range MediaMessageTypes {
+		args[i] = t
+	}
+	return strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", "), args
+}
+
+// CountMessagesBefore returns how many messages of chatID in instance are older than before.
+func (db *Database) CountMessagesBefore(ctx context.Context, instance, chatID string, before int64) (int64, error) {
+	var n int64
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM messages WHERE instance = ? AND chat_id = ? AND time < ?`, instance, chatID, before).Scan(&n)
+	return n, err
+}
+
+// CountMediaBetween returns how many media messages of chatID in instance, from after to before,
+// still have their media URL.
+func (db *Database) CountMediaBetween(ctx context.Context, instance, chatID string, after, before int64) (int64, error) {
+	types, args := mediaTypesSQL()
+	var n int64
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM messages WHERE instance = ? AND chat_id = ? AND time >= ? AND time < ?
+		AND type IN (`+types+`) AND media_pruned IS NULL`,
+		append([]interface{}{instance, chatID, after, before}, args...)...).Scan(&n)
+	return n, err
+}
+
+// PruneMessages deletes the messages of chatID in instance older than before, returning how many were deleted.
+// Their IDs are kept in pruned_messages so that they are not copied again.
+func (db *Database) PruneMessages(ctx context.Context, instance, chatID string, before int64) (int64, error) {
+	var total int64
+	for {
+		n, err := db.pruneMessagesBatch(ctx, instance, chatID, before)
+		total += n
+		if err != nil || n < pruneBatchSize {
+			if total > 0 {
+				db.MessageW.Notify()
+			}
+			return total, err
+		}
+	}
+}
+
+func (db *Database) pruneMessagesBatch(ctx context.Context, instance, chatID string, before int64) (int64, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Select a batch.
+	_, err = tx.ExecContext(ctx, `CREATE TEMP TABLE IF NOT EXISTS prune_ids (id INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM prune_ids`)
+	if err != nil {
+		return 0, err
+	}
+	// A legal hold added since the chat was selected stops pruning.
+	res, err := tx.ExecContext(ctx, `INSERT INTO prune_ids SELECT id FROM messages WHERE instance = ? AND chat_id = ? AND time < ?
+		AND NOT EXISTS (SELECT 1 FROM legal_holds WHERE instance = ? AND chat_id = ?) LIMIT ?`,
+		instance, chatID, before, instance, chatID, pruneBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	// Remember, then delete the messages and their history.
+	_, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO pruned_messages (instance, message_id, message_number, pruned)
+		SELECT instance, message_id, message_number, ? FROM messages WHERE id IN (SELECT id FROM prune_ids)`, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM message_changes WHERE row_id IN (SELECT id FROM prune_ids)`)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO message_changes (row_id, kind, old_value, new_value, time)
+		SELECT id, ?, message_id, instance, ? FROM messages WHERE id IN (SELECT id FROM prune_ids)`, ChangePruned, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM messages WHERE id IN (SELECT id FROM prune_ids)`)
+	if err != nil {
+		return 0, err
+	}
+
+	// Point the chat at its newest remaining message, or forget it if none is left.
+	_, err = tx.ExecContext(ctx, `UPDATE chat_last_messages SET (time, message_id) = (
+			SELECT time, message_id FROM messages WHERE instance = ? AND chat_id = ? ORDER BY time DESC, id DESC LIMIT 1
+		) WHERE instance = ? AND chat_id = ? AND EXISTS (SELECT 1 FROM messages WHERE instance = ? AND chat_id = ?)`,
+		instance, chatID, instance, chatID, instance, chatID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM chat_last_messages WHERE instance = ? AND chat_id = ?
+		AND NOT EXISTS (SELECT 1 FROM messages WHERE instance = ? AND chat_id = ?)`, instance, chatID, instance, chatID)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
+
+// PruneMedia removes the media URL of media messages of chatID in instance from after to before,
+// returning how many messages were changed.
+func (db *Database) PruneMedia(ctx context.Context, instance, chatID string, after, before int64) (int64, error) {
+	var total int64
+	for {
+		n, err := db.pruneMediaBatch(ctx, instance, chatID, after, before)
+		total += n
+		if err != nil || n < pruneBatchSize {
+			if total > 0 {
+				db.MessageW.Notify()
+			}
+			return total, err
+		}
+	}
+}
+
+func (db *Database) pruneMediaBatch(ctx context.Context, instance, chatID string, after, before int64) (int64, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Read a batch.
+	types, args := mediaTypesSQL()
+	rows, err := tx.QueryContext(ctx, `SELECT id, json FROM messages WHERE instance = ? AND chat_id = ? AND time >= ? AND time < ?
+		AND type IN (`+types+`) AND media_pruned IS NULL
+		AND NOT EXISTS (SELECT 1 FROM legal_holds WHERE instance = ? AND chat_id = ?) LIMIT ?`,
+		append(append([]interface{}{instance, chatID, after, before}, args...), instance, chatID, pruneBatchSize)...)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	var jsons []BJSON
+	for rows.Next() {
+		var id int64
+		var b []byte
+		err = rows.Scan(&id, &b)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		jsons = append(jsons, BJSON(b))
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	// Remove the URL; the caption is kept.
+	now := time.Now().Unix()
+	for i, id := range ids {
+		b := jsons[i]
+		err = b.Update(func(j map[string]interface{}) error {
+			j["body"] = ""
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE messages SET json = ?, body = '', media_pruned = ? WHERE id = ?`, []byte(b), now, id)
+		if err != nil {
+			return 0, err
+		}
+		err = addMessageChange(ctx, tx, id, ChangeMediaPruned, "", "")
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(ids)), tx.Commit()
+}
+
+// isPrunedMessage returns true if messageID was deleted by a retention rule or erased on request.
+func (db *Database) isPrunedMessage(ctx context.Context, tx dbtx, instance, messageID string) (bool, error) {
+	var n int
+	err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM pruned_messages WHERE instance = ? AND message_id IN (?, ?)`,
+		instance, messageID, db.hashedMessageID(instance, messageID)).Scan(&n)
+	return n > 0, err
+}
+
+// Vacuum rebuilds the database file, returning the space of deleted rows to the file system.
+func (db *Database) Vacuum(ctx context.Context) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.ExecContext(ctx, `VACUUM`)
+	return err
+}
+
+type LegalHold struct {
+	Instance  string `json:"instance"`
+	ChatID    string `json:"chatId"`
+	Reason    string `json:"reason"`
+	Created   int64  `json:"created"`
+	CreatedBy string `json:"createdBy"`
+}
+
+// AddLegalHold exempts a chat from retention rules; an existing hold is replaced.
+func (db *Database) AddLegalHold(ctx context.Context, hold *LegalHold) error {
+	db.Lock()
+	defer db.Unlock()
+
+	hold.Created = time.Now().Unix()
+	_, err := db.ExecContext(ctx, `REPLACE INTO legal_holds (instance, chat_id, reason, created, created_by) VALUES (?, ?, ?, ?, ?)`,
+		hold.Instance, hold.ChatID, hold.Reason, hold.Created, hold.CreatedBy)
+	return err
+}
+
+// RemoveLegalHold lets retention rules apply to a chat again.
+// It returns sql.ErrNoRows if the chat was not under legal hold.
+func (db *Database) RemoveLegalHold(ctx context.Context, instance, chatID string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	res, err := db.ExecContext(ctx, `DELETE FROM legal_holds WHERE instance = ? AND chat_id = ?`, instance, chatID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = sql.ErrNoRows
+	}
+	return err
+}
+
+// GetLegalHolds returns every legal hold, newest first.
+func (db *Database) GetLegalHolds(ctx context.Context) ([]*LegalHold, error) {
+	holds := make([]*LegalHold, 0, 16)
+
+	rows, err := db.QueryContext(ctx, `SELECT instance, chat_id, COALESCE(reason, ''), created, COALESCE(created_by, '') FROM legal_holds ORDER BY created DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hold LegalHold
+		err = rows.Scan(&hold.Instance, &hold.ChatID, &hold.Reason, &hold.Created, &hold.CreatedBy)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, &hold)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return holds, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPruneMessages(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	_, chatAPI := newTestSimulator(t, "test", 3, 6)
+	copyAll(t, db, chatAPI)
+	const pruned, held, emptied = "5511910000000@c.us", "5511910000001@c.us", "5511910000002@c.us"
+	count := func(chatID string) int64 {
+		t.Helper()
+		n, err := db.CountMessagesBefore(ctx, "default", chatID, time.Now().Unix()+3600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for _, chatID := range []string{pruned, held, emptied} {
+		if n := count(chatID); n != 6 {
+			t.Fatalf("%s: got %d messages, want 6", chatID, n)
+		}
+	}
+
+	// Point the chat at an old message, which the prune must repoint.
+	_, err := db.Exec(`UPDATE chat_last_messages SET (time, message_id) = (
+			SELECT time, message_id FROM messages WHERE chat_id = ? ORDER BY time LIMIT 1
+		) WHERE chat_id = ?`, pruned, pruned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddLegalHold(ctx, &LegalHold{Instance: "default", ChatID: held, Reason: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The 3 messages older than 3.5 hours, and all messages of the last chat.
+	before := time.Now().Unix() - 3*3600 - 1800
+	for _, chatID := range []string{pruned, held} {
+		_, err = db.PruneMessages(ctx, "default", chatID, before)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.PruneMessages(ctx, "default", emptied, time.Now().Unix()+3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(pruned); n != 3 {
+		t.Errorf("pruned chat: got %d messages, want 3", n)
+	}
+	if n := count(held); n != 6 {
+		t.Errorf("held chat: got %d messages, want 6", n)
+	}
+	if n := count(emptied); n != 0 {
+		t.Errorf("emptied chat: got %d messages, want 0", n)
+	}
+	if n := countRows(t, db, "pruned_messages"); n != 9 {
+		t.Errorf("pruned_messages: got %d, want 9", n)
+	}
+
+	// The last message of the chat is its newest remaining one; an empty chat has none.
+	var lastID, newestID string
+	err = db.QueryRow(`SELECT message_id FROM chat_last_messages WHERE chat_id = ?`, pruned).Scan(&lastID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRow(`SELECT message_id FROM messages WHERE chat_id = ? ORDER BY time DESC LIMIT 1`, pruned).Scan(&newestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastID != newestID {
+		t.Errorf("last message: got %s, want %s", lastID, newestID)
+	}
+	var n int
+	err = db.QueryRow(`SELECT COUNT(*) FROM chat_last_messages WHERE chat_id = ?`, emptied).Scan(&n)
+	if err != nil || n != 0 {
+		t.Errorf("emptied chat: %d last messages, %v", n, err)
+	}
+
+	// Copying everything again does not bring them back.
+	copyAll(t, db, chatAPI)
+	if n := count(pruned); n != 3 {
+		t.Errorf("pruned chat after copy: got %d messages, want 3", n)
+	}
+	if n := count(emptied); n != 0 {
+		t.Errorf("emptied chat after copy: got %d messages, want 0", n)
+	}
+}
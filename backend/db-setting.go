@@ -0,0 +1,81 @@
+// Read and write settings that must survive restarts.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Setting keys.
+const (
+	SettingWebhookSecret = "chat-api.webhook-secret"
+	SettingWebhookURL    = "chat-api.webhook-url"  // last URL sent to Chat-API
+	SettingLastVacuum    = "retention.last-vacuum" // unix time
+	SettingGDPRHashKey   = "gdpr.hash-key"         // used if the configuration has none
+)
+
+// GetSetting returns the value of key, or sql.ErrNoRows if it is not set.
+func (db *Database) GetSetting(ctx context.Context, key string) (string, error) {
+	var value string
+
+	err := db.QueryRowContext(ctx, `SELECT value FROM settings WHERE key = ?`, key).Scan(&value)
+	if err != nil {
+		return "", err
+	}
+
+	return value, nil
+}
+
+// SetSetting stores value in key.
+func (db *Database) SetSetting(ctx context.Context, key, value string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.ExecContext(ctx, `REPLACE INTO settings (key, value) VALUES (?, ?)`, key, value)
+	return err
+}
+
+// GetOrCreateSetting returns the value of key, storing create() first if it is not set.
+func (db *Database) GetOrCreateSetting(ctx context.Context, key string, create func() string) (string, error) {
+	value, err := db.GetSetting(ctx, key)
+	if err == nil {
+		return value, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	value = create()
+	err = db.SetSetting(ctx, key, value)
+	if err != nil {
+		return "", err
+	}
+
+	return value, nil
+}
+
+// addWebhookRequest records the hash of a webhook request body.
+// Returns false if the same body was already received within window.
+func addWebhookRequest(ctx context.Context, tx dbtx, hash string, window time.Duration) (bool, error) {
+	now := time.Now()
+
+	// Forget old requests.
+	_, err := tx.ExecContext(ctx, `DELETE FROM webhook_requests WHERE time < ?`, now.Add(-window).Unix())
+	if err != nil {
+		return false, err
+	}
+
+	res, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO webhook_requests (hash, time) VALUES (?, ?)`, hash, now.Unix())
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
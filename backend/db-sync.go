@@ -0,0 +1,106 @@
+// Read and write the position of the sync loops.
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// SyncState is where a sync loop stopped.
+type SyncState struct {
+	Name              string `json:"name"`
+	LastMessageNumber int64  `json:"lastMessageNumber"`
+	LastChatsSync     int64  `json:"lastChatsSync"`
+	BackfillChatID    string `json:"backfillChatId"`
+	BackfillMaxTime   int64  `json:"backfillMaxTime"`
+	Owner             string `json:"owner"`
+	LeaseUntil        int64  `json:"leaseUntil"`
+	Updated           int64  `json:"updated"`
+}
+
+// GetSyncState returns the state of sync loop name, or sql.ErrNoRows if it never ran.
+func (db *Database) GetSyncState(ctx context.Context, name string) (*SyncState, error) {
+	state := SyncState{Name: name}
+
+	err := db.QueryRowContext(ctx, `SELECT last_message_number, last_chats_sync, backfill_chat_id, backfill_max_time, owner, lease_until, updated FROM sync_state WHERE name = ?`, name).
+		Scan(&state.LastMessageNumber, &state.LastChatsSync, &state.BackfillChatID, &state.BackfillMaxTime, &state.Owner, &state.LeaseUntil, &state.Updated)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// CreateSyncState creates the state of sync loop name if it does not exist.
+func (db *Database) CreateSyncState(ctx context.Context, name string, lastMessageNumber int64) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO sync_state (name, last_message_number, last_chats_sync, backfill_chat_id, backfill_max_time, owner, lease_until, updated) VALUES (?, ?, 0, '', 0, '', 0, ?)`,
+		name, lastMessageNumber, time.Now().Unix())
+	return err
+}
+
+// setSyncLastMessageNumber moves the message cursor forward, never backwards.
+// It runs in the transaction that adds the messages.
+func setSyncLastMessageNumber(ctx context.Context, tx dbtx, name string, number int64) error {
+	_, err := tx.ExecContext(ctx, `UPDATE sync_state SET last_message_number = MAX(last_message_number, ?), updated = ? WHERE name = ?`,
+		number, time.Now().Unix(), name)
+	return err
+}
+
+// setSyncBackfill saves the backfill position.
+// It runs in the transaction that adds the messages.
+func setSyncBackfill(ctx context.Context, tx dbtx, name, chatID string, maxTime int64) error {
+	_, err := tx.ExecContext(ctx, `UPDATE sync_state SET backfill_chat_id = ?, backfill_max_time = ?, updated = ? WHERE name = ?`,
+		chatID, maxTime, time.Now().Unix(), name)
+	return err
+}
+
+// SetSyncLastChatsSync records that chats were copied at t.
+func (db *Database) SetSyncLastChatsSync(ctx context.Context, name string, t time.Time) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.ExecContext(ctx, `UPDATE sync_state SET last_chats_sync = ?, updated = ? WHERE name = ?`,
+		t.Unix(), time.Now().Unix(), name)
+	return err
+}
+
+// AcquireSyncLease lets only one process run sync loop name at a time.
+// Returns true if owner holds the lease until ttl from now.
+func (db *Database) AcquireSyncLease(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	now := time.Now()
+	res, err := db.ExecContext(ctx, `UPDATE sync_state SET owner = ?, lease_until = ? WHERE name = ? AND (owner = ? OR owner = '' OR lease_until < ?)`,
+		owner, now.Add(ttl).Unix(), name, owner, now.Unix())
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		// Check that the state exists.
+		_, err = db.GetSyncState(ctx, name)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return affected == 1, nil
+}
+
+// ReleaseSyncLease lets another process run sync loop name now, if owner holds the lease.
+func (db *Database) ReleaseSyncLease(ctx context.Context, name, owner string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.ExecContext(ctx, `UPDATE sync_state SET owner = '', lease_until = 0 WHERE name = ? AND owner = ?`, name, owner)
+	return err
+}
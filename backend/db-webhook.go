@@ -0,0 +1,160 @@
+// Read and write the outbound webhook delivery queue.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+type WebhookDelivery struct {
+	ID          int64           `json:"id"`
+	URL         string          `json:"url"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt int64           `json:"nextAttempt"`
+	LastError   string          `json:"lastError"`
+	Created     int64           `json:"created"`
+	Delivered   int64           `json:"delivered"`
+}
+
+// addEvent queues event for every webhook subscribed to it.
+// The database must be locked by the caller, who calls notifyWebhooks once the change is committed,
+// so that the sender does not look for deliveries before they are visible.
+func (db *Database) addEvent(ctx context.Context, tx dbtx, event string, data interface{}) error {
+	var payload []byte
+	now := time.Now().Unix()
+
+	for _, webhook := range db.Webhooks {
+		if !webhook.Subscribed(event) {
+			continue
+		}
+
+		// Encode payload once.
+		if payload == nil {
+			var err error
+			payload, err = json.Marshal(map[string]interface{}{"event": event, "time": now, "data": data})
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.ExecContext(ctx, `INSERT INTO webhook_deliveries (url, event, payload, status, attempts, next_attempt, last_error, created, delivered) VALUES (?, ?, ?, 'pending', 0, ?, '', ?, 0)`,
+			webhook.URL, event, string(payload), now, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// notifyWebhooks wakes the webhook sender after events were committed.
+func (db *Database) notifyWebhooks() {
+	if len(db.Webhooks) > 0 {
+		db.WebhookW.Notify()
+	}
+}
+
+// AddEvent queues an event that is not part of another database change.
+func (db *Database) AddEvent(ctx context.Context, event string, data interface{}) error {
+	db.Lock()
+	defer db.Unlock()
+
+	err := db.addEvent(ctx, db, event, data)
+	if err != nil {
+		return err
+	}
+
+	db.notifyWebhooks()
+	return nil
+}
+
+// GetDueWebhookDeliveries returns pending deliveries that should be attempted now.
+func (db *Database) GetDueWebhookDeliveries(ctx context.Context, limit int) ([]*WebhookDelivery, error) {
+	return db.getWebhookDeliveries(ctx, `WHERE status = 'pending' AND next_attempt <= ? ORDER BY next_attempt, id LIMIT ?`, time.Now().Unix(), limit)
+}
+
+// GetWebhookDeliveries returns the most recent deliveries, optionally filtered by status.
+func (db *Database) GetWebhookDeliveries(ctx context.Context, status string, limit int) ([]*WebhookDelivery, error) {
+	if status == "" {
+		return db.getWebhookDeliveries(ctx, `ORDER BY id DESC LIMIT ?`, limit)
+	}
+	return db.getWebhookDeliveries(ctx, `WHERE status = ? ORDER BY id DESC LIMIT ?`, status, limit)
+}
+
+// GetNextWebhookAttempt returns the time of the next pending delivery, or zero if there is none.
+func (db *Database) GetNextWebhookAttempt(ctx context.Context) (int64, error) {
+	var next int64
+
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MIN(next_attempt), 0) FROM webhook_deliveries WHERE status = 'pending'`).
+		Scan(&next)
+	if err != nil {
+		return 0, err
+	}
+
+	return next, nil
+}
+
+func (db *Database) getWebhookDeliveries(ctx context.Context, where string, args ...interface{}) ([]*WebhookDelivery, error) {
+	deliveries := make([]*WebhookDelivery, 0, 16)
+
+	rows, err := db.QueryContext(ctx, `SELECT id, url, event, payload, status, attempts, next_attempt, last_error, created, delivered FROM webhook_deliveries `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload string
+		err = rows.Scan(&d.ID, &d.URL, &d.Event, &payload, &d.Status, &d.Attempts, &d.NextAttempt, &d.LastError, &d.Created, &d.Delivered)
+		if err != nil {
+			return nil, err
+		}
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, &d)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// UpdateWebhookDelivery saves the result of a delivery attempt.
+func (db *Database) UpdateWebhookDelivery(ctx context.Context, d *WebhookDelivery) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.ExecContext(ctx, `UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt = ?, last_error = ?, delivered = ? WHERE id = ?`,
+		d.Status, d.Attempts, d.NextAttempt, d.LastError, d.Delivered, d.ID)
+	return err
+}
+
+// RetryWebhookDelivery resets a delivery so that it is attempted again now.
+func (db *Database) RetryWebhookDelivery(ctx context.Context, id int64) error {
+	db.Lock()
+	defer db.Unlock()
+
+	res, err := db.ExecContext(ctx, `UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt = ? WHERE id = ?`, time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return sql.ErrNoRows
+	}
+
+	db.WebhookW.Notify()
+	return nil
+}
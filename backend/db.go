@@ -5,9 +5,12 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -22,6 +25,13 @@ type Database struct {
 
 	ChatW    Wait
 	MessageW Wait
+	WebhookW Wait
+	InboxW   Wait
+
+	// Outbound webhook subscriptions.
+	Webhooks []ConfigWebhook
+	// Key of the hashes stored instead of erased phone numbers; set by SetHashKey.
+	HashKey []byte
 }
 
 func NewDatabase(driver, dsn string) *Database {
@@ -45,15 +55,107 @@ func (db *Database) Open() error {
 // Create creates tables, indexes, etc.
 func (db *Database) Create() error {
 	_, err := db.Exec(SQLITE_INIT)
-	return err
+	if err != nil {
+		return err
+	}
+
+	return db.Migrate()
+}
+
+// Migrate runs the migrations that were not applied yet.
+func (db *Database) Migrate() error {
+	var version int
+	err := db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(SQLITE_MIGRATIONS); version++ {
+		log.Printf("Running database migration %d", version)
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(SQLITE_MIGRATIONS[version])
+		if err == nil && SQLITE_MIGRATION_FUNCS[version] != nil {
+			err = SQLITE_MIGRATION_FUNCS[version](tx)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", version, err)
+		}
+		_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateMessageColumns copies the fields of every message from JSON to their columns.
+func migrateMessageColumns(tx *sql.Tx) error {
+	var lastID int64
+	for {
+		// Read a batch of messages.
+		rows, err := tx.Query(`SELECT id, json FROM messages WHERE id > ? ORDER BY id LIMIT 1000`, lastID)
+		if err != nil {
+			return err
+		}
+		var n int
+		var rowIDs []int64
+		var messages []*Message
+		for rows.Next() {
+			n++
+			var id int64
+			var b []byte
+			err = rows.Scan(&id, &b)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			lastID = id
+			message, err := NewMessageFromBJSON(b)
+			if message == nil {
+				log.Printf("Message row %d: %v", id, err)
+				continue
+			}
+			rowIDs = append(rowIDs, id)
+			messages = append(messages, message)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+
+		// Update columns.
+		for i, message := range messages {
+			_, err = tx.Exec(`UPDATE messages SET from_me = ?, author = ?, type = ?, body = ?, ack = ?, quoted_msg_id = ?, sender_name = ? WHERE id = ?`,
+				message.FromMe, message.Author, message.Type, message.Body, message.Ack, message.QuotedMsgID, message.SenderName, rowIDs[i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
 // CheckPassword returns User if username and password exist in the users table.
 func (db *Database) CheckPassword(ctx context.Context, username, password string) (*User, error) {
 	var user User
 
-	err := db.QueryRowContext(ctx, `SELECT id, name, label, token FROM users WHERE name = ? AND password = ? LIMIT 1`, username, password).
-		Scan(&user.ID, &user.Name, &user.Label, &user.Token)
+	err := db.QueryRowContext(ctx, `SELECT id, name, label, token, admin, supervisor FROM users WHERE name = ? AND password = ? LIMIT 1`, username, password).
+		Scan(&user.ID, &user.Name, &user.Label, &user.Token, &user.Admin, &user.Supervisor)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, ErrInvalidUser
@@ -68,8 +170,8 @@ func (db *Database) CheckPassword(ctx context.Context, username, password string
 func (db *Database) CheckToken(ctx context.Context, token string) (*User, error) {
 	var user User
 
-	err := db.QueryRowContext(ctx, `SELECT id, name, label FROM users WHERE token = ? LIMIT 1`, token).
-		Scan(&user.ID, &user.Name, &user.Label)
+	err := db.QueryRowContext(ctx, `SELECT id, name, label, admin, supervisor FROM users WHERE token = ? LIMIT 1`, token).
+		Scan(&user.ID, &user.Name, &user.Label, &user.Admin, &user.Supervisor)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, ErrInvalidUser
@@ -104,10 +206,10 @@ type UserChatInfo struct {
 	ReadBefore int64  `json:"readBefore"`
 }
 
-func (db *Database) GetUserChatInfo(ctx context.Context, userID int64) ([]*UserChatInfo, error) {
+func (db *Database) GetUserChatInfo(ctx context.Context, instance string, userID int64) ([]*UserChatInfo, error) {
 	infos := make([]*UserChatInfo, 0, 128)
 
-	rows, err := db.QueryContext(ctx, `SELECT chat_id, read_before FROM user_chat_info WHERE user_id = ?`, userID)
+	rows, err := db.QueryContext(ctx, `SELECT chat_id, read_before FROM user_chat_info WHERE user_id = ? AND instance = ?`, userID, instance)
 	if err != nil {
 		return nil, err
 	}
@@ -129,11 +231,11 @@ func (db *Database) GetUserChatInfo(ctx context.Context, userID int64) ([]*UserC
 	return infos, nil
 }
 
-func (db *Database) SetUserChatAsRead(ctx context.Context, userID int64, chatID string, timestamp int64) error {
+func (db *Database) SetUserChatAsRead(ctx context.Context, instance string, userID int64, chatID string, timestamp int64) error {
 	db.Lock()
 	defer db.Unlock()
 
-	res, err := db.ExecContext(ctx, `UPDATE user_chat_info SET read_before = ? WHERE user_id = ? AND chat_id = ?`, timestamp, userID, chatID)
+	res, err := db.ExecContext(ctx, `UPDATE user_chat_info SET read_before = ? WHERE user_id = ? AND instance = ? AND chat_id = ?`, timestamp, userID, instance, chatID)
 	if err != nil {
 		return err
 	}
@@ -147,7 +249,7 @@ func (db *Database) SetUserChatAsRead(ctx context.Context, userID int64, chatID
 		return nil
 	}
 
-	_, err = db.ExecContext(ctx, `INSERT INTO user_chat_info (user_id, chat_id, read_before) VALUES (?, ?, ?)`, userID, chatID, timestamp)
+	_, err = db.ExecContext(ctx, `INSERT INTO user_chat_info (user_id, instance, chat_id, read_before) VALUES (?, ?, ?, ?)`, userID, instance, chatID, timestamp)
 	if err != nil {
 		return err
 	}
@@ -156,108 +258,346 @@ func (db *Database) SetUserChatAsRead(ctx context.Context, userID int64, chatID
 	return nil
 }
 
+// dbtx is implemented by *sql.DB and *sql.Tx.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 // AddMessage adds Message to the database.
 func (db *Database) AddMessage(ctx context.Context, cmd string, message *Message) error {
+	return db.AddMessages(ctx, cmd, []*Message{message}, nil)
+}
+
+// AddMessages adds Message's to the database in one transaction.
+// If update is not nil, it runs in the same transaction, after the messages are added,
+// so that sync progress is only saved together with the messages.
+func (db *Database) AddMessages(ctx context.Context, cmd string, messages []*Message, update func(tx dbtx) error) error {
 	db.Lock()
 	defer db.Unlock()
 
-	// Return if message is already in the database.
-	var id int64
-	err := db.QueryRowContext(ctx, `SELECT id FROM messages WHERE message_id = ? AND json = ?`, message.ID, message.JSON).Scan(&id)
-	if err == nil || err != sql.ErrNoRows {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	// INSERT or REPLACE new message (needs new id).
-	_, err = db.ExecContext(ctx,
-		cmd+` INTO messages (time, message_number, message_id, chat_id, json) VALUES (?, ?, ?, ?, ?)`,
-		message.Timestamp, message.Number, message.ID, message.ChatID, message.JSON)
+	changed := false
+	for _, message := range messages {
+		added, err := db.addMessage(ctx, tx, cmd, message)
+		if err != nil {
+			return err
+		}
+		changed = changed || added
+	}
+	if update != nil {
+		err = update(tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		return err
 	}
 
-	db.MessageW.Notify()
+	if changed {
+		db.MessageW.Notify()
+		db.notifyWebhooks()
+	}
 	return nil
 }
 
+// addMessage adds one Message, returning false if it was already in the database.
+func (db *Database) addMessage(ctx context.Context, tx dbtx, cmd string, message *Message) (bool, error) {
+	// Return if message is already in the database.
+	var id int64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM messages WHERE instance = ? AND message_id = ? AND json = ?`, message.Instance, message.ID, message.JSON).Scan(&id)
+	if err == nil {
+		return false, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, err
+	}
+
+	// Do not copy again messages deleted by retention rules.
+	pruned, err := db.isPrunedMessage(ctx, tx, message.Instance, message.ID)
+	if err != nil || pruned {
+		return false, err
+	}
+
+	// Check whether this is a new message or a change to an existing one.
+	ack := message.Ack
+	var dbAck, dbBody string
+	var mediaPruned bool
+	err = tx.QueryRowContext(ctx, `SELECT id, COALESCE(ack, ''), COALESCE(body, ''), media_pruned IS NOT NULL FROM messages WHERE instance = ? AND message_id = ?`, message.Instance, message.ID).
+		Scan(&id, &dbAck, &dbBody, &mediaPruned)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	exists := err == nil
+
+	// Do not restore media removed by retention rules.
+	if exists && mediaPruned && message.Type != MessageTypeRevoked {
+		return false, nil
+	}
+
+	// Chat-API replaces a deleted message with a revoked one; keep the original.
+	if exists && message.Type == MessageTypeRevoked {
+		return db.revokeMessage(ctx, tx, id, message.Instance, message.ChatID, message.ID, messageRevokedBy(message))
+	}
+
+	if !exists || cmd != "REPLACE" {
+		// INSERT new message; fails if it exists.
+		res, err := tx.ExecContext(ctx,
+			`INSERT INTO messages (instance, time, message_number, message_id, chat_id, json, from_me, author, type, body, ack, quoted_msg_id, sender_name)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			message.Instance, message.Timestamp, message.Number, message.ID, message.ChatID, message.JSON,
+			message.FromMe, message.Author, message.Type, message.Body, ack, message.QuotedMsgID, message.SenderName)
+		if err != nil {
+			return false, err
+		}
+		id, err = res.LastInsertId()
+		if err != nil {
+			return false, err
+		}
+		err = addMessageChange(ctx, tx, id, ChangeCreated, "", "")
+		if err != nil {
+			return false, err
+		}
+
+		// The original of a deleted message may never be seen.
+		if message.Type == MessageTypeRevoked {
+			_, err = db.revokeMessage(ctx, tx, id, message.Instance, message.ChatID, message.ID, messageRevokedBy(message))
+			if err != nil {
+				return false, err
+			}
+		}
+	} else {
+		// Do not go back to an older ack.
+		if ackToNum(dbAck) > ackToNum(ack) {
+			ack = dbAck
+		}
+
+		// UPDATE the message, keeping its row ID.
+		_, err = tx.ExecContext(ctx,
+			`UPDATE messages SET time = ?, message_number = ?, chat_id = ?, json = ?, from_me = ?, author = ?, type = ?, body = ?, ack = ?, quoted_msg_id = ?, sender_name = ?
+			WHERE id = ?`,
+			message.Timestamp, message.Number, message.ChatID, message.JSON,
+			message.FromMe, message.Author, message.Type, message.Body, ack, message.QuotedMsgID, message.SenderName, id)
+		if err != nil {
+			return false, err
+		}
+
+		// Record what changed.
+		var changes [][3]string
+		if message.Body != dbBody {
+			changes = append(changes, [3]string{ChangeEdited, dbBody, message.Body})
+		}
+		if ack != dbAck {
+			changes = append(changes, [3]string{ChangeAck, dbAck, ack})
+		}
+		if len(changes) == 0 {
+			changes = append(changes, [3]string{ChangeUpdated, "", ""})
+		}
+		for _, c := range changes {
+			err = addMessageChange(ctx, tx, id, c[0], c[1], c[2])
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	// Keep the chat's last message.
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO chat_last_messages (instance, chat_id, time, message_id) VALUES (?, ?, ?, ?)
+		ON CONFLICT (instance, chat_id) DO UPDATE SET time = excluded.time, message_id = excluded.message_id WHERE excluded.time >= time`,
+		message.Instance, message.ChatID, message.Timestamp, message.ID)
+	if err != nil {
+		return false, err
+	}
+
+	event := EventMessageCreated
+	if exists {
+		event = EventMessageUpdated
+	}
+	return true, db.addEvent(ctx, tx, event, message)
+}
+
 func (db *Database) AddChat(ctx context.Context, chat *Chat) error {
 	db.Lock()
 	defer db.Unlock()
 
-	// Return if chat is already in the database.
+	// Return if chat is already in the database, or was erased.
 	var id int64
-	err := db.QueryRowContext(ctx, `SELECT id FROM chats WHERE chat_id = ? AND json = ? LIMIT 1`, chat.ID, chat.JSON).Scan(&id)
+	err := db.QueryRowContext(ctx, `SELECT id FROM chats WHERE instance = ? AND chat_id = ? AND json = ? LIMIT 1`, chat.Instance, chat.ID, chat.JSON).Scan(&id)
 	if err == nil || err != sql.ErrNoRows {
 		return err
 	}
+	erased, err := db.isErasedChat(ctx, db, chat.ID)
+	if err != nil || erased {
+		return err
+	}
 
 	// INSERT or REPLACE new chat (needs new id).
 	_, err = db.ExecContext(ctx,
-		`REPLACE INTO chats (chat_id, json) VALUES (?, ?)`,
-		chat.ID, chat.JSON)
+		`REPLACE INTO chats (instance, chat_id, json) VALUES (?, ?, ?)`,
+		chat.Instance, chat.ID, chat.JSON)
+	if err != nil {
+		return err
+	}
+
+	err = db.addEvent(ctx, db, EventChatUpdated, chat)
 	if err != nil {
 		return err
 	}
 
 	db.ChatW.Notify()
+	db.notifyWebhooks()
 	return nil
 }
 
-// SetMessageAck sets the ack field of a Message.
-// The row ID must be incremented for the browser to detect the change.
-func (db *Database) SetMessageAck(ctx context.Context, chatID, messageID, ack string) error {
+// SetMessageAck sets the ack column of a Message and records the transition.
+func (db *Database) SetMessageAck(ctx context.Context, instance, chatID, messageID, ack string) error {
 	db.Lock()
 	defer db.Unlock()
 
-	// Read current row.
-	var time, messageNumber int64
-	var js string // JSON string
-	err := db.QueryRowContext(ctx, `SELECT time, message_number, json FROM messages WHERE chat_id = ? AND message_id = ? LIMIT 1`, chatID, messageID).
-		Scan(&time, &messageNumber, &js)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	// Decode JSON.
-	var raw map[string]interface{}
-	err = json.Unmarshal([]byte(js), &raw)
+	// Read current row.
+	var id int64
+	var dbAck string
+	err = tx.QueryRowContext(ctx, `SELECT id, COALESCE(ack, '') FROM messages WHERE instance = ? AND chat_id = ? AND message_id = ? LIMIT 1`, instance, chatID, messageID).
+		Scan(&id, &dbAck)
 	if err != nil {
 		return err
 	}
 
 	// Update ack if it's newer.
-	if dbValue, ok := raw["ack"]; ok {
-		if dbAck, ok := dbValue.(string); ok {
-			if ackToNum(dbAck) > ackToNum(ack) {
-				log.Printf("Ignoring ack update: %v > %v", dbAck, ack)
-				return nil
-			}
-		}
+	if dbAck == ack {
+		return nil
+	}
+	if ackToNum(dbAck) > ackToNum(ack) {
+		log.Printf("Ignoring ack update: %v > %v", dbAck, ack)
+		return nil
 	}
-	raw["ack"] = ack
 
-	// Encode message.
-	b, err := json.Marshal(raw)
+	_, err = tx.ExecContext(ctx, `UPDATE messages SET ack = ? WHERE id = ?`, ack, id)
+	if err != nil {
+		return err
+	}
+	err = addMessageChange(ctx, tx, id, ChangeAck, dbAck, ack)
+	if err != nil {
+		return err
+	}
+	err = db.addEvent(ctx, tx, EventMessageAck, map[string]interface{}{"instance": instance, "chatId": chatID, "id": messageID, "ack": ack})
 	if err != nil {
 		return err
 	}
-	js = string(b)
 
-	// REPLACE row.
-	_, err = db.ExecContext(ctx, `REPLACE INTO messages (time, message_number, message_id, chat_id, json) VALUES (?, ?, ?, ?, ?)`, time, messageNumber, messageID, chatID, js)
+	err = tx.Commit()
 	if err != nil {
 		return err
 	}
 
 	db.MessageW.Notify()
+	db.notifyWebhooks()
 	return nil
 }
 
-// GetLastMessageNumber returns the largest message number in the database.
-func (db *Database) GetLastMessageNumber(ctx context.Context) (int64, error) {
+// Who deleted a message, stored in the revoked_by column.
+// Messages deleted through this program have "user:" and the user name.
+const (
+	RevokedByContact = "contact"
+	// Deleted on the phone of the instance, or by another program.
+	RevokedByPhone = "phone"
+)
+
+func messageRevokedBy(message *Message) string {
+	if message.FromMe {
+		return RevokedByPhone
+	}
+	return RevokedByContact
+}
+
+// RevokeMessage marks a message as deleted for everyone, keeping its content.
+// It returns sql.ErrNoRows if the message is unknown.
+func (db *Database) RevokeMessage(ctx context.Context, instance, messageID, by string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Read current row.
+	var id int64
+	var chatID string
+	err = tx.QueryRowContext(ctx, `SELECT id, chat_id FROM messages WHERE instance = ? AND message_id = ?`, instance, messageID).Scan(&id, &chatID)
+	if err != nil {
+		return err
+	}
+
+	changed, err := db.revokeMessage(ctx, tx, id, instance, chatID, messageID, by)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		db.MessageW.Notify()
+		db.notifyWebhooks()
+	}
+	return nil
+}
+
+// revokeMessage marks the message in row id as deleted, returning false if it already was.
+func (db *Database) revokeMessage(ctx context.Context, tx dbtx, id int64, instance, chatID, messageID, by string) (bool, error) {
+	res, err := tx.ExecContext(ctx, `UPDATE messages SET revoked = ?, revoked_by = ? WHERE id = ? AND revoked IS NULL`, time.Now().Unix(), by, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	err = addMessageChange(ctx, tx, id, ChangeRevoked, "", by)
+	if err != nil {
+		return false, err
+	}
+	err = db.addEvent(ctx, tx, EventMessageRevoked, map[string]interface{}{"instance": instance, "chatId": chatID, "id": messageID, "by": by})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// HasInstanceData returns true if messages or chats of instance are stored.
+func (db *Database) HasInstanceData(ctx context.Context, instance string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM messages WHERE instance = ?) OR EXISTS (SELECT 1 FROM chats WHERE instance = ?)`,
+		instance, instance).Scan(&n)
+	return n > 0, err
+}
+
+// GetLastMessageNumber returns the largest message number of instance in the database.
+func (db *Database) GetLastMessageNumber(ctx context.Context, instance string) (int64, error) {
 	var number int64
 
-	err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(message_number), 0) FROM messages`).
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(message_number), 0) FROM messages WHERE instance = ?`, instance).
 		Scan(&number)
 	if err != nil {
 		return 0, err
@@ -267,29 +607,49 @@ func (db *Database) GetLastMessageNumber(ctx context.Context) (int64, error) {
 }
 
 type MessageRow struct {
-	ID   int64
-	JSON []byte
+	ID       int64
+	JSON     []byte
+	Instance string
+	Ack      string
+	// Only set by GetChatMessages.
+	Time int64
+	// Only set by GetMessagesAfterSeq.
+	Seq int64
+	// Unix time the message was deleted for everyone, or 0, and who deleted it.
+	Revoked   int64
+	RevokedBy string
 }
 
-// GetRecentMessages returns the last 1000 messages ordered by time.
-func (db *Database) GetRecentMessages(ctx context.Context) ([]MessageRow, error) {
+type RecentMessagesOptions struct {
+	// Most recently active chats included.
+	Chats int
+	// Last messages of each chat.
+	PerChat int
+	// Only chats with a message at or after this unix time.
+	Since int64
+}
+
+// GetRecentMessages returns the last messages of the most recently active chats, ordered by time.
+// If instance is not empty, only chats of that instance are included.
+func (db *Database) GetRecentMessages(ctx context.Context, instance string, options RecentMessagesOptions) ([]MessageRow, error) {
 	var messages []MessageRow
 
-	sql_chats := `SELECT *, row_number() OVER (PARTITION BY chat_id ORDER BY time DESC) AS row FROM messages`
-	rows, err := db.QueryContext(ctx, `SELECT id, json FROM (`+sql_chats+`) AS messages WHERE row <= 20 ORDER BY time DESC`)
+	sql_chats := `SELECT instance, chat_id FROM chat_last_messages WHERE ? IN ('', instance) AND time >= ? ORDER BY time DESC LIMIT ?`
+	sql_messages := `SELECT id FROM messages WHERE instance = chats.instance AND chat_id = chats.chat_id ORDER BY time DESC, id DESC LIMIT ?`
+	rows, err := db.QueryContext(ctx, `SELECT m.id, m.json, m.instance, COALESCE(m.ack, ''), COALESCE(m.revoked, 0), COALESCE(m.revoked_by, '') FROM (`+sql_chats+`) AS chats JOIN messages AS m ON m.id IN (`+sql_messages+`) ORDER BY m.time DESC`,
+		instance, options.Since, options.Chats, options.PerChat)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var id int64
-		var json []byte
-		err = rows.Scan(&id, &json)
+		var row MessageRow
+		err = rows.Scan(&row.ID, &row.JSON, &row.Instance, &row.Ack, &row.Revoked, &row.RevokedBy)
 		if err != nil {
 			return nil, err
 		}
-		messages = append(messages, MessageRow{id, json})
+		messages = append(messages, row)
 	}
 	err = rows.Err()
 	if err != nil {
@@ -299,24 +659,23 @@ func (db *Database) GetRecentMessages(ctx context.Context) ([]MessageRow, error)
 	return messages, nil
 }
 
-// GetMessagesAfterID returns messages after id.
-func (db *Database) GetMessagesAfterID(ctx context.Context, id int64) ([]MessageRow, error) {
+// GetMessagesAfterID returns messages after id, of instance if it is not empty.
+func (db *Database) GetMessagesAfterID(ctx context.Context, instance string, id int64) ([]MessageRow, error) {
 	var messages []MessageRow
 
-	rows, err := db.QueryContext(ctx, `SELECT id, json FROM messages WHERE id > ? ORDER BY id`, id)
+	rows, err := db.QueryContext(ctx, `SELECT id, json, instance, COALESCE(ack, ''), COALESCE(revoked, 0), COALESCE(revoked_by, '') FROM messages WHERE id > ? AND ? IN ('', instance) ORDER BY id`, id, instance)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var id int64
-		var json []byte
-		err = rows.Scan(&id, &json)
+		var row MessageRow
+		err = rows.Scan(&row.ID, &row.JSON, &row.Instance, &row.Ack, &row.Revoked, &row.RevokedBy)
 		if err != nil {
 			return nil, err
 		}
-		messages = append(messages, MessageRow{id, json})
+		messages = append(messages, row)
 	}
 	err = rows.Err()
 	if err != nil {
@@ -326,55 +685,121 @@ func (db *Database) GetMessagesAfterID(ctx context.Context, id int64) ([]Message
 	return messages, nil
 }
 
-// GetChatMessages returns messages in chatID.
-func (db *Database) GetChatMessages(ctx context.Context, chatID string) ([]MessageRow, error) {
-	var messages []MessageRow
+// MessageCursor is a position in the messages of a chat, ordered by time and row ID.
+type MessageCursor struct {
+	Time int64
+	ID   int64
+}
+
+func (c MessageCursor) String() string {
+	return fmt.Sprintf("%d_%d", c.Time, c.ID)
+}
+
+// ParseMessageCursor parses a cursor created by MessageCursor.String.
+func ParseMessageCursor(s string) (MessageCursor, error) {
+	var c MessageCursor
+	parts := strings.Split(s, "_")
+	if len(parts) != 2 {
+		return c, fmt.Errorf("invalid cursor %q", s)
+	}
+	var err1, err2 error
+	c.Time, err1 = strconv.ParseInt(parts[0], 10, 64)
+	c.ID, err2 = strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return c, fmt.Errorf("invalid cursor %q", s)
+	}
+	return c, nil
+}
+
+type GetChatMessagesOptions struct {
+	// Only messages before this position; the newest messages if nil.
+	Before *MessageCursor
+	// Only messages after this position, if not nil.
+	After *MessageCursor
+	Limit int
+}
 
-	rows, err := db.QueryContext(ctx, `SELECT id, json FROM messages WHERE chat_id = ?`, chatID)
+// GetChatMessages returns a page of messages in chatID of instance, ordered by time and row ID.
+// The page is next to Before or After, or has the newest messages if both are nil.
+// hasMore tells whether more messages exist past the page, in the direction of the request.
+func (db *Database) GetChatMessages(ctx context.Context, instance, chatID string, options GetChatMessagesOptions) (messages []MessageRow, hasMore bool, err error) {
+	// Prepare query.
+	query := `SELECT id, json, instance, COALESCE(ack, ''), COALESCE(revoked, 0), COALESCE(revoked_by, ''), time FROM messages WHERE instance = ? AND chat_id = ?`
+	args := []interface{}{instance, chatID}
+	if options.After != nil {
+		query += ` AND (time > ? OR (time = ? AND id > ?))`
+		args = append(args, options.After.Time, options.After.Time, options.After.ID)
+	}
+	if options.Before != nil {
+		query += ` AND (time < ? OR (time = ? AND id < ?))`
+		args = append(args, options.Before.Time, options.Before.Time, options.Before.ID)
+	}
+	if options.After != nil && options.Before == nil {
+		query += ` ORDER BY time, id`
+	} else {
+		query += ` ORDER BY time DESC, id DESC`
+	}
+	// One more message tells whether there are more.
+	query += ` LIMIT ?`
+	args = append(args, options.Limit+1)
+
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var id int64
-		var json []byte
-		err = rows.Scan(&id, &json)
+		var row MessageRow
+		err = rows.Scan(&row.ID, &row.JSON, &row.Instance, &row.Ack, &row.Revoked, &row.RevokedBy, &row.Time)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		messages = append(messages, MessageRow{id, json})
+		messages = append(messages, row)
 	}
 	err = rows.Err()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	return messages, nil
+	if len(messages) > options.Limit {
+		hasMore = true
+		messages = messages[:options.Limit]
+	}
+
+	// Oldest first.
+	if !(options.After != nil && options.Before == nil) {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	return messages, hasMore, nil
 }
 
 type ChatRow struct {
-	ID   int64
-	JSON []byte
+	ID       int64
+	JSON     []byte
+	Instance string
 }
 
-func (db *Database) GetChatsAfterID(ctx context.Context, id int64) ([]ChatRow, error) {
+// GetChatsAfterID returns chats after id, of instance if it is not empty.
+func (db *Database) GetChatsAfterID(ctx context.Context, instance string, id int64) ([]ChatRow, error) {
 	var chats []ChatRow
 
-	rows, err := db.QueryContext(ctx, `SELECT id, json FROM chats WHERE id > ? ORDER BY id`, id)
+	rows, err := db.QueryContext(ctx, `SELECT id, json, instance FROM chats WHERE id > ? AND ? IN ('', instance) ORDER BY id`, id, instance)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var id int64
-		var json []byte
-		err = rows.Scan(&id, &json)
+		var row ChatRow
+		err = rows.Scan(&row.ID, &row.JSON, &row.Instance)
 		if err != nil {
 			return nil, err
 		}
-		chats = append(chats, ChatRow{id, json})
+		chats = append(chats, row)
 	}
 	err = rows.Err()
 	if err != nil {
@@ -0,0 +1,177 @@
+// Finds and repairs holes in the message_number sequence.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// GapRepair periodically looks for missing message numbers and requests them from Chat-API.
+// Gaps that are still missing after MaxAttempts are recorded as unrecoverable.
+type GapRepair struct {
+	*ChatAPIDB
+	// Time between scans.
+	Interval time.Duration
+	// Messages requested per Chat-API request.
+	PageSize int
+	// A gap is unrecoverable after this many failed repairs.
+	MaxAttempts int
+	// Force a scan now.
+	ScanC chan struct{}
+}
+
+func NewGapRepair(wadb *ChatAPIDB) *GapRepair {
+	return &GapRepair{
+		ChatAPIDB:   wadb,
+		Interval:    time.Hour,
+		PageSize:    100,
+		MaxAttempts: 3,
+		ScanC:       make(chan struct{}, 1),
+	}
+}
+
+// Loop runs Run every Interval.
+func (gr *GapRepair) Loop(ctx context.Context) {
+	ticker := time.NewTicker(gr.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-gr.ScanC:
+		}
+
+		err := gr.Run(ctx)
+		if err != nil {
+			log.Printf("GapRepair.Run: %v", err)
+		}
+	}
+}
+
+// ScanNow forces a scan as soon as possible.
+func (gr *GapRepair) ScanNow() {
+	select {
+	case gr.ScanC <- struct{}{}:
+	default:
+	}
+}
+
+// Run finds gaps and tries to repair each one once.
+func (gr *GapRepair) Run(ctx context.Context) error {
+	gaps, err := gr.DB.FindMessageGaps(ctx, gr.Instance)
+	if err != nil {
+		return err
+	}
+
+	for _, gap := range gaps {
+		err = gr.DB.AddMessageGap(ctx, gap)
+		if err != nil {
+			return err
+		}
+		if gap.Status == "unrecoverable" {
+			continue
+		}
+
+		log.Printf("GapRepair: requesting messages %d to %d", gap.Start, gap.End)
+		err = gr.copyRange(ctx, gap.Start, gap.End)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("GapRepair.copyRange(%d, %d): %v", gap.Start, gap.End, err)
+		}
+
+		// Check what is still missing.
+		missing, err := gr.DB.CountMissingMessages(ctx, gr.Instance, gap.Start, gap.End)
+		if err != nil {
+			return err
+		}
+		gap.Attempts++
+		switch {
+		case missing == 0:
+			gap.Status = "repaired"
+		case gap.Attempts >= gr.MaxAttempts:
+			log.Printf("GapRepair: %d messages between %d and %d are unrecoverable", missing, gap.Start, gap.End)
+			gap.Status = "unrecoverable"
+		}
+		err = gr.DB.UpdateMessageGap(ctx, gap)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyRange copies messages numbered start to end from Chat-API.
+func (gr *GapRepair) copyRange(ctx context.Context, start, end int64) error {
+	cursor := start - 1
+
+	for cursor < end {
+		limit := int64(gr.PageSize)
+		if end-cursor < limit {
+			limit = end - cursor
+		}
+		messages, _, err := gr.Provider.GetMessages(ctx, GetMessagesOptions{LastMessageNumber: cursor, Limit: int(limit)})
+		if err != nil {
+			return err
+		}
+
+		// Store messages and move the cursor.
+		next := cursor
+		for _, message := range messages {
+			err = gr.DB.AddMessage(ctx, "REPLACE", message)
+			if err != nil {
+				return err
+			}
+			if message.Number > next {
+				next = message.Number
+			}
+		}
+		if next <= cursor {
+			// Chat-API has nothing more.
+			return nil
+		}
+		cursor = next
+	}
+
+	return nil
+}
+
+// HTTPGaps sends gaps so that users know the history is incomplete.
+//
+// Query parameters:
+// instance: only gaps of this Chat-API instance.
+// status: unrecoverable (default), open or repaired.
+func (gr *GapRepair) HTTPGaps(w http.ResponseWriter, r *http.Request) {
+	uq := r.URL.Query()
+	status := uq.Get("status")
+	if status == "" {
+		status = "unrecoverable"
+	}
+
+	gaps, err := gr.DB.GetMessageGaps(r.Context(), uq.Get("instance"), status)
+	if err != nil {
+		log.Printf("Database.GetMessageGaps: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"gaps": gaps})
+}
+
+// HTTPScan starts a scan now.
+func (gr *GapRepair) HTTPScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gr.ScanNow()
+}
@@ -0,0 +1,251 @@
+// Exports and erases the data of a WhatsApp ID on request of the person.
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Largest media file copied into an export.
+const gdprMaxMediaSize = 64 << 20
+
+// GDPR exports and erases everything stored about a WhatsApp ID, across instances.
+type GDPR struct {
+	DB     *Database
+	Client *http.Client
+}
+
+func NewGDPR(db *Database) *GDPR {
+	return &GDPR{DB: db, Client: &http.Client{Timeout: 60 * time.Second}}
+}
+
+// Export writes a zip file with the data of subject to w and records it in the audit.
+// With media, the media files of the messages are downloaded into media/;
+// files that cannot be downloaded are listed in media/errors.txt.
+func (g *GDPR) Export(ctx context.Context, subject string, media bool, performedBy string, w io.Writer) (*GDPRReport, error) {
+	data, err := g.DB.GetSubjectData(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	report := &GDPRReport{Action: GDPRExport, Messages: int64(len(data.Messages)), Chats: int64(len(data.Chats))}
+	for _, m := range data.Messages {
+		report.Changes += int64(len(m.Changes))
+	}
+	if data.Contact != nil {
+		report.Contacts = 1
+	}
+
+	// Data as JSON files.
+	z := zip.NewWriter(w)
+	files := []struct {
+		name string
+		v    interface{}
+	}{
+		{"subject.json", map[string]interface{}{"subject": subject, "exported": time.Now().Unix()}},
+		{"messages.json", data.Messages},
+		{"chats.json", data.Chats},
+		{"contact.json", data.Contact},
+	}
+	for _, file := range files {
+		f, err := z.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(file.v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Media files.
+	if media {
+		var failures []string
+		for _, m := range data.Messages {
+			message := m.Message
+			if !containsString(MediaMessageTypes, message.Type) || !strings.HasPrefix(message.Body, "http") {
+				continue
+			}
+			name := "media/" + sanitizeFileName(message.ID) + path.Ext(mediaURLPath(message.Body))
+			err = g.copyMedia(ctx, z, name, message.Body)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", message.ID, err))
+				continue
+			}
+			report.Media++
+		}
+		report.MediaErrors = len(failures)
+		if len(failures) > 0 {
+			f, err := z.Create("media/errors.txt")
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.WriteString(f, strings.Join(failures, "\n")+"\n")
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = z.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return report, g.DB.AddGDPRAudit(ctx, subject, performedBy, report)
+}
+
+// copyMedia downloads rawURL into the file name of z.
+func (g *GDPR) copyMedia(ctx context.Context, z *zip.Writer, name, rawURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := g.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %s", res.Status)
+	}
+	if res.ContentLength > gdprMaxMediaSize {
+		return fmt.Errorf("larger than %d bytes", gdprMaxMediaSize)
+	}
+
+	f, err := z.Create(name)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(res.Body, gdprMaxMediaSize+1))
+	if err == nil && n > gdprMaxMediaSize {
+		err = fmt.Errorf("truncated at %d bytes", gdprMaxMediaSize)
+	}
+	return err
+}
+
+// Erase deletes or pseudonymises the data of subject and records it in the audit.
+func (g *GDPR) Erase(ctx context.Context, subject string, pseudonymise bool, performedBy string) (*GDPRReport, error) {
+	report, err := g.DB.EraseSubject(ctx, subject, pseudonymise)
+	if err != nil {
+		return nil, err
+	}
+	return report, g.DB.AddGDPRAudit(ctx, subject, performedBy, report)
+}
+
+func mediaURLPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+// sanitizeFileName replaces the characters of s that are not safe in a file name.
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// gdprSubject returns the chat ID in the subject query parameter, which can also be a phone number.
+func gdprSubject(r *http.Request) (string, bool) {
+	subject, err := PhoneToChatID(r.URL.Query().Get("subject"))
+	return subject, err == nil
+}
+
+func gdprPerformedBy(ctx context.Context) string {
+	if user, ok := ContextUser(ctx); ok {
+		return user.Name
+	}
+	return ""
+}
+
+// HTTPExport sends the data of a WhatsApp ID as a zip file.
+func (g *GDPR) HTTPExport(w http.ResponseWriter, r *http.Request) {
+	subject, ok := gdprSubject(r)
+	if !ok {
+		http.Error(w, "Invalid subject", http.StatusBadRequest)
+		return
+	}
+	media := r.URL.Query().Get("media") == "1"
+
+	// The response is streamed; errors after this can only be logged.
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, sanitizeFileName(subject)))
+	_, err := g.Export(r.Context(), subject, media, gdprPerformedBy(r.Context()), w)
+	if err != nil {
+		log.Printf("GDPR.Export: %v", err)
+	}
+}
+
+// HTTPErase deletes the data of a WhatsApp ID, or pseudonymises it with mode=pseudonymise.
+func (g *GDPR) HTTPErase(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	subject, ok := gdprSubject(r)
+	if !ok {
+		http.Error(w, "Invalid subject", http.StatusBadRequest)
+		return
+	}
+	var pseudonymise bool
+	switch r.URL.Query().Get("mode") {
+	case "", GDPRErase:
+	case GDPRPseudonymise:
+		pseudonymise = true
+	default:
+		http.Error(w, "Invalid mode", http.StatusBadRequest)
+		return
+	}
+
+	report, err := g.Erase(r.Context(), subject, pseudonymise, gdprPerformedBy(r.Context()))
+	if err == ErrSubjectOnLegalHold {
+		http.Error(w, "Chat is under legal hold", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("GDPR.Erase: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// HTTPAudit sends the audit entries, of the subject query parameter if it is set.
+func (g *GDPR) HTTPAudit(w http.ResponseWriter, r *http.Request) {
+	subject := ""
+	if r.URL.Query().Get("subject") != "" {
+		var ok bool
+		subject, ok = gdprSubject(r)
+		if !ok {
+			http.Error(w, "Invalid subject", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := g.DB.GetGDPRAudit(r.Context(), subject)
+	if err != nil {
+		log.Printf("Database.GetGDPRAudit: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"entries": entries})
+}
@@ -0,0 +1,178 @@
+// Runs several Chat-API instances against one database.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+)
+
+// Instance is one messaging account with the goroutines that copy it to the database.
+type Instance struct {
+	*ChatAPIHTTP
+	Config    *ConfigChatAPI
+	Status    *StatusMonitor
+	Inbox     *WebhookInbox
+	Backfill  *Backfill
+	GapRepair *GapRepair
+	// Only set for Chat-API instances.
+	Proxy *ChatAPIProxy
+}
+
+func NewInstance(ctx context.Context, cf *ConfigChatAPI, db *Database) (*Instance, error) {
+	provider, err := NewProvider(cf)
+	if err != nil {
+		return nil, err
+	}
+	wadb := NewChatAPIDB(provider, db)
+	wadb.PageSize = cf.PageSize
+
+	inst := &Instance{
+		ChatAPIHTTP: NewChatAPIHTTP(wadb),
+		Config:      cf,
+		Status:      NewStatusMonitor(wadb),
+		Inbox:       NewWebhookInbox(wadb),
+		Backfill:    NewBackfill(ctx, wadb),
+		GapRepair:   NewGapRepair(wadb),
+	}
+
+	// Let the browser call Chat-API directly.
+	if chatAPI, ok := provider.(*ChatAPI); ok {
+		inst.Proxy = &ChatAPIProxy{
+			URL:   chatAPI.URL,
+			Proxy: httputil.NewSingleHostReverseProxy(chatAPI.URL),
+			Token: cf.Token,
+		}
+	}
+
+	// Record Chat-API traffic.
+	if cf.Record != "" {
+		rec, err := OpenRecorder(cf.Record)
+		if err != nil {
+			return nil, err
+		}
+		inst.Recorder = rec
+		if chatAPI, ok := provider.(*ChatAPI); ok {
+			chatAPI.Client.Transport = &RecordingTransport{Instance: cf.Name, Recorder: rec, Transport: chatAPI.Client.Transport}
+		}
+	}
+
+	return inst, nil
+}
+
+// CheckDefaultInstance returns an error if the database has data of the default instance,
+// stored before instances had names, but no instance of cf has that name:
+// the data would no longer be shown or synced.
+func CheckDefaultInstance(ctx context.Context, cf *Config, db *Database) error {
+	for _, icf := range cf.Instances {
+		if icf.Name == DefaultInstance {
+			return nil
+		}
+	}
+	found, err := db.HasInstanceData(ctx, DefaultInstance)
+	if err != nil || !found {
+		return err
+	}
+	return fmt.Errorf("the database has chats and messages of instance %q, but no instance has that name; name the instance of that account %q", DefaultInstance, DefaultInstance)
+}
+
+// Start copies the instance to the database and starts its background goroutines.
+func (inst *Instance) Start(ctx context.Context) error {
+	// Watch the account status.
+	status := inst.Status.Check(ctx)
+	if status.State != "authenticated" {
+		// Serve the stored messages; sync starts when Chat-API is ready.
+		log.Printf("Instance %v: starting in degraded mode: %v %v", inst.Instance, status.State, status.Error)
+	}
+	go inst.Status.Loop(ctx)
+
+	// Connect Chat-API to local database.
+	err := inst.ChatAPIDB.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Apply stored webhook requests.
+	go inst.Inbox.Loop(ctx)
+
+	// Repair holes in the message history.
+	go inst.GapRepair.Loop(ctx)
+
+	return nil
+}
+
+type Instances []*Instance
+
+// Get returns the instance named name, the first instance if name is empty, or nil.
+func (insts Instances) Get(name string) *Instance {
+	if name == "" {
+		return insts[0]
+	}
+	for _, inst := range insts {
+		if inst.Instance == name {
+			return inst
+		}
+	}
+	return nil
+}
+
+// Route returns a handler that sends requests to the instance in the instance query parameter,
+// or to the first instance if it is missing.
+func (insts Instances) Route(handler func(inst *Instance) http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inst := insts.Get(r.URL.Query().Get("instance"))
+		if inst == nil {
+			http.Error(w, "Unknown instance", http.StatusNotFound)
+			return
+		}
+		handler(inst)(w, r)
+	}
+}
+
+// ServeProxy sends requests to the Chat-API proxy of the instance.
+// Deletions are handled here, so that the database knows about them.
+func (inst *Instance) ServeProxy(w http.ResponseWriter, r *http.Request) {
+	if inst.Proxy == nil {
+		http.Error(w, "Instance does not use Chat-API", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPost && r.URL.Path == "/deleteMessage" {
+		inst.DeleteMessage(w, r)
+		return
+	}
+	inst.Proxy.ServeHTTP(w, r)
+}
+
+// KeepActive calls Active on every instance before handler,
+// so that all instances keep copying new messages while users are online.
+func (insts Instances) KeepActive(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, inst := range insts {
+			inst.Active()
+		}
+		handler(w, r)
+	}
+}
+
+// HTTPInstances sends the name and account status of every instance.
+func (insts Instances) HTTPInstances(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]AccountStatus, 0, len(insts))
+	for _, inst := range insts {
+		statuses = append(statuses, inst.Status.Status())
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"instances": statuses})
+}
+
+// instanceKey returns key for the default instance and key.<instance> for the others,
+// so that databases created before instances existed keep their settings and sync state.
+func instanceKey(key, instance string) string {
+	if instance == DefaultInstance {
+		return key
+	}
+	return key + "." + instance
+}
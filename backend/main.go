@@ -8,6 +8,10 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
@@ -34,6 +38,15 @@ func main() {
 
 	// Database.
 	db := NewDatabase(cf.Database.Driver, cf.Database.DSN)
+	db.Webhooks = cf.Webhooks
+	// Commands that replace the database run before it is opened.
+	if flag.NArg() > 0 && IsBeforeOpenCommand(flag.Arg(0)) {
+		err = RunCommand(ctx, cf, db, flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	err = db.Open()
 	if err != nil {
 		log.Fatalf("Cannot open database: %v", err)
@@ -42,81 +55,137 @@ func main() {
 	if err != nil {
 		log.Fatalf("Cannot create database: %v", err)
 	}
+	err = db.SetHashKey(ctx, cf.GDPR.HashKey)
+	if err != nil {
+		log.Fatalf("Cannot set hash key: %v", err)
+	}
+
+	// Run command instead of the server.
+	if flag.NArg() > 0 {
+		err = RunCommand(ctx, cf, db, flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	// Authentication.
 	auth := &Auth{
 		Database: db,
 	}
 
-	// Chat-API.
-	u, err := url.Parse(cf.ChatAPI.URL)
+	// Chat-API instances.
+	err = CheckDefaultInstance(ctx, cf, db)
 	if err != nil {
 		log.Fatal(err)
 	}
-	chatAPI := &ChatAPI{
-		URL:   u,
-		Token: cf.ChatAPI.Token,
+	var instances Instances
+	for i := range cf.Instances {
+		inst, err := NewInstance(ctx, &cf.Instances[i], db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = inst.Start(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		instances = append(instances, inst)
 	}
-	err = chatAPI.GetStatus(ctx)
-	if err != nil {
-		log.Fatal(err)
+	first := instances[0]
+
+	contactHTTP := NewContactHTTP(db)
+
+	// Outbound webhooks.
+	webhookSender := NewWebhookSender(db)
+	go webhookSender.Loop(ctx)
+
+	// Retention rules.
+	pruner := NewPruner(db, &cf.Retention)
+	if len(cf.Retention.Rules) > 0 {
+		go pruner.Loop(ctx)
 	}
 
-	// Connect Chat-API to local database.
-	wadb := NewChatAPIDB(chatAPI, db)
-	err = wadb.Start(ctx)
-	if err != nil {
-		log.Fatal(err)
+	// Scheduled backups.
+	backuper := NewBackuper(db, &cf.Backup)
+	if cf.Backup.Dir != "" {
+		go backuper.Loop(ctx)
 	}
 
-	wadbHTTP := NewChatAPIHTTP(wadb)
+	// Data requests of customers.
+	gdpr := NewGDPR(db)
 
 	// HTTP muxes.
 	mux := http.NewServeMux()
 	apiMux := http.NewServeMux()
+	adminMux := http.NewServeMux()
 
 	// HTTP routes.
+	// Routes that act on one Chat-API instance take it from the instance query parameter.
 	mux.HandleFunc("/api/login", auth.HTTPLogin)
 	mux.Handle("/api/", auth.Protect(http.StripPrefix("/api", apiMux)))
 	apiMux.HandleFunc("/logout", auth.HTTPLogout)
-	apiMux.HandleFunc("/messages/all", wadbHTTP.Messages)
-	apiMux.HandleFunc("/messages/chat_id", wadbHTTP.MessagesByChatID)
-	apiMux.HandleFunc("/chats/all", wadbHTTP.Chats)
-	apiMux.HandleFunc("/chat/info", wadbHTTP.GetUserChatInfo)
-	apiMux.HandleFunc("/chat/info/read", wadbHTTP.SetUserChatAsRead)
-
-	// Webhook.
-	if cf.ChatAPI.Webhook != "" {
-		// Create random URL.
-		u, err = url.Parse(cf.ChatAPI.Webhook)
-		if err != nil {
-			log.Fatal(err)
+	apiMux.HandleFunc("/instances", instances.HTTPInstances)
+	apiMux.HandleFunc("/status", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.Status.HTTPStatus }))
+	apiMux.HandleFunc("/messages/all", instances.KeepActive(first.Messages))
+	apiMux.HandleFunc("/messages/chat_id", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.MessagesByChatID }))
+	apiMux.HandleFunc("/messages/history", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.MessageHistory }))
+	apiMux.HandleFunc("/messages/gaps", first.GapRepair.HTTPGaps)
+	apiMux.HandleFunc("/chats/all", first.Chats)
+	apiMux.HandleFunc("/chats/summary", first.ChatSummaries)
+	apiMux.HandleFunc("/chat/info", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.GetUserChatInfo }))
+	apiMux.HandleFunc("/chat/info/read", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.SetUserChatAsRead }))
+	apiMux.HandleFunc("/chat/assign", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.SetChatAssignee }))
+	apiMux.HandleFunc("/chat/labels", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.SetChatLabels }))
+	apiMux.HandleFunc("/contacts/all", contactHTTP.Contacts)
+	apiMux.HandleFunc("/contacts/import", contactHTTP.Import)
+	apiMux.HandleFunc("/contacts/export", contactHTTP.Export)
+	apiMux.Handle("/admin/", auth.Admin(http.StripPrefix("/admin", adminMux)))
+	adminMux.HandleFunc("/webhooks/deliveries", webhookSender.HTTPDeliveries)
+	adminMux.HandleFunc("/webhooks/retry", webhookSender.HTTPRetry)
+	adminMux.HandleFunc("/webhook-inbox", first.Inbox.HTTPEntries)
+	adminMux.HandleFunc("/webhook-inbox/replay", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.Inbox.HTTPReplay }))
+	adminMux.HandleFunc("/sync", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.SyncState }))
+	adminMux.HandleFunc("/backfill", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.Backfill.HTTPStatus }))
+	adminMux.HandleFunc("/backfill/start", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.Backfill.HTTPStart }))
+	adminMux.HandleFunc("/backfill/stop", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.Backfill.HTTPStop }))
+	adminMux.HandleFunc("/gaps/scan", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.GapRepair.HTTPScan }))
+	adminMux.HandleFunc("/status/qr", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.Status.HTTPQRCode }))
+	adminMux.HandleFunc("/retention/report", pruner.HTTPReport)
+	adminMux.HandleFunc("/retention/run", pruner.HTTPRun)
+	adminMux.HandleFunc("/legal-holds", pruner.HTTPLegalHolds)
+	adminMux.HandleFunc("/legal-holds/add", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.AddLegalHold }))
+	adminMux.HandleFunc("/legal-holds/remove", instances.Route(func(inst *Instance) http.HandlerFunc { return inst.RemoveLegalHold }))
+	adminMux.HandleFunc("/gdpr/export", gdpr.HTTPExport)
+	adminMux.HandleFunc("/gdpr/erase", gdpr.HTTPErase)
+	adminMux.HandleFunc("/gdpr/audit", gdpr.HTTPAudit)
+	adminMux.HandleFunc("/backups", backuper.HTTPFiles)
+	adminMux.HandleFunc("/backups/run", backuper.HTTPRun)
+	adminMux.HandleFunc("/integrity-check", backuper.HTTPIntegrityCheck)
+
+	// Webhooks.
+	// The current path of an instance takes precedence over the previous path of another.
+	webhookPaths := map[string]bool{}
+	for _, inst := range instances {
+		if u, err := url.Parse(inst.Config.Webhook); err == nil && inst.Config.Webhook != "" {
+			webhookPaths[u.Path] = true
 		}
-		u.Path += "/" + generateToken()
-		// Handle HTTP requests.
-		mux.HandleFunc(u.Path, wadbHTTP.Webhook)
-		// Inform Chat-API our webhook URL.
-		err = chatAPI.SetWebhook(ctx, u.String())
-		if err != nil {
-			log.Fatal(err)
+	}
+	for _, inst := range instances {
+		if inst.Config.Webhook != "" {
+			err = inst.RegisterWebhook(ctx, mux, inst.Config, webhookPaths)
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
 	}
 
 	// Proxy to the Chat-API service.
-	u, err = url.Parse(cf.ChatAPI.URL)
-	if err != nil {
-		log.Fatal(err)
-	}
-	chatAPIProxy := &ChatAPIProxy{
-		URL:   u,
-		Proxy: httputil.NewSingleHostReverseProxy(u),
-		Token: cf.ChatAPI.Token,
-	}
+	chatAPIProxy := instances.Route(func(inst *Instance) http.HandlerFunc { return inst.ServeProxy })
 	mux.Handle("/chat-api/", auth.Protect(http.StripPrefix("/chat-api", chatAPIProxy)))
 
 	// Proxy to the SvelteKit dev server.
 	if cf.Proxy != "" {
-		u, err = url.Parse(cf.Proxy)
+		u, err := url.Parse(cf.Proxy)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -131,5 +200,26 @@ func main() {
 		mux.Handle("/", http.FileServer(http.FS(staticFS)))
 	}
 
-	http.ListenAndServe(":8080", mux)
+	// Stop on Ctrl+C or SIGTERM.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := &http.Server{Addr: ":8080", Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	// Let a restarted process copy messages at once.
+	for _, inst := range instances {
+		err = inst.ReleaseSyncLease(context.Background())
+		if err != nil {
+			log.Printf("ReleaseSyncLease: %v", err)
+		}
+	}
 }
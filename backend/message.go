@@ -12,8 +12,28 @@ type Message struct {
 	Timestamp int64  `json:"time"`
 	Number    int64  `json:"messageNumber"`
 	JSON      BJSON  `json:"-"`
+	// Chat-API instance that received the message.
+	Instance string `json:"-"`
+
+	// Copied from JSON to the columns of the messages table.
+	FromMe      bool   `json:"-"`
+	Author      string `json:"-"`
+	Type        string `json:"-"`
+	Body        string `json:"-"`
+	Ack         string `json:"-"`
+	QuotedMsgID string `json:"-"`
+	SenderName  string `json:"-"`
+
+	// Unix time the message was deleted for everyone, or 0.
+	Revoked int64 `json:"-"`
 }
 
+// Chat-API replaces deleted messages with a message of this type and the same ID.
+const MessageTypeRevoked = "revoked"
+
+// Types of messages whose body is the URL of a file.
+var MediaMessageTypes = []string{"image", "video", "document", "audio", "ptt", "sticker"}
+
 type MessageError struct {
 	Message *Message
 	Text    string
@@ -32,6 +52,12 @@ func NewMessageFromBJSON(b BJSON) (*Message, error) {
 		return nil, err
 	}
 
+	// Copy fields stored in columns.
+	err = message.readFields()
+	if err != nil {
+		return nil, err
+	}
+
 	// Validate message.
 	if message.ID == "" {
 		return message, &MessageError{message, "message ID is missing"}
@@ -63,20 +89,96 @@ func NewMessagesFromBJSON(bs []BJSON) ([]*Message, error) {
 	return messages, firstErr
 }
 
+// readFields copies the fields stored in columns from JSON.
+// Unexpected types are converted instead of rejecting the message.
+func (message *Message) readFields() error {
+	var j struct {
+		FromMe      interface{} `json:"fromMe"`
+		Author      interface{} `json:"author"`
+		Type        interface{} `json:"type"`
+		Body        interface{} `json:"body"`
+		Ack         interface{} `json:"ack"`
+		QuotedMsgID interface{} `json:"quotedMsgId"`
+		SenderName  interface{} `json:"senderName"`
+	}
+	err := json.Unmarshal(message.JSON, &j)
+	if err != nil {
+		return err
+	}
+
+	message.FromMe = j.FromMe == true || j.FromMe == 1.0
+	message.Author = jsonString(j.Author)
+	message.Type = jsonString(j.Type)
+	message.Body = jsonString(j.Body)
+	message.Ack = jsonString(j.Ack)
+	message.QuotedMsgID = jsonString(j.QuotedMsgID)
+	message.SenderName = jsonString(j.SenderName)
+	return nil
+}
+
+// jsonString converts a decoded JSON value to a string; null is "".
+func jsonString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
 // NewMessageFromRow creates a new Message from a MessageRow.
+// The ack column replaces the ack in JSON.
 func NewMessageFromRow(row MessageRow) (*Message, error) {
 	message, err := NewMessageFromBJSON(row.JSON)
 	if err != nil {
 		return message, err
 	}
+	message.Instance = row.Instance
+	if row.Ack != "" {
+		message.Ack = row.Ack
+	}
 
 	err = message.JSON.Update(func(j map[string]interface{}) error {
 		j["__rowID"] = row.ID
+		j["__instance"] = row.Instance
+		if row.Seq != 0 {
+			j["__seq"] = row.Seq
+		}
+		if row.Ack != "" {
+			j["ack"] = row.Ack
+		}
+		if row.Revoked != 0 {
+			j["__revoked"] = row.Revoked
+			j["__revokedBy"] = row.RevokedBy
+		}
 		return nil
 	})
+	message.Revoked = row.Revoked
 	return message, err
 }
 
+// HideRevoked removes the content of a deleted message, as it is shown in WhatsApp.
+// Messages that were not deleted are not changed.
+func (message *Message) HideRevoked() error {
+	if message.Revoked == 0 {
+		return nil
+	}
+	message.Type = MessageTypeRevoked
+	message.Body = ""
+	return message.JSON.Update(func(j map[string]interface{}) error {
+		j["type"] = MessageTypeRevoked
+		j["body"] = ""
+		for _, key := range []string{"caption", "quotedMsgBody", "quotedMsgId", "quotedMsgType", "metadata"} {
+			if _, ok := j[key]; ok {
+				j[key] = nil
+			}
+		}
+		return nil
+	})
+}
+
 // NewMessagesFromRow creates a slice of Message's from a slice of MessageRow's.
 func NewMessagesFromRow(rows []MessageRow) ([]*Message, error) {
 	var firstErr error
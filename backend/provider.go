@@ -0,0 +1,66 @@
+// Messaging services that can be copied to the database.
+
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Provider is a messaging service, such as Chat-API.
+// Messages and chats returned by a Provider have Instance set to Name.
+type Provider interface {
+	// Name is the instance name.
+	Name() string
+	// Status returns the state of the account; Instance, Since and Checked are not set.
+	Status(ctx context.Context) (*AccountStatus, error)
+	// GetChats returns every chat.
+	GetChats(ctx context.Context) ([]*Chat, error)
+	// GetMessages returns messages and the last message number known by the service.
+	GetMessages(ctx context.Context, options GetMessagesOptions) ([]*Message, int64, error)
+	// SendMessage sends a text message.
+	SendMessage(ctx context.Context, options SendMessageOptions) (*SendMessageResponse, error)
+	// SetWebhook tells the service where to send webhook requests.
+	SetWebhook(ctx context.Context, url string) error
+	// ParseWebhook decodes a webhook request body.
+	// Errors wrap ErrInvalidWebhook if the body will never be valid.
+	ParseWebhook(b []byte) (*WebhookEvents, error)
+}
+
+// QRCodeProvider is a Provider whose account is linked by scanning a QR code.
+type QRCodeProvider interface {
+	// GetQRCode returns a PNG image.
+	GetQRCode(ctx context.Context) ([]byte, error)
+}
+
+// MessageDeleter is a Provider that can delete messages for everyone.
+type MessageDeleter interface {
+	DeleteMessage(ctx context.Context, messageID string) error
+}
+
+// WebhookEvents are the changes sent in one webhook request.
+type WebhookEvents struct {
+	Messages []*Message
+	Acks     []*MessageAck
+}
+
+// MessageAck is a change of the delivery status of a message.
+type MessageAck struct {
+	ChatID    string
+	MessageID string
+	Ack       string // sent, delivered, read, viewed
+}
+
+// NewProvider creates the Provider selected by cf.Provider.
+func NewProvider(cf *ConfigChatAPI) (Provider, error) {
+	switch cf.Provider {
+	case "", "chat-api":
+		chatAPI, err := NewChatAPI(cf)
+		if err != nil {
+			return nil, err
+		}
+		return chatAPI, nil
+	default:
+		return nil, fmt.Errorf("instance %v: unknown provider %q", cf.Name, cf.Provider)
+	}
+}
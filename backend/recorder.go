@@ -0,0 +1,297 @@
+// Records Chat-API traffic to a file and serves it back, to reproduce sync problems offline.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Exchange is one line of a recording: a request sent to Chat-API with its response,
+// or a webhook request received from Chat-API.
+// Bodies are stored as JSON when valid, or as base64 in the *Raw fields.
+type Exchange struct {
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	Type     string    `json:"type"` // request or webhook
+	Method   string    `json:"method,omitempty"`
+	// Path and query, without the token.
+	URL             string          `json:"url,omitempty"`
+	RequestBody     json.RawMessage `json:"requestBody,omitempty"`
+	RequestBodyRaw  []byte          `json:"requestBodyRaw,omitempty"`
+	Status          int             `json:"status,omitempty"`
+	ResponseBody    json.RawMessage `json:"responseBody,omitempty"`
+	ResponseBodyRaw []byte          `json:"responseBodyRaw,omitempty"`
+	// Network error, when there is no response.
+	Error string `json:"error,omitempty"`
+}
+
+const (
+	ExchangeRequest = "request"
+	ExchangeWebhook = "webhook"
+)
+
+// Recorder appends exchanges to a file, one JSON object per line.
+// Tokens in URLs are replaced with REDACTED.
+type Recorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenRecorder opens path for appending.
+func OpenRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{f: f}, nil
+}
+
+// Record writes e to the file.
+func (rec *Recorder) Record(e *Exchange) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(e)
+	if err != nil {
+		return err
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	_, err = rec.f.Write(buf.Bytes())
+	return err
+}
+
+// RecordWebhook writes a webhook request body received for instance.
+func (rec *Recorder) RecordWebhook(instance string, body []byte) error {
+	e := &Exchange{Time: time.Now(), Instance: instance, Type: ExchangeWebhook}
+	e.RequestBody, e.RequestBodyRaw = recordBody(body)
+	return rec.Record(e)
+}
+
+func (rec *Recorder) Close() error {
+	return rec.f.Close()
+}
+
+// recordBody returns b as JSON, without tokens, or as raw bytes if it is not JSON.
+func recordBody(b []byte) (json.RawMessage, []byte) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	if !json.Valid(b) {
+		return nil, b
+	}
+	if !bytes.Contains(b, []byte("token")) {
+		return b, nil
+	}
+
+	// Redact URLs such as the webhook URL, and token keys.
+	var v interface{}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return b, nil
+	}
+	b, err = json.Marshal(redactJSON(v))
+	if err != nil {
+		return nil, nil
+	}
+	return b, nil
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if key == "token" {
+				v[key] = "REDACTED"
+			} else {
+				v[key] = redactJSON(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactJSON(value)
+		}
+	case string:
+		return redactURL(v)
+	}
+	return v
+}
+
+// recordURL returns the path and query of u, without the token.
+func recordURL(u *url.URL) string {
+	q := u.Query()
+	q.Del("token")
+	if len(q) == 0 {
+		return u.Path
+	}
+	return u.Path + "?" + q.Encode()
+}
+
+// RecordingTransport records every request sent through Transport.
+type RecordingTransport struct {
+	Instance  string
+	Recorder  *Recorder
+	Transport http.RoundTripper
+}
+
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	e := &Exchange{Time: time.Now(), Instance: t.Instance, Type: ExchangeRequest, Method: req.Method, URL: recordURL(req.URL)}
+
+	// Copy request body.
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err == nil {
+			b, _ := io.ReadAll(body)
+			body.Close()
+			e.RequestBody, e.RequestBodyRaw = recordBody(b)
+		}
+	}
+
+	// Send request.
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		e.Error = redactURL(err.Error())
+		t.Recorder.Record(e)
+		return nil, err
+	}
+
+	// Copy response body, giving the caller a new reader.
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		e.Error = err.Error()
+	}
+	e.Status = res.StatusCode
+	e.ResponseBody, e.ResponseBodyRaw = recordBody(b)
+	t.Recorder.Record(e)
+
+	return res, nil
+}
+
+// Recording is a recording read back from a file.
+type Recording struct {
+	Exchanges []*Exchange
+}
+
+// ReadRecording reads a file written by Recorder.
+func ReadRecording(path string) (*Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rec := &Recording{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 100_000_000)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e Exchange
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %w", path, line, err)
+		}
+		rec.Exchanges = append(rec.Exchanges, &e)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Webhooks returns the webhook request bodies received for instance, in order.
+func (rec *Recording) Webhooks(instance string) [][]byte {
+	var bodies [][]byte
+	for _, e := range rec.Exchanges {
+		if e.Type == ExchangeWebhook && e.Instance == instance {
+			bodies = append(bodies, exchangeBody(e.RequestBody, e.RequestBodyRaw))
+		}
+	}
+	return bodies
+}
+
+// Transport returns a ReplayTransport serving the requests recorded for instance.
+func (rec *Recording) Transport(instance string) *ReplayTransport {
+	t := &ReplayTransport{responses: map[string][]*Exchange{}}
+	for _, e := range rec.Exchanges {
+		if e.Type == ExchangeRequest && e.Instance == instance {
+			key := e.Method + " " + e.URL
+			t.responses[key] = append(t.responses[key], e)
+		}
+	}
+	return t
+}
+
+func exchangeBody(body json.RawMessage, raw []byte) []byte {
+	if body != nil {
+		return body
+	}
+	return raw
+}
+
+// ReplayTransport answers requests with recorded responses, without contacting Chat-API.
+// Requests are matched by method, path and query; requests made more often than they
+// were recorded get the last response again. Unknown requests get HTTP 404.
+type ReplayTransport struct {
+	mu        sync.Mutex
+	responses map[string][]*Exchange
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	// Find the next response.
+	key := req.Method + " " + recordURL(req.URL)
+	t.mu.Lock()
+	queue := t.responses[key]
+	var e *Exchange
+	if len(queue) > 0 {
+		e = queue[0]
+		if len(queue) > 1 {
+			t.responses[key] = queue[1:]
+		}
+	}
+	t.mu.Unlock()
+
+	if e == nil {
+		b, _ := json.Marshal(map[string]interface{}{"error": "Request not in the recording: " + key})
+		return replayResponse(req, http.StatusNotFound, b), nil
+	}
+	if e.Error != "" {
+		return nil, fmt.Errorf("recorded error: %v", e.Error)
+	}
+	return replayResponse(req, e.Status, exchangeBody(e.ResponseBody, e.ResponseBodyRaw)), nil
+}
+
+func replayResponse(req *http.Request, status int, b []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Request:       req,
+	}
+}
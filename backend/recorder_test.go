@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordingReplay(t *testing.T) {
+	ctx := context.Background()
+	_, chatAPI := newTestSimulator(t, "secret-token", 2, 4)
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+
+	// Record a sync.
+	rec, err := OpenRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatAPI.Client.Transport = &RecordingTransport{Instance: "default", Recorder: rec}
+	err = chatAPI.SetWebhook(ctx, "https://example.com/hook?token=webhook-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := newTestDatabase(t)
+	wa := NewChatAPIDB(chatAPI, db)
+	_, err = wa.LoadSyncState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wa.CopyChats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wa.CopyNewMessages(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens must not be in the file.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"secret-token", "webhook-secret"} {
+		if strings.Contains(string(b), token) {
+			t.Errorf("recording contains %q", token)
+		}
+	}
+	if !strings.Contains(string(b), "REDACTED") {
+		t.Errorf("recording does not contain the redacted webhook URL")
+	}
+
+	// Replay it into another database, without the simulator.
+	recording, err := ReadRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayAPI, err := NewChatAPI(&ConfigChatAPI{Name: "default", URL: "http://chat-api.invalid", Token: "other-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayAPI.Client.Transport = recording.Transport("default")
+	replayDB := newTestDatabase(t)
+	replay := NewChatAPIDB(replayAPI, replayDB)
+	_, err = replay.LoadSyncState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replay.CopyChats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replay.CopyNewMessages(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"chats", "messages"} {
+		if got, want := countRows(t, replayDB, table), countRows(t, db, table); got != want {
+			t.Errorf("%s: got %d, want %d", table, got, want)
+		}
+	}
+	if replay.LastMessageNumber != wa.LastMessageNumber {
+		t.Errorf("LastMessageNumber: got %d, want %d", replay.LastMessageNumber, wa.LastMessageNumber)
+	}
+}
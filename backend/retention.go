@@ -0,0 +1,246 @@
+// Applies retention rules in the background.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Pruner deletes messages and media older than the retention rules allow.
+type Pruner struct {
+	DB     *Database
+	Config *ConfigRetention
+
+	// Only one run at a time.
+	mu sync.Mutex
+}
+
+func NewPruner(db *Database, cf *ConfigRetention) *Pruner {
+	return &Pruner{DB: db, Config: cf}
+}
+
+// RetentionReport tells what a run deleted, or would delete in a dry run.
+type RetentionReport struct {
+	DryRun   bool                   `json:"dryRun"`
+	Started  time.Time              `json:"started"`
+	Finished time.Time              `json:"finished"`
+	Rules    []*RetentionRuleReport `json:"rules"`
+	// Chats matching a rule that were skipped because of a legal hold.
+	HeldChats int   `json:"heldChats"`
+	Messages  int64 `json:"messages"`
+	Media     int64 `json:"media"`
+	Vacuumed  bool  `json:"vacuumed"`
+}
+
+type RetentionRuleReport struct {
+	Rule     ConfigRetentionRule `json:"rule"`
+	Chats    int                 `json:"chats"`
+	Messages int64               `json:"messages"`
+	Media    int64               `json:"media"`
+}
+
+// Loop runs Run every Config.Interval hours until ctx is done.
+func (p *Pruner) Loop(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(p.Config.Interval) * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		report, err := p.Run(ctx, false)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Pruner.Run: %v", err)
+		} else if report.Messages > 0 || report.Media > 0 {
+			log.Printf("Pruner: deleted %d messages and %d media", report.Messages, report.Media)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run applies the retention rules to every chat, except those under legal hold.
+// With dryRun, nothing is changed and the report counts what would be deleted.
+// The database is vacuumed after deleting, at most every Config.VacuumDays.
+func (p *Pruner) Run(ctx context.Context, dryRun bool) (*RetentionReport, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	report := &RetentionReport{DryRun: dryRun, Started: time.Now(), Rules: make([]*RetentionRuleReport, 0, len(p.Config.Rules))}
+	for _, rule := range p.Config.Rules {
+		report.Rules = append(report.Rules, &RetentionRuleReport{Rule: rule})
+	}
+
+	chats, err := p.DB.GetRetentionChats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, chat := range chats {
+		// Find the rule of the chat.
+		i := p.ruleIndex(chat)
+		if i < 0 {
+			continue
+		}
+		if chat.Held {
+			report.HeldChats++
+			continue
+		}
+		rule, rr := p.Config.Rules[i], report.Rules[i]
+		rr.Chats++
+
+		// Cut-off times; 0 keeps everything.
+		var messageBefore, mediaBefore int64
+		if rule.MessageDays > 0 {
+			messageBefore = report.Started.AddDate(0, 0, -rule.MessageDays).Unix()
+		}
+		if rule.MediaDays > 0 {
+			mediaBefore = report.Started.AddDate(0, 0, -rule.MediaDays).Unix()
+		}
+
+		// Delete messages, then media of the remaining messages.
+		if messageBefore > 0 {
+			var n int64
+			if dryRun {
+				n, err = p.DB.CountMessagesBefore(ctx, chat.Instance, chat.ChatID, messageBefore)
+			} else {
+				n, err = p.DB.PruneMessages(ctx, chat.Instance, chat.ChatID, messageBefore)
+			}
+			rr.Messages += n
+			if err != nil {
+				return nil, err
+			}
+		}
+		if mediaBefore > messageBefore {
+			var n int64
+			if dryRun {
+				n, err = p.DB.CountMediaBetween(ctx, chat.Instance, chat.ChatID, messageBefore, mediaBefore)
+			} else {
+				n, err = p.DB.PruneMedia(ctx, chat.Instance, chat.ChatID, messageBefore, mediaBefore)
+			}
+			rr.Media += n
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, rr := range report.Rules {
+		report.Messages += rr.Messages
+		report.Media += rr.Media
+	}
+
+	// Return the space to the file system.
+	if !dryRun && report.Messages > 0 {
+		report.Vacuumed, err = p.vacuumIfDue(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report.Finished = time.Now()
+	return report, nil
+}
+
+// ruleIndex returns the index of the first rule matching chat, or -1.
+func (p *Pruner) ruleIndex(chat *RetentionChat) int {
+	for i, rule := range p.Config.Rules {
+		if rule.Instance != "" && rule.Instance != chat.Instance {
+			continue
+		}
+		if rule.ChatID != "" && rule.ChatID != chat.ChatID {
+			continue
+		}
+		if rule.Label != "" && !containsString(chat.Labels, rule.Label) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// vacuumIfDue runs VACUUM if the last one is older than Config.VacuumDays.
+func (p *Pruner) vacuumIfDue(ctx context.Context) (bool, error) {
+	if p.Config.VacuumDays <= 0 {
+		return false, nil
+	}
+	last, err := p.DB.GetSetting(ctx, SettingLastVacuum)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	t, _ := strconv.ParseInt(last, 10, 64)
+	if time.Since(time.Unix(t, 0)) < time.Duration(p.Config.VacuumDays)*24*time.Hour {
+		return false, nil
+	}
+	return true, p.Vacuum(ctx)
+}
+
+// Vacuum runs VACUUM now and remembers when.
+func (p *Pruner) Vacuum(ctx context.Context) error {
+	log.Printf("Pruner: vacuuming database")
+	err := p.DB.Vacuum(ctx)
+	if err != nil {
+		return err
+	}
+	return p.DB.SetSetting(ctx, SettingLastVacuum, strconv.FormatInt(time.Now().Unix(), 10))
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPReport sends what the retention rules would delete now, without deleting it.
+func (p *Pruner) HTTPReport(w http.ResponseWriter, r *http.Request) {
+	report, err := p.Run(r.Context(), true)
+	if err != nil {
+		log.Printf("Pruner.Run: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// HTTPRun applies the retention rules now and sends the report.
+func (p *Pruner) HTTPRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := p.Run(r.Context(), false)
+	if err != nil {
+		log.Printf("Pruner.Run: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// HTTPLegalHolds sends every legal hold.
+func (p *Pruner) HTTPLegalHolds(w http.ResponseWriter, r *http.Request) {
+	holds, err := p.DB.GetLegalHolds(r.Context())
+	if err != nil {
+		log.Printf("Database.GetLegalHolds: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"holds": holds})
+}
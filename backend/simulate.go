@@ -0,0 +1,413 @@
+// Fake Chat-API server, so that the whole stack runs without a Chat-API account.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Simulator implements the Chat-API endpoints used by this program:
+// /status, /webhook, /messages, /dialogs, /sendMessage and /deleteMessage.
+// Sent messages go through the sent, delivered and viewed acks, and
+// new messages and acks are delivered to the webhook like Chat-API does.
+type Simulator struct {
+	Token string
+	// Reported by /status.
+	AccountStatus string
+	// Time between ack changes of sent messages.
+	AckInterval time.Duration
+	// Sends webhook requests.
+	Client *http.Client
+
+	mu         sync.Mutex
+	webhookURL string
+	number     int64 // last messageNumber
+	chats      []*simChat
+	messages   []map[string]interface{} // ordered by messageNumber
+}
+
+type simChat struct {
+	ID       string
+	Name     string
+	LastTime int64
+}
+
+func NewSimulator(token string) *Simulator {
+	return &Simulator{
+		Token:         token,
+		AccountStatus: "authenticated",
+		AckInterval:   2 * time.Second,
+		Client:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Seed creates chats with messages spread over the last days.
+func (sim *Simulator) Seed(chats, messages int) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	now := time.Now().Unix()
+	for i := 0; i < chats; i++ {
+		chat := sim.addChat(fmt.Sprintf("55119%08d@c.us", 10000000+i), fmt.Sprintf("Contact %d", i+1))
+		for j := 0; j < messages; j++ {
+			t := now - int64((messages-j)*3600) - int64(i*60)
+			fromMe := j%3 == 2
+			message := sim.addMessage(chat, fmt.Sprintf("Message %d in chat %d", j+1, i+1), fromMe, t)
+			if fromMe {
+				message["ack"] = "viewed"
+			}
+		}
+	}
+}
+
+// AddChat adds a private chat, returning the existing one if chatID is known.
+func (sim *Simulator) AddChat(chatID, name string) *simChat {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return sim.addChat(chatID, name)
+}
+
+func (sim *Simulator) addChat(chatID, name string) *simChat {
+	for _, chat := range sim.chats {
+		if chat.ID == chatID {
+			return chat
+		}
+	}
+	chat := &simChat{ID: chatID, Name: name}
+	sim.chats = append(sim.chats, chat)
+	return chat
+}
+
+// Receive simulates a message sent by the contact of chatID and delivers it to the webhook.
+func (sim *Simulator) Receive(ctx context.Context, chatID, body string) {
+	sim.mu.Lock()
+	chat := sim.addChat(chatID, strings.TrimSuffix(chatID, "@c.us"))
+	message := sim.addMessage(chat, body, false, time.Now().Unix())
+	sim.mu.Unlock()
+
+	sim.deliver(ctx, map[string]interface{}{"messages": []interface{}{message}})
+}
+
+// ReceiveLoop receives a message in a random chat at every interval until ctx is done.
+func (sim *Simulator) ReceiveLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for n := 1; ; n++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		sim.mu.Lock()
+		var chatID string
+		if len(sim.chats) > 0 {
+			chatID = sim.chats[mathrand.Intn(len(sim.chats))].ID
+		}
+		sim.mu.Unlock()
+		if chatID == "" {
+			continue
+		}
+		sim.Receive(ctx, chatID, fmt.Sprintf("Simulated message %d", n))
+	}
+}
+
+// addMessage stores a new message; the caller must hold mu.
+func (sim *Simulator) addMessage(chat *simChat, body string, fromMe bool, t int64) map[string]interface{} {
+	sim.number++
+	author := chat.ID
+	senderName := chat.Name
+	if fromMe {
+		author = "5511900000000@c.us"
+		senderName = "Me"
+	}
+	message := map[string]interface{}{
+		"id":            fmt.Sprintf("%v_%v_%v", fromMe, chat.ID, simRandomID()),
+		"body":          body,
+		"fromMe":        fromMe,
+		"self":          0,
+		"isForwarded":   0,
+		"author":        author,
+		"time":          t,
+		"chatId":        chat.ID,
+		"messageNumber": sim.number,
+		"type":          "chat",
+		"senderName":    senderName,
+		"caption":       nil,
+		"quotedMsgBody": nil,
+		"quotedMsgId":   nil,
+		"quotedMsgType": nil,
+		"metadata":      nil,
+		"ack":           nil,
+		"chatName":      chat.Name,
+	}
+	sim.messages = append(sim.messages, message)
+	if t > chat.LastTime {
+		chat.LastTime = t
+	}
+	return message
+}
+
+func (sim *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check token.
+	if r.URL.Query().Get("token") != sim.Token {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Wrong token"})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/status":
+		sim.httpStatus(w, r)
+	case "/webhook":
+		sim.httpWebhook(w, r)
+	case "/messages":
+		sim.httpMessages(w, r)
+	case "/dialogs":
+		sim.httpDialogs(w, r)
+	case "/sendMessage":
+		sim.httpSendMessage(w, r)
+	case "/deleteMessage":
+		sim.httpDeleteMessage(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Not implemented by the simulator"})
+	}
+}
+
+func (sim *Simulator) httpStatus(w http.ResponseWriter, r *http.Request) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"accountStatus": sim.AccountStatus,
+		"statusData":    map[string]interface{}{"substatus": "normal", "title": "", "msg": "", "submsg": "", "actions": map[string]interface{}{}},
+	})
+}
+
+func (sim *Simulator) httpWebhook(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		WebhookURL string `json:"webhookUrl"`
+	}
+	if r.Method == http.MethodPost {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+			return
+		}
+		sim.mu.Lock()
+		sim.webhookURL = req.WebhookURL
+		sim.mu.Unlock()
+		log.Printf("Simulator: webhook set to %v", redactURL(req.WebhookURL))
+	}
+
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"set": true, "webhookUrl": sim.webhookURL})
+}
+
+// httpMessages sends messages after lastMessageNumber, oldest first.
+// Without lastMessageNumber, the newest limit messages matching the other filters are sent.
+func (sim *Simulator) httpMessages(w http.ResponseWriter, r *http.Request) {
+	uq := r.URL.Query()
+	limit := simIntParam(uq.Get("limit"), 100)
+	lastNumber := simIntParam(uq.Get("lastMessageNumber"), 0)
+	minTime := simIntParam(uq.Get("min_time"), 0)
+	maxTime := simIntParam(uq.Get("max_time"), 0)
+	chatID := uq.Get("chatId")
+
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	// Filter messages.
+	matches := make([]map[string]interface{}, 0, limit)
+	for _, message := range sim.messages {
+		t := message["time"].(int64)
+		if message["messageNumber"].(int64) <= int64(lastNumber) ||
+			(chatID != "" && message["chatId"] != chatID) ||
+			(minTime > 0 && t < int64(minTime)) ||
+			(maxTime > 0 && t > int64(maxTime)) {
+			continue
+		}
+		matches = append(matches, message)
+	}
+
+	// Limit the page.
+	if len(matches) > limit {
+		if uq.Has("lastMessageNumber") {
+			matches = matches[:limit]
+		} else {
+			matches = matches[len(matches)-limit:]
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"messages": matches, "lastMessageNumber": sim.number})
+}
+
+func (sim *Simulator) httpDialogs(w http.ResponseWriter, r *http.Request) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	// Most recent chats first.
+	chats := append([]*simChat(nil), sim.chats...)
+	sort.SliceStable(chats, func(i, j int) bool { return chats[i].LastTime > chats[j].LastTime })
+
+	dialogs := make([]map[string]interface{}, 0, len(chats))
+	for _, chat := range chats {
+		dialogs = append(dialogs, map[string]interface{}{
+			"id":    chat.ID,
+			"name":  chat.Name,
+			"image": "",
+			"metadata": map[string]interface{}{
+				"isGroup":          false,
+				"participants":     []string{},
+				"participantsInfo": []string{},
+				"groupInviteLink":  nil,
+			},
+			"last_time": chat.LastTime,
+		})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"dialogs": dialogs})
+}
+
+func (sim *Simulator) httpSendMessage(w http.ResponseWriter, r *http.Request) {
+	var req SendMessageOptions
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if req.ChatID == "" && req.Phone != "" {
+		req.ChatID, err = PhoneToChatID(req.Phone)
+		if err != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+			return
+		}
+	}
+	if req.ChatID == "" || req.Body == "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "chatId or phone and body are required"})
+		return
+	}
+
+	// Store message.
+	sim.mu.Lock()
+	chat := sim.addChat(req.ChatID, strings.TrimSuffix(req.ChatID, "@c.us"))
+	message := sim.addMessage(chat, req.Body, true, time.Now().Unix())
+	if req.QuotedMsgID != "" {
+		message["quotedMsgId"] = req.QuotedMsgID
+	}
+	sim.mu.Unlock()
+
+	// Chat-API also sends our own messages to the webhook, then their acks.
+	go func() {
+		ctx := context.Background()
+		sim.deliver(ctx, map[string]interface{}{"messages": []interface{}{message}})
+		for _, ack := range []string{"sent", "delivered", "viewed"} {
+			time.Sleep(sim.AckInterval)
+			sim.mu.Lock()
+			message["ack"] = ack
+			sim.mu.Unlock()
+			sim.deliver(ctx, map[string]interface{}{"ack": []interface{}{
+				map[string]interface{}{"id": message["id"], "chatId": message["chatId"], "status": ack, "queueNumber": 1},
+			}})
+		}
+	}()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sent":        true,
+		"message":     "Sent to " + req.ChatID,
+		"id":          message["id"],
+		"queueNumber": 1,
+	})
+}
+
+// httpDeleteMessage replaces a message with a revoked one, like WhatsApp does,
+// and delivers it to the webhook.
+func (sim *Simulator) httpDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MessageID string `json:"messageId"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	// Find message.
+	sim.mu.Lock()
+	var revoked map[string]interface{}
+	for _, message := range sim.messages {
+		if message["id"] == req.MessageID {
+			message["type"] = MessageTypeRevoked
+			message["body"] = ""
+			revoked = message
+			break
+		}
+	}
+	sim.mu.Unlock()
+	if revoked == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"sent": false, "message": "Message not found"})
+		return
+	}
+
+	go sim.deliver(context.Background(), map[string]interface{}{"messages": []interface{}{revoked}})
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"sent": true, "message": "Message deleted"})
+}
+
+// deliver sends a webhook request, if a webhook is set.
+func (sim *Simulator) deliver(ctx context.Context, body interface{}) {
+	sim.mu.Lock()
+	b, err := json.Marshal(body)
+	webhookURL := sim.webhookURL
+	sim.mu.Unlock()
+	if err != nil || webhookURL == "" {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewReader(b))
+	if err != nil {
+		log.Printf("Simulator: webhook: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := sim.Client.Do(req)
+	if err != nil {
+		log.Printf("Simulator: webhook: %v", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		log.Printf("Simulator: webhook: HTTP %d", res.StatusCode)
+	}
+}
+
+func simIntParam(s string, def int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+func simRandomID() string {
+	b := make([]byte, 10)
+	rand.Read(b)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDatabase creates a database in a temporary directory.
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	db := NewDatabase("sqlite3", filepath.Join(t.TempDir(), "test.sqlite"))
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = db.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newTestSimulator starts a Simulator with chats and messages, returning a ChatAPI client for it.
+func newTestSimulator(t *testing.T, token string, chats, messages int) (*Simulator, *ChatAPI) {
+	t.Helper()
+	sim := NewSimulator(token)
+	sim.Seed(chats, messages)
+	srv := httptest.NewServer(sim)
+	t.Cleanup(srv.Close)
+
+	chatAPI, err := NewChatAPI(&ConfigChatAPI{Name: "default", URL: srv.URL, Token: token, Timeout: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sim, chatAPI
+}
+
+// copyAll copies the chats and every message of chatAPI to db, like a sync and a full backfill.
+func copyAll(t *testing.T, db *Database, chatAPI *ChatAPI) {
+	t.Helper()
+	ctx := context.Background()
+	wa := NewChatAPIDB(chatAPI, db)
+	_, err := wa.LoadSyncState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wa.CopyChats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, _, err := chatAPI.GetMessages(ctx, GetMessagesOptions{Limit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddMessages(ctx, "REPLACE", messages, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countRows(t *testing.T, db *Database, table string) int {
+	t.Helper()
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestChatAPIDBSimulator(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	sim, chatAPI := newTestSimulator(t, "test", 3, 7)
+
+	wa := NewChatAPIDB(chatAPI, db)
+	wa.PageSize = 5
+	_, err := wa.LoadSyncState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new database starts with the newest page; the backfill copies older messages.
+	err = wa.CopyChats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wa.CopyNewMessages(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, "chats"); n != 3 {
+		t.Errorf("chats: got %d, want 3", n)
+	}
+	if n := countRows(t, db, "messages"); n != 5 {
+		t.Errorf("messages: got %d, want 5", n)
+	}
+	if wa.LastMessageNumber != 21 {
+		t.Errorf("LastMessageNumber: got %d, want 21", wa.LastMessageNumber)
+	}
+	bf := NewBackfill(ctx, wa)
+	bf.PageSize = 2
+	bf.Interval = time.Millisecond
+	err = bf.Run(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, "messages"); n != 21 {
+		t.Errorf("messages after backfill: got %d, want 21", n)
+	}
+
+	// Copy only the new message, from where the sync state stopped.
+	sim.Receive(ctx, "5511912345678@c.us", "Hello")
+	wa = NewChatAPIDB(chatAPI, db)
+	err = wa.CopyNewMessages(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, "messages"); n != 22 {
+		t.Errorf("messages after Receive: got %d, want 22", n)
+	}
+	if wa.LastMessageNumber != 22 {
+		t.Errorf("LastMessageNumber after Receive: got %d, want 22", wa.LastMessageNumber)
+	}
+}
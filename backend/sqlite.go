@@ -1,5 +1,7 @@
 package main
 
+import "database/sql"
+
 var SQLITE_INIT = `
 CREATE TABLE IF NOT EXISTS users (
 	id INTEGER PRIMARY KEY,
@@ -29,12 +31,219 @@ CREATE TABLE IF NOT EXISTS messages (
 	chat_id TEXT,
 	json TEXT
 );
-CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_id ON messages (message_id);
 
 CREATE TABLE IF NOT EXISTS chats (
 	id INTEGER PRIMARY KEY,
 	chat_id TEXT,
 	json TEXT
 );
-CREATE UNIQUE INDEX IF NOT EXISTS idx_chats_id ON chats (chat_id);
+
+CREATE TABLE IF NOT EXISTS contacts (
+	id INTEGER PRIMARY KEY,
+	chat_id TEXT, -- <number>@c.us
+	name TEXT,
+	phone TEXT,
+	email TEXT,
+	company TEXT,
+	notes TEXT
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_contacts_chat_id ON contacts (chat_id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id INTEGER PRIMARY KEY,
+	url TEXT, -- subscription URL in the configuration
+	event TEXT, -- e.g. message.created
+	payload TEXT, -- JSON request body
+	status TEXT, -- pending, delivered, failed
+	attempts INTEGER,
+	next_attempt INTEGER, -- unix time
+	last_error TEXT,
+	created INTEGER, -- unix time
+	delivered INTEGER -- unix time
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries (status, next_attempt);
+
+CREATE TABLE IF NOT EXISTS settings (
+	key TEXT PRIMARY KEY,
+	value TEXT
+);
+
+CREATE TABLE IF NOT EXISTS webhook_requests (
+	hash TEXT PRIMARY KEY, -- SHA-256 of the request body
+	time INTEGER -- unix time
+);
+
+CREATE TABLE IF NOT EXISTS webhook_inbox (
+	id INTEGER PRIMARY KEY,
+	payload TEXT, -- raw request body from Chat-API
+	status TEXT, -- pending, done, dead
+	attempts INTEGER,
+	next_attempt INTEGER, -- unix time
+	last_error TEXT,
+	received INTEGER, -- unix time
+	processed INTEGER -- unix time
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_inbox_due ON webhook_inbox (status, next_attempt);
+
+CREATE TABLE IF NOT EXISTS backfill_chats (
+	id INTEGER PRIMARY KEY,
+	chat_id TEXT,
+	max_time INTEGER, -- only messages older than this are still missing; 0 means none copied yet
+	done INTEGER, -- 1 when the beginning of the chat was reached
+	messages INTEGER, -- messages copied so far
+	last_error TEXT,
+	updated INTEGER -- unix time
+);
+
+CREATE TABLE IF NOT EXISTS message_gaps (
+	id INTEGER PRIMARY KEY,
+	start_number INTEGER, -- first missing message_number
+	end_number INTEGER, -- last missing message_number
+	status TEXT, -- open, repaired, unrecoverable
+	attempts INTEGER,
+	detected INTEGER, -- unix time
+	updated INTEGER -- unix time
+);
+
+CREATE TABLE IF NOT EXISTS sync_state (
+	name TEXT PRIMARY KEY, -- sync loop, e.g. chat-api
+	last_message_number INTEGER, -- CopyNewMessages continues after this
+	last_chats_sync INTEGER, -- unix time of the last CopyChats
+	backfill_chat_id TEXT, -- chat being copied by the backfill
+	backfill_max_time INTEGER, -- backfill position in that chat
+	owner TEXT, -- process holding the lease
+	lease_until INTEGER, -- unix time
+	updated INTEGER -- unix time
+);
+
+CREATE TABLE IF NOT EXISTS chat_last_messages (
+	instance TEXT,
+	chat_id TEXT,
+	time INTEGER, -- time of the newest message
+	message_id TEXT, -- references messages.message_id
+	PRIMARY KEY (instance, chat_id)
+);
+CREATE INDEX IF NOT EXISTS idx_chat_last_messages_time ON chat_last_messages (time);
+
+CREATE TABLE IF NOT EXISTS chat_metadata (
+	instance TEXT,
+	chat_id TEXT,
+	assignee INTEGER, -- references users.id; NULL if nobody
+	labels TEXT, -- JSON array of strings
+	updated INTEGER, -- unix time
+	PRIMARY KEY (instance, chat_id)
+);
+
+CREATE TABLE IF NOT EXISTS message_changes (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT, -- clients follow changes after the last seq they saw
+	row_id INTEGER, -- references messages.id
+	kind TEXT, -- created, updated, edited, ack, revoked, media-pruned, pruned
+	old_value TEXT, -- previous body (edited), ack (ack) or message ID (pruned)
+	new_value TEXT,
+	time INTEGER -- unix time
+);
+CREATE INDEX IF NOT EXISTS idx_message_changes_row_id ON message_changes (row_id);
+
+CREATE TABLE IF NOT EXISTS legal_holds (
+	instance TEXT,
+	chat_id TEXT,
+	reason TEXT,
+	created INTEGER, -- unix time
+	created_by TEXT, -- user name
+	PRIMARY KEY (instance, chat_id)
+);
+
+-- Messages deleted by retention rules, so that they are not copied again.
+CREATE TABLE IF NOT EXISTS pruned_messages (
+	instance TEXT,
+	message_id TEXT,
+	message_number INTEGER,
+	pruned INTEGER, -- unix time
+	PRIMARY KEY (instance, message_id)
+);
+CREATE INDEX IF NOT EXISTS idx_pruned_messages_number ON pruned_messages (instance, message_number);
+
+-- Chats erased or pseudonymised on request of the person, so that they are not copied again.
+CREATE TABLE IF NOT EXISTS erased_chats (
+	chat_hash TEXT PRIMARY KEY, -- keyed hash of the chat ID
+	erased INTEGER -- unix time
+);
+
+-- Exports and erasures of the data of a WhatsApp ID.
+CREATE TABLE IF NOT EXISTS gdpr_audit (
+	id INTEGER PRIMARY KEY,
+	time INTEGER, -- unix time
+	action TEXT, -- export, erase, pseudonymise
+	subject_hash TEXT, -- keyed hash of the chat ID
+	performed_by TEXT, -- user name, or cli
+	report TEXT -- JSON counts of rows
+);
 `
+
+// SQLITE_MIGRATIONS change tables created by older versions.
+// Migration i runs once, when PRAGMA user_version is i.
+// Only append to this list.
+var SQLITE_MIGRATIONS = []string{
+	// 0: Administrators.
+	`ALTER TABLE users ADD COLUMN admin INTEGER NOT NULL DEFAULT 0;
+	UPDATE users SET admin = 1 WHERE name = 'admin';`,
+
+	// 1: Chat-API instances; indexes that were unique per database are now unique per instance.
+	// Existing rows belong to DefaultInstance; CheckDefaultInstance stops servers that do not configure it.
+	`ALTER TABLE messages ADD COLUMN instance TEXT NOT NULL DEFAULT 'default';
+	DROP INDEX IF EXISTS idx_messages_id;
+	DROP INDEX IF EXISTS idx_messages_number;
+	CREATE UNIQUE INDEX idx_messages_id ON messages (instance, message_id);
+	CREATE INDEX idx_messages_number ON messages (instance, message_number);
+
+	ALTER TABLE chats ADD COLUMN instance TEXT NOT NULL DEFAULT 'default';
+	DROP INDEX IF EXISTS idx_chats_id;
+	CREATE UNIQUE INDEX idx_chats_id ON chats (instance, chat_id);
+
+	ALTER TABLE webhook_inbox ADD COLUMN instance TEXT NOT NULL DEFAULT 'default';
+
+	ALTER TABLE backfill_chats ADD COLUMN instance TEXT NOT NULL DEFAULT 'default';
+	DROP INDEX IF EXISTS idx_backfill_chats_chat_id;
+	CREATE UNIQUE INDEX idx_backfill_chats_chat_id ON backfill_chats (instance, chat_id);
+
+	ALTER TABLE message_gaps ADD COLUMN instance TEXT NOT NULL DEFAULT 'default';
+	DROP INDEX IF EXISTS idx_message_gaps_range;
+	CREATE UNIQUE INDEX idx_message_gaps_range ON message_gaps (instance, start_number, end_number);`,
+
+	// 2: Pages of chat messages.
+	`CREATE INDEX idx_messages_chat_time ON messages (instance, chat_id, time);`,
+
+	// 3: Last message of each chat.
+	`INSERT OR REPLACE INTO chat_last_messages (instance, chat_id, time, message_id)
+	SELECT instance, chat_id, time, message_id FROM (
+		SELECT instance, chat_id, time, message_id, row_number() OVER (PARTITION BY instance, chat_id ORDER BY time DESC, id DESC) AS row FROM messages
+	) WHERE row = 1;`,
+
+	// 4: Message fields as columns; filled by migrateMessageColumns.
+	`ALTER TABLE messages ADD COLUMN from_me INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN author TEXT;
+	ALTER TABLE messages ADD COLUMN type TEXT;
+	ALTER TABLE messages ADD COLUMN body TEXT;
+	ALTER TABLE messages ADD COLUMN ack TEXT;
+	ALTER TABLE messages ADD COLUMN quoted_msg_id TEXT;
+	ALTER TABLE messages ADD COLUMN sender_name TEXT;`,
+
+	// 5: Deleted messages; supervisors may still see them.
+	`ALTER TABLE messages ADD COLUMN revoked INTEGER; -- unix time
+	ALTER TABLE messages ADD COLUMN revoked_by TEXT; -- contact, phone or user:<name>
+	ALTER TABLE users ADD COLUMN supervisor INTEGER NOT NULL DEFAULT 0;`,
+
+	// 6: Media removed by retention rules.
+	`ALTER TABLE messages ADD COLUMN media_pruned INTEGER; -- unix time`,
+
+	// 7: Read state per instance, so that chats with the same contact on two numbers are read separately.
+	`ALTER TABLE user_chat_info ADD COLUMN instance TEXT NOT NULL DEFAULT 'default';
+	DROP INDEX IF EXISTS idx_user_chat_info_ids;
+	CREATE UNIQUE INDEX idx_user_chat_info_ids ON user_chat_info (user_id, instance, chat_id);`,
+}
+
+// SQLITE_MIGRATION_FUNCS run after the SQL of the migration with the same number,
+// for changes SQL cannot make (SQLite is built without JSON functions).
+var SQLITE_MIGRATION_FUNCS = map[int]func(tx *sql.Tx) error{
+	4: migrateMessageColumns,
+}
@@ -0,0 +1,171 @@
+// Watches the connection between Chat-API and the WhatsApp phone.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Account states besides the ones sent by Chat-API (init, loading, got qr code, authenticated).
+const (
+	// Authenticated, but the phone is offline.
+	AccountDisconnected = "disconnected"
+	// Chat-API did not answer.
+	AccountUnavailable = "unavailable"
+)
+
+type AccountStatus struct {
+	Instance  string `json:"instance"`
+	State     string `json:"state"`
+	Substatus string `json:"substatus,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// Unix time the account entered this state.
+	Since int64 `json:"since"`
+	// Unix time of the last check.
+	Checked int64 `json:"checked"`
+}
+
+// StatusMonitor polls the provider status so that a disconnected phone is noticed while running.
+type StatusMonitor struct {
+	*ChatAPIDB
+	// Time between checks.
+	Interval time.Duration
+	// Time between checks while the account is not authenticated, e.g. while a QR code is shown.
+	FastInterval time.Duration
+	// Notified when the state changes.
+	W Wait
+
+	mu     sync.Mutex
+	status AccountStatus
+}
+
+func NewStatusMonitor(wadb *ChatAPIDB) *StatusMonitor {
+	return &StatusMonitor{
+		ChatAPIDB:    wadb,
+		Interval:     30 * time.Second,
+		FastInterval: 5 * time.Second,
+	}
+}
+
+// Loop checks the status until ctx is done.
+func (sm *StatusMonitor) Loop(ctx context.Context) {
+	for {
+		wait := sm.Interval
+		if sm.Status().State != "authenticated" {
+			wait = sm.FastInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		sm.Check(ctx)
+	}
+}
+
+// Status returns the result of the last check.
+func (sm *StatusMonitor) Status() AccountStatus {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.status
+}
+
+// Check asks Chat-API for the account status and records changes.
+func (sm *StatusMonitor) Check(ctx context.Context) AccountStatus {
+	now := time.Now().Unix()
+
+	// Get status from Chat-API.
+	var status AccountStatus
+	s, err := sm.Provider.Status(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return sm.Status()
+		}
+		status.State = AccountUnavailable
+		status.Error = err.Error()
+	} else {
+		status = *s
+	}
+	status.Instance = sm.Instance
+	status.Checked = now
+
+	// Store status.
+	sm.mu.Lock()
+	previous := sm.status
+	changed := status.State != previous.State
+	if changed {
+		status.Since = now
+	} else {
+		status.Since = previous.Since
+	}
+	sm.status = status
+	sm.mu.Unlock()
+	if !changed {
+		return status
+	}
+
+	// Tell everyone about the new state.
+	log.Printf("Chat-API account status of %v: %v -> %v", sm.Instance, previous.State, status.State)
+	sm.W.Notify()
+	err = sm.DB.AddEvent(ctx, EventAccountStatus, status)
+	if err != nil {
+		log.Printf("Database.AddEvent: %v", err)
+	}
+
+	// Catch up on messages received while disconnected.
+	if status.State == "authenticated" && previous.State != "" {
+		sm.UpdateNow()
+	}
+
+	return status
+}
+
+// HTTPStatus sends the account status.
+//
+// Query parameters:
+// instance: Chat-API instance (the first one if missing).
+// state: the state known by the user.
+// wait: if not empty, wait until the state is different from state.
+func (sm *StatusMonitor) HTTPStatus(w http.ResponseWriter, r *http.Request) {
+	uq := r.URL.Query()
+
+	// Wait for a change.
+	if uq.Has("wait") {
+		waitCtx, cancel := context.WithTimeout(r.Context(), time.Minute)
+		defer cancel()
+		for sm.Status().State == uq.Get("state") {
+			if sm.W.Wait(waitCtx) != nil {
+				break
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(sm.Status())
+}
+
+// HTTPQRCode sends the QR code image used to log in to WhatsApp.
+func (sm *StatusMonitor) HTTPQRCode(w http.ResponseWriter, r *http.Request) {
+	qr, ok := sm.Provider.(QRCodeProvider)
+	if !ok {
+		http.Error(w, "This instance does not use QR codes", http.StatusNotFound)
+		return
+	}
+	b, err := qr.GetQRCode(r.Context())
+	if err != nil {
+		log.Printf("ChatAPI.GetQRCode: %v", err)
+		http.Error(w, "No QR code available", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(b)
+}
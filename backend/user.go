@@ -18,6 +18,9 @@ type User struct {
 	Name  string
 	Label string // real name
 	Token string
+	Admin bool // may use /api/admin/
+	// May see the content of deleted messages; administrators always may.
+	Supervisor bool
 }
 
 // ContextUser returns User from the context.
@@ -0,0 +1,191 @@
+// Checks that incoming webhook requests come from Chat-API.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrWebhookToken     = errors.New("invalid webhook token")
+	ErrWebhookIP        = errors.New("webhook sender IP is not allowed")
+	ErrWebhookSignature = errors.New("invalid webhook signature")
+	ErrWebhookReplay    = errors.New("webhook request was already received")
+)
+
+// WebhookAuth verifies incoming Chat-API webhook requests.
+type WebhookAuth struct {
+	DB *Database
+	// Shared token sent by Chat-API in the token query parameter.
+	Secret string
+	// Token of the previous webhook URL, accepted until PreviousUntil.
+	PreviousSecret string
+	PreviousUntil  time.Time
+	// If not empty, only these networks may send webhooks.
+	AllowedNets []*net.IPNet
+	// Reverse proxies whose X-Forwarded-For header is believed.
+	TrustedProxies []*net.IPNet
+	// Header with the hex HMAC-SHA256 of the body, keyed with Secret.
+	SignatureHeader string
+	// Identical bodies received within this window are rejected when they are stored in the inbox.
+	ReplayWindow time.Duration
+}
+
+// NewWebhookAuth creates a WebhookAuth from the configuration.
+// The secret is read from the database, and created on first use, unless it is set in the configuration.
+func NewWebhookAuth(ctx context.Context, db *Database, cf *ConfigChatAPI) (*WebhookAuth, error) {
+	auth := &WebhookAuth{
+		DB:              db,
+		Secret:          cf.WebhookSecret,
+		SignatureHeader: cf.WebhookSignatureHeader,
+		ReplayWindow:    24 * time.Hour,
+	}
+
+	// Persistent secret.
+	if auth.Secret == "" {
+		secret, err := db.GetOrCreateSetting(ctx, instanceKey(SettingWebhookSecret, cf.Name), generateToken)
+		if err != nil {
+			return nil, err
+		}
+		auth.Secret = secret
+	}
+
+	// IP allowlist and trusted proxies.
+	var err error
+	auth.AllowedNets, err = parseNets(cf.WebhookAllowedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("webhookAllowedIPs: %v", err)
+	}
+	auth.TrustedProxies, err = parseNets(cf.WebhookTrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("webhookTrustedProxies: %v", err)
+	}
+
+	return auth, nil
+}
+
+// parseNets parses IPs and CIDRs; an IP is a network of one address.
+func parseNets(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// URL adds the webhook token to u.
+func (auth *WebhookAuth) URL(u *url.URL) *url.URL {
+	uu := *u
+	q := uu.Query()
+	q.Set("token", auth.Secret)
+	uu.RawQuery = q.Encode()
+	return &uu
+}
+
+// Check returns an error if the request was not sent by Chat-API.
+// Replays are detected by Database.AddInboxEntry.
+func (auth *WebhookAuth) Check(r *http.Request, body []byte) error {
+	// Check token.
+	token := r.URL.Query().Get("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(auth.Secret)) != 1 {
+		previous := auth.PreviousSecret != "" && time.Now().Before(auth.PreviousUntil) &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(auth.PreviousSecret)) == 1
+		if !previous {
+			return ErrWebhookToken
+		}
+	}
+
+	// Check sender IP.
+	if len(auth.AllowedNets) > 0 && !containsIP(auth.AllowedNets, auth.remoteIP(r)) {
+		return ErrWebhookIP
+	}
+
+	// Check signature.
+	if auth.SignatureHeader != "" {
+		signature := strings.TrimPrefix(r.Header.Get(auth.SignatureHeader), "sha256=")
+		got, err := hex.DecodeString(signature)
+		if err != nil {
+			return ErrWebhookSignature
+		}
+		mac := hmac.New(sha256.New, []byte(auth.Secret))
+		mac.Write(body)
+		if !hmac.Equal(got, mac.Sum(nil)) {
+			return ErrWebhookSignature
+		}
+	}
+
+	// Request is from Chat-API.
+	return nil
+}
+
+// remoteIP returns the sender IP of r.
+// X-Forwarded-For is only read when the request comes from a trusted proxy. The sender
+// is then the rightmost address not added by a trusted proxy; addresses left of it
+// are set by the client and cannot be believed.
+func (auth *WebhookAuth) remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if !containsIP(auth.TrustedProxies, ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, xff := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(xff, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip = net.ParseIP(strings.TrimSpace(hops[i]))
+		if !containsIP(auth.TrustedProxies, ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// redactURL hides the token query parameter of a URL before it is logged.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	q := u.Query()
+	if q.Has("token") {
+		q.Set("token", "REDACTED")
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
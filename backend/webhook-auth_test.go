@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookAuthCheck(t *testing.T) {
+	body := []byte(`{"messages":[]}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+	allowed, _ := parseNets([]string{"203.0.113.0/24"})
+	proxies, _ := parseNets([]string{"10.0.0.1", "10.0.0.2"})
+
+	tests := []struct {
+		name       string
+		auth       WebhookAuth
+		query      string
+		remoteAddr string
+		xff        []string
+		signature  string
+		want       error
+	}{
+		{name: "token", query: "token=secret"},
+		{name: "no token", want: ErrWebhookToken},
+		{name: "wrong token", query: "token=other", want: ErrWebhookToken},
+		{name: "previous token", query: "token=old",
+			auth: WebhookAuth{PreviousSecret: "old", PreviousUntil: time.Now().Add(time.Minute)}},
+		{name: "expired previous token", query: "token=old", want: ErrWebhookToken,
+			auth: WebhookAuth{PreviousSecret: "old", PreviousUntil: time.Now().Add(-time.Minute)}},
+
+		{name: "allowed IP", query: "token=secret", remoteAddr: "203.0.113.5:1234",
+			auth: WebhookAuth{AllowedNets: allowed}},
+		{name: "other IP", query: "token=secret", remoteAddr: "198.51.100.5:1234", want: ErrWebhookIP,
+			auth: WebhookAuth{AllowedNets: allowed}},
+		{name: "XFF from untrusted sender", query: "token=secret", remoteAddr: "198.51.100.5:1234", xff: []string{"203.0.113.5"}, want: ErrWebhookIP,
+			auth: WebhookAuth{AllowedNets: allowed}},
+		{name: "XFF from trusted proxy", query: "token=secret", remoteAddr: "10.0.0.1:1234", xff: []string{"203.0.113.5"},
+			auth: WebhookAuth{AllowedNets: allowed, TrustedProxies: proxies}},
+		{name: "XFF through two proxies", query: "token=secret", remoteAddr: "10.0.0.1:1234", xff: []string{"203.0.113.5", "10.0.0.2"},
+			auth: WebhookAuth{AllowedNets: allowed, TrustedProxies: proxies}},
+		{name: "XFF spoofed by client", query: "token=secret", remoteAddr: "10.0.0.1:1234", xff: []string{"203.0.113.5, 198.51.100.5"}, want: ErrWebhookIP,
+			auth: WebhookAuth{AllowedNets: allowed, TrustedProxies: proxies}},
+
+		{name: "signature", query: "token=secret", signature: signature,
+			auth: WebhookAuth{SignatureHeader: "X-Signature"}},
+		{name: "signature with prefix", query: "token=secret", signature: "sha256=" + signature,
+			auth: WebhookAuth{SignatureHeader: "X-Signature"}},
+		{name: "no signature", query: "token=secret", want: ErrWebhookSignature,
+			auth: WebhookAuth{SignatureHeader: "X-Signature"}},
+		{name: "wrong signature", query: "token=secret", signature: signature[2:] + "00", want: ErrWebhookSignature,
+			auth: WebhookAuth{SignatureHeader: "X-Signature"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := tt.auth
+			auth.Secret = "secret"
+			r := httptest.NewRequest("POST", "/webhook?"+tt.query, nil)
+			if tt.remoteAddr != "" {
+				r.RemoteAddr = tt.remoteAddr
+			}
+			for _, xff := range tt.xff {
+				r.Header.Add("X-Forwarded-For", xff)
+			}
+			if tt.signature != "" {
+				r.Header.Set("X-Signature", tt.signature)
+			}
+			if err := auth.Check(r, body); err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddInboxEntryReplay(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+
+	tests := []struct {
+		name    string
+		payload string
+		window  time.Duration
+		want    error
+	}{
+		{"first", `{"messages":[1]}`, time.Hour, nil},
+		{"replay", `{"messages":[1]}`, time.Hour, ErrWebhookReplay},
+		{"other body", `{"messages":[2]}`, time.Hour, nil},
+		{"replay without window", `{"messages":[1]}`, 0, nil},
+	}
+	for _, tt := range tests {
+		err := db.AddInboxEntry(ctx, "default", []byte(tt.payload), tt.window)
+		if err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if n := countRows(t, db, "webhook_inbox"); n != 3 {
+		t.Errorf("webhook_inbox: got %d, want 3", n)
+	}
+}
@@ -0,0 +1,198 @@
+// Applies stored webhook requests to the database.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// WebhookInbox processes webhook requests stored by ChatAPIHTTP.Webhook.
+// Failed requests are retried; after MaxAttempts they are kept as dead until replayed.
+type WebhookInbox struct {
+	*ChatAPIDB
+	// Entries are marked as dead after this many attempts.
+	MaxAttempts int
+	// First retry delay, doubled after every failed attempt.
+	RetryInterval time.Duration
+	// Largest retry delay.
+	MaxRetryInterval time.Duration
+	// Processed entries are deleted after this long.
+	KeepProcessed time.Duration
+}
+
+func NewWebhookInbox(wadb *ChatAPIDB) *WebhookInbox {
+	return &WebhookInbox{
+		ChatAPIDB:        wadb,
+		MaxAttempts:      8,
+		RetryInterval:    5 * time.Second,
+		MaxRetryInterval: 30 * time.Minute,
+		KeepProcessed:    7 * 24 * time.Hour,
+	}
+}
+
+// Loop processes entries until ctx is done.
+func (wi *WebhookInbox) Loop(ctx context.Context) {
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+
+	for {
+		err := wi.ProcessDue(ctx)
+		if err != nil {
+			log.Printf("WebhookInbox.ProcessDue: %v", err)
+		}
+
+		// Delete old processed entries.
+		select {
+		case <-cleanup.C:
+			err = wi.DB.DeleteProcessedInboxEntries(ctx, time.Now().Add(-wi.KeepProcessed))
+			if err != nil {
+				log.Printf("Database.DeleteProcessedInboxEntries: %v", err)
+			}
+		default:
+		}
+
+		// Sleep until the next retry or a new entry.
+		wait := time.Minute
+		next, err := wi.DB.GetNextInboxAttempt(ctx, wi.Instance)
+		if err != nil {
+			log.Printf("Database.GetNextInboxAttempt: %v", err)
+		} else if next > 0 {
+			wait = time.Until(time.Unix(next, 0))
+			if wait < time.Second {
+				wait = time.Second
+			}
+			if wait > time.Minute {
+				wait = time.Minute
+			}
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, wait)
+		wi.DB.InboxW.Wait(waitCtx)
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// ProcessDue processes every entry that is due.
+func (wi *WebhookInbox) ProcessDue(ctx context.Context) error {
+	for {
+		entries, err := wi.DB.GetDueInboxEntries(ctx, wi.Instance, 100)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+
+		for _, e := range entries {
+			wi.Process(ctx, e)
+			err = wi.DB.UpdateInboxEntry(ctx, e)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Process applies one entry and updates e with the result.
+func (wi *WebhookInbox) Process(ctx context.Context, e *InboxEntry) {
+	now := time.Now()
+	e.Attempts++
+
+	err := wi.ProcessWebhook(ctx, e.Payload)
+	if err == nil {
+		e.Status = "done"
+		e.Processed = now.Unix()
+		e.LastError = ""
+		return
+	}
+	log.Printf("Webhook inbox entry %d failed: %v", e.ID, err)
+	e.LastError = err.Error()
+
+	// Give up.
+	if e.Attempts >= wi.MaxAttempts || errors.Is(err, ErrInvalidWebhook) {
+		e.Status = "dead"
+		return
+	}
+
+	// Retry with exponential backoff.
+	delay := wi.RetryInterval << (e.Attempts - 1)
+	if delay > wi.MaxRetryInterval || delay <= 0 {
+		delay = wi.MaxRetryInterval
+	}
+	e.NextAttempt = now.Add(delay).Unix()
+}
+
+// HTTPEntries sends stored webhook requests.
+//
+// Query parameters:
+// instance: only entries of this Chat-API instance.
+// status: only entries with this status (pending, done, dead).
+// limit: maximum number of entries, newest first (default 100).
+func (wi *WebhookInbox) HTTPEntries(w http.ResponseWriter, r *http.Request) {
+	uq := r.URL.Query()
+
+	// Get limit.
+	limit := 100
+	if uq.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(uq.Get("limit"))
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Get entries from database.
+	entries, err := wi.DB.GetInboxEntries(r.Context(), uq.Get("instance"), uq.Get("status"), limit)
+	if err != nil {
+		log.Printf("Database.GetInboxEntries: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	// Send entries to user.
+	json.NewEncoder(w).Encode(map[string]interface{}{"entries": entries})
+}
+
+// HTTPReplay queues dead entries again.
+//
+// Query parameters:
+// instance: Chat-API instance (the first one if missing).
+// id: entry ID; all dead entries if missing.
+func (wi *WebhookInbox) HTTPReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	uq := r.URL.Query()
+
+	// Get entry ID.
+	var id int64
+	if uq.Has("id") {
+		var err error
+		id, err = strconv.ParseInt(uq.Get("id"), 10, 64)
+		if err != nil || id <= 0 {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Update database.
+	replayed, err := wi.DB.ReplayInboxEntries(r.Context(), wi.Instance, id)
+	if err != nil {
+		log.Printf("Database.ReplayInboxEntries: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"replayed": replayed})
+}
@@ -0,0 +1,264 @@
+// Sends events to other systems through outbound webhooks.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Events sent to outbound webhooks.
+const (
+	EventMessageCreated = "message.created"
+	EventMessageUpdated = "message.updated"
+	EventMessageAck     = "message.ack"
+	EventMessageRevoked = "message.revoked"
+	EventChatUpdated    = "chat.updated"
+	EventChatAssigned   = "chat.assigned"
+	EventChatLabeled    = "chat.labeled"
+	EventAccountStatus  = "account.status"
+)
+
+// Subscribed returns true if the webhook wants to receive event.
+func (webhook *ConfigWebhook) Subscribed(event string) bool {
+	if len(webhook.Events) == 0 {
+		return true
+	}
+	for _, e := range webhook.Events {
+		if e == event || e == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the signature of a request body sent at timestamp.
+// Receivers compute HMAC-SHA256 of "<timestamp>.<body>" with the shared secret.
+func (webhook *ConfigWebhook) Sign(timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookSender delivers queued events to outbound webhooks.
+type WebhookSender struct {
+	DB     *Database
+	Client *http.Client
+	// Deliveries are marked as failed after this many attempts.
+	MaxAttempts int
+	// First retry delay, doubled after every failed attempt.
+	RetryInterval time.Duration
+	// Largest retry delay.
+	MaxRetryInterval time.Duration
+}
+
+func NewWebhookSender(db *Database) *WebhookSender {
+	return &WebhookSender{
+		DB:               db,
+		Client:           &http.Client{Timeout: 30 * time.Second},
+		MaxAttempts:      12,
+		RetryInterval:    10 * time.Second,
+		MaxRetryInterval: 6 * time.Hour,
+	}
+}
+
+// Loop delivers events until ctx is done.
+func (ws *WebhookSender) Loop(ctx context.Context) {
+	for {
+		err := ws.SendDue(ctx)
+		if err != nil {
+			log.Printf("WebhookSender.SendDue: %v", err)
+		}
+
+		// Sleep until the next attempt or a new event.
+		wait := time.Minute
+		next, err := ws.DB.GetNextWebhookAttempt(ctx)
+		if err != nil {
+			log.Printf("Database.GetNextWebhookAttempt: %v", err)
+		} else if next > 0 {
+			wait = time.Until(time.Unix(next, 0))
+			if wait < time.Second {
+				wait = time.Second
+			}
+			if wait > time.Minute {
+				wait = time.Minute
+			}
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, wait)
+		ws.DB.WebhookW.Wait(waitCtx)
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// SendDue attempts every delivery that is due.
+func (ws *WebhookSender) SendDue(ctx context.Context) error {
+	for {
+		deliveries, err := ws.DB.GetDueWebhookDeliveries(ctx, 100)
+		if err != nil {
+			return err
+		}
+		if len(deliveries) == 0 {
+			return nil
+		}
+
+		for _, d := range deliveries {
+			ws.Send(ctx, d)
+			err = ws.DB.UpdateWebhookDelivery(ctx, d)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Send makes one delivery attempt and updates d with the result.
+func (ws *WebhookSender) Send(ctx context.Context, d *WebhookDelivery) {
+	now := time.Now()
+	d.Attempts++
+
+	err := ws.post(ctx, d)
+	if err == nil {
+		d.Status = "delivered"
+		d.Delivered = now.Unix()
+		d.LastError = ""
+		return
+	}
+	log.Printf("Webhook delivery %d to %v failed: %v", d.ID, d.URL, err)
+	d.LastError = err.Error()
+
+	// Give up.
+	if d.Attempts >= ws.MaxAttempts {
+		d.Status = "failed"
+		return
+	}
+
+	// Retry with exponential backoff.
+	delay := ws.RetryInterval << (d.Attempts - 1)
+	if delay > ws.MaxRetryInterval || delay <= 0 {
+		delay = ws.MaxRetryInterval
+	}
+	d.NextAttempt = now.Add(delay).Unix()
+}
+
+func (ws *WebhookSender) post(ctx context.Context, d *WebhookDelivery) error {
+	// Find subscription.
+	var webhook *ConfigWebhook
+	for i := range ws.DB.Webhooks {
+		if ws.DB.Webhooks[i].URL == d.URL {
+			webhook = &ws.DB.Webhooks[i]
+			break
+		}
+	}
+	if webhook == nil {
+		d.Attempts = ws.MaxAttempts
+		return fmt.Errorf("webhook is no longer in the configuration")
+	}
+
+	// Create request.
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequestWithContext(ctx, "POST", d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		d.Attempts = ws.MaxAttempts
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.ID, 10))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	if webhook.Secret != "" {
+		req.Header.Set("X-Webhook-Signature", webhook.Sign(timestamp, d.Payload))
+	}
+
+	// Send request.
+	res, err := ws.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	// Check response.
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("HTTP status %v", res.Status)
+	}
+
+	return nil
+}
+
+// HTTPDeliveries sends the delivery log.
+//
+// Query parameters:
+// status: only deliveries with this status (pending, delivered, failed).
+// limit: maximum number of deliveries, newest first (default 100).
+func (ws *WebhookSender) HTTPDeliveries(w http.ResponseWriter, r *http.Request) {
+	uq := r.URL.Query()
+
+	// Get limit.
+	limit := 100
+	if uq.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(uq.Get("limit"))
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Get deliveries from database.
+	deliveries, err := ws.DB.GetWebhookDeliveries(r.Context(), uq.Get("status"), limit)
+	if err != nil {
+		log.Printf("Database.GetWebhookDeliveries: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+
+	// Send deliveries to user.
+	json.NewEncoder(w).Encode(map[string]interface{}{"deliveries": deliveries})
+}
+
+// HTTPRetry queues a failed delivery again.
+//
+// Query parameters:
+// id: delivery ID.
+func (ws *WebhookSender) HTTPRetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Get delivery ID.
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	// Update database.
+	err = ws.DB.RetryWebhookDelivery(r.Context(), id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Delivery not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Database.RetryWebhookDelivery: %v", err)
+		http.Error(w, "Cannot access database", http.StatusInternalServerError)
+		return
+	}
+}
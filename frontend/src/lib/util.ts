@@ -2,6 +2,12 @@ import type { Readable } from "svelte/store"
 import { readable } from "svelte/store"
 import { ErrTimeout } from "./fetch"
 
+// instanceKey identifies a chat or message across Chat-API instances,
+// since the same contact can write to several numbers.
+export function instanceKey(instance: string, id: string): string {
+    return `${instance ?? ''} ${id}`
+}
+
 export function sleep(ms: number): Promise<void> {
     return new Promise(resolve => setTimeout(resolve, ms))
 }
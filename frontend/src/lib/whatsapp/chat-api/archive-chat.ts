@@ -1,6 +1,8 @@
 import { getAuthorization } from "$lib/login";
+import { chatAPIURL } from "./url";
 
 export interface ArchiveChat {
+    instance?: string // Chat-API instance; not sent to Chat-API
     chatId?: string
     phone?: string
 }
@@ -11,12 +13,13 @@ export interface ArchiveChatResponse {
 }
 
 export function archiveChat(options: ArchiveChat): Promise<ArchiveChatResponse> {
-    return fetch(`/chat-api/archiveChat`, {
+    const { instance, ...body } = options
+    return fetch(chatAPIURL('archiveChat', instance), {
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
             'Authorization': `${getAuthorization()}`,
         },
-        body: JSON.stringify(options)
+        body: JSON.stringify(body)
     }).then(res => res.json())
 }
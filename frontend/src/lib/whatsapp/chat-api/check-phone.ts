@@ -1,6 +1,8 @@
 import { getAuthorization } from "$lib/login"
+import { chatAPIURL } from "./url"
 
 export interface CheckPhone {
+    instance?: string // Chat-API instance
     phone: string
 }
 
@@ -13,5 +15,5 @@ export function checkPhone(options: CheckPhone): Promise<CheckPhoneResponse> {
     const params = new URLSearchParams({ phone: options.phone })
     const headers = {}
     headers['Authorization'] = getAuthorization()
-    return fetch(`/chat-api/checkPhone?${params}`, { headers }).then(res => res.json())
+    return fetch(chatAPIURL('checkPhone', options.instance, params), { headers }).then(res => res.json())
 }
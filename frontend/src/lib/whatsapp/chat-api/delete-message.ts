@@ -1,6 +1,8 @@
 import { getAuthorization } from "$lib/login";
+import { chatAPIURL } from "./url";
 
 export interface DeleteMessage {
+    instance?: string // Chat-API instance; not sent to Chat-API
     messageId?: string
 }
 
@@ -10,12 +12,13 @@ export interface DeleteMessageResponse {
 }
 
 export function deleteMessage(options: DeleteMessage): Promise<DeleteMessageResponse> {
-    return fetch(`/chat-api/deleteMessage`, {
+    const { instance, ...body } = options
+    return fetch(chatAPIURL('deleteMessage', instance), {
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
             'Authorization': `${getAuthorization()}`,
         },
-        body: JSON.stringify(options)
+        body: JSON.stringify(body)
     }).then(res => res.json())
 }
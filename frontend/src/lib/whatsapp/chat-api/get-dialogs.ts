@@ -1,7 +1,9 @@
 import { getAuthorization } from "$lib/login"
 import type { Dialog } from "./types"
+import { chatAPIURL } from "./url"
 
 export interface GetDialogs {
+    instance?: string // Chat-API instance
     limit?: number
     page?: number
     order?: string
@@ -18,5 +20,5 @@ export function getDialogs(options: GetDialogs): Promise<GetDialogsResponse> {
     if (options.order != null) params.set('order', options.order)
     const headers = {}
     headers['Authorization'] = getAuthorization()
-    return fetch(`/chat-api/dialogs?${params}`, { headers }).then(res => res.json())
+    return fetch(chatAPIURL('dialogs', options.instance, params), { headers }).then(res => res.json())
 }
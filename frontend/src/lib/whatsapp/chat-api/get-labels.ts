@@ -1,12 +1,13 @@
 import { getAuthorization } from "$lib/login"
 import type { Label } from "./types"
+import { chatAPIURL } from "./url"
 
 export interface GetLabelsResponse {
     labels: Label[]
 }
 
-export function getLabels(): Promise<GetLabelsResponse> {
+export function getLabels(instance?: string): Promise<GetLabelsResponse> {
     const headers = {}
     headers['Authorization'] = getAuthorization()
-    return fetch(`/chat-api/labelsList`, { headers }).then(res => res.json())
+    return fetch(chatAPIURL('labelsList', instance), { headers }).then(res => res.json())
 }
@@ -1,6 +1,8 @@
 import type { Message } from "./types"
+import { chatAPIURL } from "./url"
 
 export interface GetMessages {
+    instance?: string // Chat-API instance
     lastMessageNumber?: number
     last?: boolean
     chatId?: string
@@ -22,5 +24,5 @@ export function getMessages(options: GetMessages): Promise<GetMessagesResponse>
     if (options.limit != null) params.set('limit', options.limit.toString())
     if (options.minTime != null) params.set('min_time', options.minTime.toString())
     if (options.maxTime != null) params.set('max_time', options.maxTime.toString())
-    return fetch(`/chat-api/messages?${params}`).then(res => res.json())
+    return fetch(chatAPIURL('messages', options.instance, params)).then(res => res.json())
 }
@@ -1,6 +1,8 @@
 import { getAuthorization } from "$lib/login";
+import { chatAPIURL } from "./url";
 
 export interface LabelChat {
+    instance?: string // Chat-API instance; not sent to Chat-API
     labelId: string
     chatId?: string
     phone?: string
@@ -12,12 +14,13 @@ export interface LabelChatResponse {
 }
 
 export function labelChat(options: LabelChat): Promise<LabelChatResponse> {
-    return fetch(`/chat-api/labelChat`, {
+    const { instance, ...body } = options
+    return fetch(chatAPIURL('labelChat', instance), {
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
             'Authorization': `${getAuthorization()}`,
         },
-        body: JSON.stringify(options)
+        body: JSON.stringify(body)
     }).then(res => res.json())
 }
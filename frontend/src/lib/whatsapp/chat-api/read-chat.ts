@@ -1,6 +1,8 @@
 import { getAuthorization } from "$lib/login";
+import { chatAPIURL } from "./url";
 
 export interface ReadChat {
+    instance?: string // Chat-API instance; not sent to Chat-API
     chatId?: string
     phone?: string
 }
@@ -12,12 +14,13 @@ export interface ReadChatResponse {
 }
 
 export function readChat(options: ReadChat): Promise<ReadChatResponse> {
-    return fetch(`/chat-api/readChat`, {
+    const { instance, ...body } = options
+    return fetch(chatAPIURL('readChat', instance), {
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
             'Authorization': `${getAuthorization()}`,
         },
-        body: JSON.stringify(options)
+        body: JSON.stringify(body)
     }).then(res => res.json())
 }
@@ -1,6 +1,8 @@
 import { getAuthorization } from "$lib/login";
+import { chatAPIURL } from "./url";
 
 export interface SendMessage {
+    instance?: string // Chat-API instance; not sent to Chat-API
     body: string
     quotedMsgId?: string
     chatId?: string
@@ -16,12 +18,13 @@ export interface SendMessageResponse {
 }
 
 export function sendMessage(options: SendMessage): Promise<SendMessageResponse> {
-    return fetch(`/chat-api/sendMessage`, {
+    const { instance, ...body } = options
+    return fetch(chatAPIURL('sendMessage', instance), {
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
             'Authorization': `${getAuthorization()}`,
         },
-        body: JSON.stringify(options)
+        body: JSON.stringify(body)
     }).then(res => res.json())
 }
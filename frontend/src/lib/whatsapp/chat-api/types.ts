@@ -1,5 +1,6 @@
 export interface Dialog {
     __rowID: number // not from Chat-API, but our own local database
+    __instance: string // Chat-API instance of the chat
     id: string
     name: string
     image: string
@@ -46,6 +47,10 @@ export interface ParticipantInfo {
 
 export interface Message {
     __rowID: number // not from Chat-API, but our own local database
+    __instance: string // Chat-API instance that sent or received the message
+    __seq?: number // change sequence number, only set when following changes
+    __revoked?: number // unix time the message was deleted for everyone
+    __revokedBy?: string // "contact" | "phone" | "user:<name>"
     ack: string | null // null | "viewed" | "delivered"
     author: string // "5512345678@c.us" | "undefined"
     body: string // "Oi! Teste!"
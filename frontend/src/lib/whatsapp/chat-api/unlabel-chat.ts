@@ -1,6 +1,8 @@
 import { getAuthorization } from "$lib/login";
+import { chatAPIURL } from "./url";
 
 export interface UnlabelChat {
+    instance?: string // Chat-API instance; not sent to Chat-API
     labelId: string
     chatId?: string
     phone?: string
@@ -12,12 +14,13 @@ export interface UnlabelChatResponse {
 }
 
 export function unlabelChat(options: UnlabelChat): Promise<UnlabelChatResponse> {
-    return fetch(`/chat-api/unlabelChat`, {
+    const { instance, ...body } = options
+    return fetch(chatAPIURL('unlabelChat', instance), {
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
             'Authorization': `${getAuthorization()}`,
         },
-        body: JSON.stringify(options)
+        body: JSON.stringify(body)
     }).then(res => res.json())
 }
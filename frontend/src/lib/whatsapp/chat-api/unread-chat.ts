@@ -1,6 +1,8 @@
 import { getAuthorization } from "$lib/login";
+import { chatAPIURL } from "./url";
 
 export interface UnreadChat {
+    instance?: string // Chat-API instance; not sent to Chat-API
     chatId?: string
     phone?: string
 }
@@ -11,12 +13,13 @@ export interface UnreadChatResponse {
 }
 
 export function unreadChat(options: UnreadChat): Promise<UnreadChatResponse> {
-    return fetch(`/chat-api/unreadChat`, {
+    const { instance, ...body } = options
+    return fetch(chatAPIURL('unreadChat', instance), {
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
             'Authorization': `${getAuthorization()}`,
         },
-        body: JSON.stringify(options)
+        body: JSON.stringify(body)
     }).then(res => res.json())
 }
@@ -0,0 +1,7 @@
+// chatAPIURL returns the URL of a Chat-API method, proxied by the server to instance;
+// without instance, the server uses the first one.
+export function chatAPIURL(method: string, instance?: string, params = new URLSearchParams()): string {
+    if (instance) params.set('instance', instance)
+    const query = params.toString()
+    return query ? `/chat-api/${method}?${query}` : `/chat-api/${method}`
+}
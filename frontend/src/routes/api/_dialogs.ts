@@ -1,12 +1,12 @@
 import type { Dialog } from "$lib/whatsapp/chat-api/types"
 import { getAuthorization } from "$lib/login"
 import { writable } from "svelte/store"
-import { syncStore } from "$lib/util"
+import { instanceKey, syncStore } from "$lib/util"
 import { f } from "$lib/fetch"
 
 // All dialogs received from the server.
 export const dialog$ = writable([] as Dialog[]) // [Dialog]
-export const dialogsByID = {} as Record<string, Dialog> // {ID: [Dialog]}
+export const dialogsByID = {} as Record<string, Dialog> // {instanceKey(Instance, ID): [Dialog]}
 
 let lastRowID: number = 0
 
@@ -22,7 +22,7 @@ function updateStores(newDialogs: Dialog[]): void {
     }
     // Update dialogsByID.
     for (const dialog of newDialogs) {
-        dialogsByID[dialog.id] = dialog
+        dialogsByID[instanceKey(dialog.__instance, dialog.id)] = dialog
     }
     // Update the store.
     dialog$.set(Object.values(dialogsByID))
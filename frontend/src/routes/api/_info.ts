@@ -1,13 +1,17 @@
 import { browser } from "$app/env"
 import { f } from "$lib/fetch"
 import { getAuthorization } from "$lib/login"
+import { instanceKey } from "$lib/util"
 import { get, writable } from "svelte/store"
+import { getInstances } from "./_instances"
 
+// Keys are instanceKey(instance, chat ID).
 export const chatInfo = writable([] as ChatInfo[])
 export let chatInfoByChatID = {} as Record<string, ChatInfo>
 export const readingByChatID = writable({} as Record<string, boolean>)
 
 export interface ChatInfo {
+    instance: string // not from the server, but the instance it was fetched from
     chatID: string
     readBefore: number
 }
@@ -19,30 +23,40 @@ export interface GetInfoJSON {
 export async function getInfo(): Promise<void> {
     const headers = {}
     headers['Authorization'] = getAuthorization()
-    const res = await fetch('/api/chat/info', { headers })
-    const json = await res.json() as GetInfoJSON
+
+    const infos = [] as ChatInfo[]
+    for (const instance of await getInstances()) {
+        const params = new URLSearchParams({ instance })
+        const res = await fetch(`/api/chat/info?${params}`, { headers })
+        const json = await res.json() as GetInfoJSON
+        for (const info of json.infos) {
+            infos.push({ ...info, instance })
+        }
+    }
 
     chatInfoByChatID = {}
-    for (const info of json.infos) {
-        chatInfoByChatID[info.chatID] = info
+    for (const info of infos) {
+        chatInfoByChatID[instanceKey(info.instance, info.chatID)] = info
     }
 
-    chatInfo.set(json.infos)
+    chatInfo.set(infos)
 }
 
-export async function setChatAsRead(chatID: string, timestamp: number): Promise<void> {
+export async function setChatAsRead(instance: string, chatID: string, timestamp: number): Promise<void> {
+    const key = instanceKey(instance, chatID)
     const $readingByChatID = get(readingByChatID)
-    if ($readingByChatID[chatID]) return
+    if ($readingByChatID[key]) return
 
-    console.log("setChatAsRead(%o, %o)", chatID, timestamp)
+    console.log("setChatAsRead(%o, %o, %o)", instance, chatID, timestamp)
 
     try {
-        $readingByChatID[chatID] = true
+        $readingByChatID[key] = true
         readingByChatID.set($readingByChatID)
 
         const headers = {}
         headers['Authorization'] = getAuthorization()
-        const res = await f(`/api/chat/info/read`, {
+        const params = new URLSearchParams({ instance })
+        const res = await f(`/api/chat/info/read?${params}`, {
             method: 'POST', headers, timeout: 10000,
             body: JSON.stringify({ chatID, timestamp }),
         })
@@ -55,14 +69,14 @@ export async function setChatAsRead(chatID: string, timestamp: number): Promise<
         setTimeout(() => setChatAsRead.apply(this, arguments), 1000)
         return
     } finally {
-        delete $readingByChatID[chatID]
+        delete $readingByChatID[key]
         readingByChatID.set($readingByChatID)
     }
 
-    let info = chatInfoByChatID[chatID]
+    let info = chatInfoByChatID[key]
     if (info == null) {
-        info = { chatID, readBefore: timestamp }
-        chatInfoByChatID[chatID] = info
+        info = { instance, chatID, readBefore: timestamp }
+        chatInfoByChatID[key] = info
         chatInfo.update(infos => [...infos, info])
     } else {
         info.readBefore = timestamp
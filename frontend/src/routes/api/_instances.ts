@@ -0,0 +1,25 @@
+import { getAuthorization } from "$lib/login"
+import { writable } from "svelte/store"
+
+// Names of the Chat-API instances, in the order of the configuration.
+export const instance$ = writable([] as string[])
+
+export interface AccountStatus {
+    instance: string
+    state: string
+}
+
+export interface GetInstancesJSON {
+    instances: AccountStatus[]
+}
+
+export async function getInstances(): Promise<string[]> {
+    const headers = {}
+    headers['Authorization'] = getAuthorization()
+    const res = await fetch('/api/instances', { headers })
+    const json = await res.json() as GetInstancesJSON
+
+    const instances = json.instances.map(status => status.instance)
+    instance$.set(instances)
+    return instances
+}
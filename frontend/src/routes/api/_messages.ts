@@ -1,18 +1,19 @@
 import type { Message } from "$lib/whatsapp/chat-api/types"
 import { getAuthorization } from "$lib/login"
 import { writable } from "svelte/store"
-import { syncStore } from "$lib/util"
+import { instanceKey, syncStore } from "$lib/util"
 import { f } from "$lib/fetch"
 
 // All messages received from the server.
 export const message$ = writable([] as Message[]) // [Message]
-export const messagesByID = {} as Record<string, Message> // {ID: [Message]}
-export const messagesByChatID = {} as Record<string, Record<string, Message>> // {ChatID: {ID: [Message]}}
-export const newestMessageTimeByChatID = {} as Record<string, number> // {ChatID: Timestamp}
+// Keys are instanceKey(instance, ID), since chats and messages of different instances can share IDs.
+export const messagesByID = {} as Record<string, Message> // {Key: [Message]}
+export const messagesByChatID = {} as Record<string, Record<string, Message>> // {ChatKey: {Key: [Message]}}
+export const newestMessageTimeByChatID = {} as Record<string, number> // {ChatKey: Timestamp}
 
-// The ID of the last message fetched from the server.
-// Function getMessages uses this to only fetch new messages.
-let lastRowID: number = 0
+// The sequence number of the last message change fetched from the server.
+// Function getMessages uses this to only fetch new and changed messages.
+let lastSeq: number = 0
 
 // All messages received from the server should be given to this function.
 // It updates all variables above and then updates the store.
@@ -20,28 +21,23 @@ function updateStores(newMessages: Message[]): void {
     if (newMessages.length === 0) {
         return
     }
-    // Update row ID.
-    for (const message of newMessages) {
-        if (message.__rowID > lastRowID) {
-            lastRowID = message.__rowID
-        }
-    }
     // Update newestMessageTimeByChatID.
     for (const message of newMessages) {
-        const time = newestMessageTimeByChatID[message.chatId] ?? 0
+        const chatKey = instanceKey(message.__instance, message.chatId)
+        const time = newestMessageTimeByChatID[chatKey] ?? 0
         if (message.time > time) {
-            newestMessageTimeByChatID[message.chatId] = message.time
+            newestMessageTimeByChatID[chatKey] = message.time
         }
     }
     // Update messagesByID.
     for (const message of newMessages) {
-        messagesByID[message.id] = message
+        messagesByID[instanceKey(message.__instance, message.id)] = message
     }
     // Update messagesByChatID.
     for (const message of newMessages) {
-        const chatID = message.chatId
-        if (!chatID) continue
-        (messagesByChatID[chatID] ??= {})[message.id] = message
+        if (!message.chatId) continue
+        const messages = messagesByChatID[instanceKey(message.__instance, message.chatId)] ??= {}
+        messages[instanceKey(message.__instance, message.id)] = message
     }
     // Update the store.
     message$.set(Object.values(messagesByID))
@@ -52,11 +48,17 @@ export interface GetMessagesJSON {
     messages: Message[]
 }
 
+// GetAllMessagesJSON is the shape of new and changed messages.
+export interface GetAllMessagesJSON extends GetMessagesJSON {
+    seq: number // sequence number of the last change
+    hasMore: boolean // more changes follow seq
+}
+
 export async function getMessages(): Promise<void> {
-    console.log(`Getting messages after row ID %o.`, lastRowID)
+    console.log(`Getting messages after change %o.`, lastSeq)
 
     const params = new URLSearchParams()
-    params.set('id', lastRowID.toString())
+    params.set('seq', lastSeq.toString())
     params.set('wait', 'true')
 
     const headers = {}
@@ -65,19 +67,45 @@ export async function getMessages(): Promise<void> {
     const res = await f(`/api/messages/all?${params}`, { headers, timeout: 30000 })
     // TODO: Handle errors.
 
-    const json: GetMessagesJSON = await res.json()
+    const json: GetAllMessagesJSON = await res.json()
+    if (json.seq > lastSeq) {
+        lastSeq = json.seq
+    }
     updateStores(json.messages)
+    // Fetch the next page without waiting.
+    if (json.hasMore) {
+        return getMessages()
+    }
+}
+
+// Cursor of the oldest message fetched from each chat.
+// Function getChatMessages uses this to fetch older pages.
+const oldestCursorByChatID = {} as Record<string, string> // {ChatKey: Cursor}
+
+// Whether the server has messages older than those fetched.
+export const hasOlderMessages$ = writable({} as Record<string, boolean>) // {ChatKey: boolean}
+
+// GetChatMessagesJSON is the shape of a page of chat messages.
+export interface GetChatMessagesJSON extends GetMessagesJSON {
+    before: string // cursor of the first message
+    after: string // cursor of the last message
+    hasMore: boolean
 }
 
 export interface GetChatMessagesOptions {
-    update: boolean
+    update: boolean // copy the page from Chat-API first
+    older?: boolean // fetch the page before the oldest message fetched
 }
 
-export async function getChatMessages(chatID: string, { update }: GetChatMessagesOptions = { update: false }): Promise<void> {
-    console.log(`Getting messages from chat ID %o.`, chatID)
+export async function getChatMessages(instance: string, chatID: string, { update, older }: GetChatMessagesOptions = { update: false }): Promise<void> {
+    console.log(`Getting messages from chat ID %o of instance %o.`, chatID, instance)
 
+    const chatKey = instanceKey(instance, chatID)
+    const cursor = oldestCursorByChatID[chatKey]
     const params = new URLSearchParams()
+    if (instance) params.set('instance', instance)
     params.set('chat_id', chatID)
+    if (older && cursor) params.set('before', cursor)
     if (update) params.set('update', 'true')
 
     const headers = {}
@@ -86,7 +114,12 @@ export async function getChatMessages(chatID: string, { update }: GetChatMessage
     const res = await f(`/api/messages/chat_id?${params}`, { headers, timeout: 30000 })
     // TODO: Handle errors.
 
-    const json: GetMessagesJSON = await res.json()
+    const json: GetChatMessagesJSON = await res.json()
+    // Reloading the newest page does not forget older pages.
+    if (json.before && (!cursor || params.has('before'))) {
+        oldestCursorByChatID[chatKey] = json.before
+        hasOlderMessages$.update(more => ({ ...more, [chatKey]: json.hasMore }))
+    }
     updateStores(json.messages)
 }
 
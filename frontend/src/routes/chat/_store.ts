@@ -1,12 +1,15 @@
 import type { ChatInfo } from "../api/_info"
 import type { Message } from "$lib/whatsapp/chat-api/types"
 import { derived, writable } from "svelte/store"
+import { instanceKey } from "$lib/util"
 import { chatInfo, chatInfoByChatID } from "../api/_info"
 import { messagesByChatID, message$ } from "../api/_messages"
 import { dialog$ } from "../api/_dialogs"
 
 // One screen contact.
 export interface ScreenChat {
+    key: string // instanceKey(instance, id)
+    instance: string
     id: string
     chatName: string
     senderName: string
@@ -21,8 +24,19 @@ export interface ScreenMessage extends Message {
     [MessageIsRead]?: boolean
 }
 
-// ID of the currently selected chat.
-export const selectedChatID = writable('')
+// A chat is identified by its Chat-API instance and ID.
+export interface SelectedChat {
+    instance: string
+    id: string
+}
+
+export const noChat: SelectedChat = { instance: '', id: '' }
+
+// The currently selected chat, or noChat.
+export const selectedChat = writable(noChat)
+
+// Key of the currently selected chat, or '' if none is selected.
+export const selectedChatKey = derived(selectedChat, $selectedChat => $selectedChat.id ? instanceKey($selectedChat.instance, $selectedChat.id) : '')
 
 // Contact filter
 export const screenChatsFilter = writable('')
@@ -31,29 +45,34 @@ export const allScreenChats = derived([dialog$, message$, chatInfo], ([$dialog,
     console.log('Updating screenChats %o + %o.', $dialog.length, $message.length)
 
     const chats = [] as ScreenChat[]
-    const chatByID = {} as Record<string, ScreenChat>
+    const chatByKey = {} as Record<string, ScreenChat>
 
-    function getChat(chatID: string): ScreenChat {
-        let chat = chatByID[chatID]
+    function getChat(instance: string, chatID: string): ScreenChat {
+        const key = instanceKey(instance, chatID)
+        let chat = chatByKey[key]
         if (chat === undefined) {
             chat = {
+                key,
+                instance,
                 id: chatID,
                 chatName: '',
                 senderName: '',
                 time: 0,
                 unread: 0,
             }
-            chatByID[chatID] = chat
+            chatByKey[key] = chat
             chats.push(chat)
         }
-        return chatByID[chatID]
+        return chat
     }
 
     // Add chats from messages.
-    for (const [chatID, messages] of Object.entries(messagesByChatID)) {
-        const chat = getChat(chatID)
+    for (const [chatKey, messages] of Object.entries(messagesByChatID)) {
+        const first = Object.values(messages)[0]
+        if (!first) continue
+        const chat = getChat(first.__instance, first.chatId)
         // Get the time of the last read message.
-        const info = chatInfoByChatID[chatID] ?? {} as ChatInfo
+        const info = chatInfoByChatID[chatKey] ?? {} as ChatInfo
         const lastReadMessage = info.readBefore ?? 0
         // Count the number of unread messages.
         for (const message of Object.values(messages)) {
@@ -89,7 +108,7 @@ export const allScreenChats = derived([dialog$, message$, chatInfo], ([$dialog,
 
     // Add chats from dialogs.
     for (const dialog of $dialog) {
-        const chat = getChat(dialog.id)
+        const chat = getChat(dialog.__instance, dialog.id)
         chat.chatName = dialog.name
         if (chat.time === 0) {
             chat.time = dialog.last_time
@@ -117,15 +136,15 @@ export const screenChats = derived([allScreenChats, screenChatsFilter], ([chats,
 })
 
 // ScreenMessage's - Right div.
-export const screenMessages = derived([message$, chatInfo, selectedChatID], ([$message, _chatInfo, selectedChatID]) => {
+export const screenMessages = derived([message$, chatInfo, selectedChatKey], ([$message, _chatInfo, selectedChatKey]) => {
     console.log('Updating screenMessages %o.', $message.length)
 
     let messages: ScreenMessage[]
 
     // If a chat has been selected, show all messages in that chat.
     // Otherwise, show the most recent messages from all chats.
-    if (selectedChatID) {
-        const messagesByID = messagesByChatID[selectedChatID]
+    if (selectedChatKey) {
+        const messagesByID = messagesByChatID[selectedChatKey]
         if (!messagesByID) return []
         messages = Object.values(messagesByID)
         messages.sort((a, b) => b.time - a.time || b.messageNumber - a.messageNumber)
@@ -136,11 +155,10 @@ export const screenMessages = derived([message$, chatInfo, selectedChatID], ([$m
     }
     // Check whether each message has been read.
     for (const message of messages) {
-        const chatID = message.chatId
-        if (!chatID) {
+        if (!message.chatId) {
             continue
         }
-        const info = chatInfoByChatID[chatID]
+        const info = chatInfoByChatID[instanceKey(message.__instance, message.chatId)]
         if (!info) {
             continue
         }